@@ -0,0 +1,342 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/AntonBozhinov/sentinel/wallet"
+	"github.com/pkg/errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// restoreBatchSize bounds the entries written in one transaction while a backup is restored
+const restoreBatchSize = 1000
+
+// backupHeader starts a backup. It is followed by every entry of the database
+// as a backupEntry, an entry without a key and the backupTrailer.
+type backupHeader struct {
+	Network     string
+	GenesisHash []byte
+	TipHash     []byte
+	Height      int
+	Created     int64
+}
+
+type backupEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// backupTrailer ends a backup with the wallets file, empty when there was
+// none, and the sha256 over the entries and the wallets
+type backupTrailer struct {
+	Entries  int
+	Wallets  []byte
+	Checksum []byte
+}
+
+// BackupInfo describes a backup
+type BackupInfo struct {
+	Network     string
+	GenesisHash []byte
+	TipHash     []byte
+	Height      int
+	Created     time.Time
+	Entries     int
+	Wallets     bool
+}
+
+// addBackupEntry feeds an entry to the checksum of a backup, lengths first so
+// entries can not run into each other
+func addBackupEntry(h hash.Hash, key, value []byte) {
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, uint64(len(key)))
+	h.Write(length)
+	h.Write(key)
+	binary.BigEndian.PutUint64(length, uint64(len(value)))
+	h.Write(length)
+	h.Write(value)
+}
+
+// Backup writes a consistent copy of the chain to w while it stays in use: the
+// whole database, blocks, indexes, the UTXO set and the mempool, is read in one
+// transaction after the UTXO cache is flushed. The wallets file of the data
+// directory is included when there is one. See RestoreBackup.
+func (chain *BlockChain) Backup(w io.Writer) (BackupInfo, error) {
+	if err := (UTXOSet{BlockChain: chain}).flushCache(); err != nil {
+		return BackupInfo{}, err
+	}
+	var wallets []byte
+	if chain.opts.Store == nil {
+		data, err := ioutil.ReadFile(wallet.FilePath(chain.opts.dataDir()))
+		if err != nil && !os.IsNotExist(err) {
+			return BackupInfo{}, errors.Wrap(err, "error reading the wallets file")
+		}
+		wallets = data
+	}
+
+	info := BackupInfo{Network: chain.Params.Name, GenesisHash: chain.GenesisHash, Created: time.Now(), Wallets: len(wallets) > 0}
+	enc := gob.NewEncoder(w)
+	checksum := sha256.New()
+	err := chain.Database.View(func(txn storage.Txn) error {
+		tip, err := lastBlock(txn)
+		if err != nil {
+			return err
+		}
+		info.TipHash, info.Height = tip.Hash, tip.Height
+		header := backupHeader{info.Network, info.GenesisHash, info.TipHash, info.Height, info.Created.Unix()}
+		if err := enc.Encode(header); err != nil {
+			return errors.Wrap(err, "error writing the backup header")
+		}
+
+		it := txn.NewIterator(storage.IteratorOptions{})
+		defer it.Close()
+		for ; it.Valid(); it.Next() {
+			key := it.Key()
+			value, err := it.Value()
+			if err != nil {
+				return errors.Wrapf(err, "error reading key %q", key)
+			}
+			if err := enc.Encode(backupEntry{key, value}); err != nil {
+				return errors.Wrapf(err, "error writing key %q", key)
+			}
+			addBackupEntry(checksum, key, value)
+			info.Entries++
+		}
+		return nil
+	})
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	if err := enc.Encode(backupEntry{}); err != nil {
+		return BackupInfo{}, errors.Wrap(err, "error writing the end of the entries")
+	}
+	checksum.Write(wallets)
+	if err := enc.Encode(backupTrailer{info.Entries, wallets, checksum.Sum(nil)}); err != nil {
+		return BackupInfo{}, errors.Wrap(err, "error writing the backup trailer")
+	}
+	return info, nil
+}
+
+// BackupFile writes a backup to file, see Backup. The file only appears once
+// the backup is complete.
+func (chain *BlockChain) BackupFile(file string) (BackupInfo, error) {
+	partial := file + ".partial"
+	f, err := os.Create(partial)
+	if err != nil {
+		return BackupInfo{}, errors.Wrap(err, "error creating the backup file")
+	}
+	info, err := chain.Backup(f)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "error writing the backup file")
+	}
+	if err == nil {
+		err = errors.Wrap(os.Rename(partial, file), "error moving the backup file in place")
+	}
+	if err != nil {
+		os.Remove(partial)
+		return BackupInfo{}, err
+	}
+	return info, nil
+}
+
+// readBackup reads a backup from r, passing every entry to add, and fails with
+// ErrCorruptData when it is truncated or its checksum does not match. It
+// returns the wallets file of the backup.
+func readBackup(r io.Reader, add func(key, value []byte) error) (BackupInfo, []byte, error) {
+	dec := gob.NewDecoder(r)
+	var header backupHeader
+	if err := dec.Decode(&header); err != nil {
+		return BackupInfo{}, nil, errors.Wrapf(ErrCorruptData, "error reading the backup header: %v", err)
+	}
+	info := BackupInfo{
+		Network:     header.Network,
+		GenesisHash: header.GenesisHash,
+		TipHash:     header.TipHash,
+		Height:      header.Height,
+		Created:     time.Unix(header.Created, 0),
+	}
+	checksum := sha256.New()
+	for {
+		var entry backupEntry
+		if err := dec.Decode(&entry); err != nil {
+			return info, nil, errors.Wrapf(ErrCorruptData, "error reading entry %d of the backup: %v", info.Entries, err)
+		}
+		if len(entry.Key) == 0 {
+			break
+		}
+		addBackupEntry(checksum, entry.Key, entry.Value)
+		if err := add(entry.Key, entry.Value); err != nil {
+			return info, nil, err
+		}
+		info.Entries++
+	}
+	var trailer backupTrailer
+	if err := dec.Decode(&trailer); err != nil {
+		return info, nil, errors.Wrapf(ErrCorruptData, "error reading the backup trailer: %v", err)
+	}
+	checksum.Write(trailer.Wallets)
+	if trailer.Entries != info.Entries || bytes.Compare(trailer.Checksum, checksum.Sum(nil)) != 0 {
+		return info, nil, errors.Wrap(ErrCorruptData, "the backup does not match its checksum")
+	}
+	info.Wallets = len(trailer.Wallets) > 0
+	return info, trailer.Wallets, nil
+}
+
+// CheckBackup reads a whole backup from r and fails with ErrCorruptData unless it is complete and intact
+func CheckBackup(r io.Reader) (BackupInfo, error) {
+	info, _, err := readBackup(r, func(key, value []byte) error { return nil })
+	return info, err
+}
+
+// RestoreBackup replaces the chain and the wallets file in the data directory of
+// opts with a backup read from r. The backup is first restored to a staging
+// directory and validated there: its checksum, its genesis, the headers and
+// blocks of its chain, see VerifyBlocks, the hash of its UTXO set and its
+// wallets. Only then the database of the data directory is swapped for it, a
+// database opened by a running node is not replaced. Wallets already in the
+// data directory are kept when the backup has none.
+func RestoreBackup(opts Options, r io.Reader) (BackupInfo, error) {
+	if err := opts.validate(); err != nil {
+		return BackupInfo{}, err
+	}
+	if opts.Store != nil {
+		return BackupInfo{}, errors.New("a backup can only be restored to a data directory")
+	}
+	chainParams := opts.params()
+	staging := filepath.Join(opts.dataDir(), "restore")
+	if err := os.RemoveAll(staging); err != nil {
+		return BackupInfo{}, errors.Wrap(err, "error clearing the staging directory")
+	}
+	defer os.RemoveAll(staging)
+	stagingOpts := Options{DataDir: staging, Params: opts.Params, UTXOCacheSize: -1}
+
+	db, err := openDB(stagingOpts)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	var batch []backupEntry
+	writeBatch := func() error {
+		err := db.Update(func(txn storage.Txn) error {
+			for _, entry := range batch {
+				if err := txn.Set(entry.Key, entry.Value); err != nil {
+					return errors.Wrapf(err, "error restoring key %q", entry.Key)
+				}
+			}
+			return nil
+		})
+		batch = batch[:0]
+		return err
+	}
+	info, wallets, err := readBackup(r, func(key, value []byte) error {
+		batch = append(batch, backupEntry{key, value})
+		if len(batch) < restoreBatchSize {
+			return nil
+		}
+		return writeBatch()
+	})
+	if err == nil {
+		err = writeBatch()
+	}
+	if closeErr := db.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "error closing the staging database")
+	}
+	if err != nil {
+		return info, err
+	}
+	if info.Network != chainParams.Name {
+		return info, errors.Wrapf(ErrGenesisMismatch, "the backup is of %s, not %s", info.Network, chainParams.Name)
+	}
+	if len(wallets) > 0 {
+		if err := ioutil.WriteFile(wallet.FilePath(staging), wallets, 0600); err != nil {
+			return info, errors.Wrap(err, "error writing the wallets file")
+		}
+		if _, err := wallet.OpenWallets(staging, chainParams.AddressVersion); err != nil {
+			return info, err
+		}
+	}
+	if err := checkRestored(stagingOpts, info); err != nil {
+		return info, errors.Wrap(err, "the backup is not valid")
+	}
+	return info, swapDataDir(opts, stagingOpts, len(wallets) > 0)
+}
+
+// checkRestored validates the chain restored from a backup with opts
+func checkRestored(opts Options, info BackupInfo) error {
+	chain, err := Open(opts)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	if bytes.Compare(chain.GenesisHash, info.GenesisHash) != 0 || bytes.Compare(chain.LastHash(), info.TipHash) != 0 {
+		return errors.Wrapf(ErrCorruptData, "the restored chain runs from %x to %x, the backup from %x to %x",
+			chain.GenesisHash, chain.LastHash(), info.GenesisHash, info.TipHash)
+	}
+	if err := chain.VerifyChain(VerifyBlocks, nil); err != nil {
+		return err
+	}
+	return chain.Database.View(func(txn storage.Txn) error {
+		stored, err := utxoHash(txn)
+		if err != nil {
+			return err
+		}
+		computed, err := computeUTXOHash(txn)
+		if err != nil {
+			return err
+		}
+		if bytes.Compare(stored.Sum(), computed.Sum()) != 0 {
+			return errors.Wrapf(ErrCorruptData, "the UTXO set hashes to %x instead of the recorded %x", computed.Sum(), stored.Sum())
+		}
+		utxoTip, err := txn.Get([]byte(utxoTipKey))
+		if err != nil || bytes.Compare(utxoTip, chain.LastHash()) != 0 {
+			return nil
+		}
+		tip, err := lastBlock(txn)
+		if err != nil {
+			return err
+		}
+		if len(tip.UTXOCommitment) > 0 && bytes.Compare(tip.UTXOCommitment, computed.Sum()) != 0 {
+			return errors.Wrapf(ErrCorruptData, "the UTXO set hashes to %x, the tip commits to %x", computed.Sum(), tip.UTXOCommitment)
+		}
+		return nil
+	})
+}
+
+// swapDataDir moves the database restored in the staging directory, and its
+// wallets file when withWallets, in place of the ones of the data directory
+func swapDataDir(opts, staging Options, withWallets bool) error {
+	previous := opts.dbPath() + ".old"
+	if hasDB(opts) {
+		// badger locks its directory, a running node keeps it from opening here
+		db, err := storage.OpenBadger(opts.dbPath())
+		if err != nil {
+			return errors.Wrapf(err, "the chain in %s is in use, stop the node first", opts.dataDir())
+		}
+		if err := db.Close(); err != nil {
+			return errors.Wrap(err, "error closing the database")
+		}
+	}
+	if err := os.RemoveAll(previous); err != nil {
+		return errors.Wrap(err, "error clearing the previous database")
+	}
+	if err := os.Rename(opts.dbPath(), previous); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error moving the database aside")
+	}
+	if err := os.Rename(staging.dbPath(), opts.dbPath()); err != nil {
+		os.Rename(previous, opts.dbPath())
+		return errors.Wrap(err, "error moving the restored database in place")
+	}
+	if withWallets {
+		if err := os.Rename(wallet.FilePath(staging.dataDir()), wallet.FilePath(opts.dataDir())); err != nil {
+			return errors.Wrap(err, "error moving the restored wallets in place")
+		}
+	}
+	return errors.Wrap(os.RemoveAll(previous), "error removing the previous database")
+}
@@ -0,0 +1,136 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// rewriteBackup reads a backup and writes it again with the entries edit
+// returns, under a checksum that matches them
+func rewriteBackup(t *testing.T, data []byte, edit func(entries []backupEntry) []backupEntry) []byte {
+	var entries []backupEntry
+	info, _, err := readBackup(bytes.NewReader(data), func(key, value []byte) error {
+		entries = append(entries, backupEntry{key, value})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = edit(entries)
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	checksum := sha256.New()
+	if err := enc.Encode(backupHeader{info.Network, info.GenesisHash, info.TipHash, info.Height, info.Created.Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range append(entries, backupEntry{}) {
+		if err := enc.Encode(entry); err != nil {
+			t.Fatal(err)
+		}
+		if len(entry.Key) > 0 {
+			addBackupEntry(checksum, entry.Key, entry.Value)
+		}
+	}
+	if err := enc.Encode(backupTrailer{len(entries), nil, checksum.Sum(nil)}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source, pool, wallets, address := newTestChain(t, dir)
+	defer source.Close()
+	w := wallets.Wallets[address]
+	coins := splitTestCoins(t, pool, w, address, 2, 100000)
+	if err := pool.Add(newTestTxWithFee(t, pool, w, coins[0], 1, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	mineTestBlocks(t, pool, address, 2)
+
+	var backup bytes.Buffer
+	info, err := source.Backup(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := backup.Bytes()
+	if checked, err := CheckBackup(bytes.NewReader(data)); err != nil || checked.Entries != info.Entries || checked.Wallets {
+		t.Errorf("checked %d entries with wallets %v, %v, want %d without", checked.Entries, checked.Wallets, err, info.Entries)
+	}
+
+	// a backup of a chain in memory is restored to a data directory
+	dataDir, err := ioutil.TempDir("", "sentinel-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	opts := Options{DataDir: dataDir, Params: &params.Regtest}
+	if _, err := RestoreBackup(opts, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	checkRestoredChain := func(name string) {
+		chain, err := Open(opts)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		defer chain.Close()
+		if bytes.Compare(chain.LastHash(), source.LastHash()) != 0 || bytes.Compare(chain.GenesisHash, source.GenesisHash) != 0 {
+			t.Errorf("%s: the restored chain runs from %x to %x", name, chain.GenesisHash, chain.LastHash())
+		}
+		if bytes.Compare(storedUTXOHash(t, chain), storedUTXOHash(t, source)) != 0 {
+			t.Errorf("%s: the restored UTXO set differs from the one of the source", name)
+		}
+		if err := chain.VerifyChain(VerifyUTXO, nil); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	checkRestoredChain("restored")
+
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	withoutUTXO := rewriteBackup(t, data, func(entries []backupEntry) []backupEntry {
+		for i, entry := range entries {
+			if bytes.HasPrefix(entry.Key, utxoPrefix) {
+				return append(entries[:i], entries[i+1:]...)
+			}
+		}
+		t.Fatal("the backup has no unspent outputs")
+		return nil
+	})
+	if _, err := CheckBackup(bytes.NewReader(withoutUTXO)); err != nil {
+		t.Fatalf("the rewritten backup does not match its checksum: %v", err)
+	}
+	tests := []struct {
+		name string
+		opts Options
+		data []byte
+		want error
+	}{
+		{"truncated", opts, data[:len(data)-10], ErrCorruptData},
+		{"corrupt", opts, corrupt, ErrCorruptData},
+		{"unspent outputs missing", opts, withoutUTXO, ErrCorruptData},
+		{"another network", Options{DataDir: dataDir, Params: &params.Testnet}, data, ErrGenesisMismatch},
+	}
+	for _, test := range tests {
+		if _, err := RestoreBackup(test.opts, bytes.NewReader(test.data)); errors.Cause(err) != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+		// a backup that is refused leaves the chain of the data directory alone
+		checkRestoredChain(test.name)
+	}
+	if _, err := RestoreBackup(Options{Store: storage.NewMemory(), Params: &params.Regtest}, bytes.NewReader(data)); err == nil {
+		t.Error("a backup was restored to a store")
+	}
+}
@@ -3,15 +3,22 @@ package blockchain
 import (
 	"bytes"
 	"encoding/gob"
+	"github.com/pkg/errors"
 	"log"
+	"time"
 )
 
 // Block of the chain
 type Block struct {
+	Timestamp    int64
 	Transactions []*CoinTransaction
 	PrevHash []byte
 	Hash     []byte
 	Nonce    int
+	Height   int
+	// UTXOCommitment is the hash of the UTXO set with the block applied, see
+	// UTXOSet.Commitment. Blocks from ChainParams.UTXOCommitmentHeight on carry it.
+	UTXOCommitment []byte
 }
 
 // HashTransaction hashes combined transactions
@@ -25,21 +32,42 @@ func (b *Block) HashTransaction() []byte {
 	return tree.RootNode.Data
 }
 
-// CreateBlock creates new Block on the blockchain
-func CreateBlock(txns []*CoinTransaction, prevHash []byte) *Block {
+// CreateBlock creates new Block on the blockchain, mined with the given difficulty
+func CreateBlock(txns []*CoinTransaction, prevHash []byte, height, difficulty int) *Block {
+	return createBlockAt(time.Now().Unix(), txns, prevHash, height, difficulty, nil)
+}
+
+func createBlockAt(timestamp int64, txns []*CoinTransaction, prevHash []byte, height, difficulty int, commitment []byte) *Block {
 	block := &Block{
+		Timestamp:    timestamp,
 		Transactions: txns,
 		PrevHash: prevHash,
 		Hash:     []byte{},
+		Height:   height,
+		UTXOCommitment: commitment,
 	}
-	pow := NewProof(block)
+	pow := NewProof(block, difficulty)
 	nonce, hash := pow.Run()
 	block.Hash = hash[:]
 	block.Nonce = nonce
 	return block
 }
 
-// Serialize a block
+// Header is a copy of the block without its transactions, all a pruned chain keeps of old blocks
+func (b *Block) Header() *Block {
+	header := *b
+	header.Transactions = nil
+	return &header
+}
+
+// Pruned reports whether the transactions of the block were removed. Every
+// complete block has at least its coinbase.
+func (b *Block) Pruned() bool {
+	return len(b.Transactions) == 0
+}
+
+// Serialize a block. Encoding a block into memory can not fail,
+// a panic here is a programming error.
 func (b *Block) Serialize() []byte {
 	var res bytes.Buffer
 	encoder := gob.NewEncoder(&res)
@@ -51,13 +79,13 @@ func (b *Block) Serialize() []byte {
 }
 
 // Deserialize a block
-func Deserialize(data []byte) *Block {
+func Deserialize(data []byte) (*Block, error) {
 	var block Block
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 	err := decoder.Decode(&block)
 	if err != nil {
-		log.Panic(err)
+		return nil, errors.Wrapf(ErrCorruptData, "error decoding a block: %v", err)
 	}
-	return &block
+	return &block, nil
 }
 
@@ -0,0 +1,156 @@
+package blockchain
+
+import (
+	"container/list"
+	"encoding/hex"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+// DefaultBlockCacheSize is the number of bytes of blocks the block cache holds by default
+const DefaultBlockCacheSize = 32 << 20
+
+// BlockCacheStats are the counters of a block cache
+type BlockCacheStats struct {
+	Entries   int
+	Bytes     int
+	Hits      int
+	Misses    int
+	Evictions int
+}
+
+// HitRate is the share of lookups answered from memory
+func (s BlockCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// blockCacheEntry is a decoded block or header with the size it was stored with
+type blockCacheEntry struct {
+	key   string
+	block *Block
+	size  int
+}
+
+// BlockCache keeps the most recently read blocks and headers decoded, by hash,
+// evicting the least recently used ones once their serialized size exceeds the
+// budget. Cached blocks are shared by every reader, they must not be modified.
+// The cache is safe for concurrent use, a nil cache holds nothing.
+type BlockCache struct {
+	// mu guards every field below it, lookups change the order and the stats too
+	mu      sync.Mutex
+	budget  int
+	used    int
+	lru     *list.List
+	entries map[string]*list.Element
+	// epoch changes whenever a stored block is replaced, blocks read from the
+	// database before are not added as they may be the replaced ones
+	epoch uint64
+	stats BlockCacheStats
+}
+
+// NewBlockCache creates a cache holding blocks of at most budget bytes in total
+func NewBlockCache(budget int) *BlockCache {
+	return &BlockCache{
+		budget:  budget,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Stats returns the counters of the cache
+func (c *BlockCache) Stats() BlockCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.Bytes = c.used
+	return stats
+}
+
+// get returns the cached block with hash and the epoch to add it with on a miss
+func (c *BlockCache) get(hash []byte) (*Block, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[hex.EncodeToString(hash)]; ok {
+		c.stats.Hits++
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*blockCacheEntry).block, c.epoch, true
+	}
+	c.stats.Misses++
+	return nil, c.epoch, false
+}
+
+// add caches a block read from the database in epoch, evicting the least
+// recently used blocks to stay within the budget
+func (c *BlockCache) add(block *Block, size int, epoch uint64) {
+	if c == nil || size > c.budget {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := hex.EncodeToString(block.Hash)
+	if _, ok := c.entries[key]; ok || epoch != c.epoch {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&blockCacheEntry{key, block, size})
+	c.used += size
+	for c.used > c.budget {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *BlockCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*blockCacheEntry)
+	delete(c.entries, entry.key)
+	c.used -= entry.size
+}
+
+// invalidate drops the blocks with the given hashes after they were replaced
+// in the database, by their headers when pruned or their transactions when backfilled
+func (c *BlockCache) invalidate(hashes ...[]byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	for _, hash := range hashes {
+		if elem, ok := c.entries[hex.EncodeToString(hash)]; ok {
+			c.remove(elem)
+		}
+	}
+}
+
+// readBlock returns the block or header stored under hash, from the cache when it holds it
+func readBlock(db storage.Store, cache *BlockCache, hash []byte) (*Block, error) {
+	block, epoch, ok := cache.get(hash)
+	if ok {
+		return block, nil
+	}
+	var size int
+	err := db.View(func(txn storage.Txn) error {
+		data, err := txn.Get(hash)
+		if err == storage.ErrKeyNotFound {
+			return errors.Wrapf(ErrBlockNotFound, "%x", hash)
+		}
+		if err != nil {
+			return err
+		}
+		size = len(data)
+		block, err = Deserialize(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cache.add(block, size, epoch)
+	return block, nil
+}
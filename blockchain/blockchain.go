@@ -4,35 +4,52 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"encoding/hex"
-	"fmt"
-	"github.com/dgraph-io/badger"
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/AntonBozhinov/sentinel/wallet"
 	"github.com/pkg/errors"
-	"log"
+	"math/big"
 	"os"
-	"runtime"
+	"sync"
 )
 
-const (
-	dbPath = "./tmp/blocks"
-	dbFile = "./tmp/blocks/MANIFEST"
-	lastHashKey = "lh"
-	genesisData = "First transaction from Genesis"
-)
+const lastHashKey = "lh"
 
+// BlockChain is safe for any number of goroutines reading it while one
+// goroutine at a time changes it: adds blocks, updates the UTXO set or the
+// mempool. Callers serialize the writers among themselves.
 type BlockChain struct {
-	LastHash []byte
-	Database *badger.DB
+	GenesisHash []byte
+	Database    storage.Store
+	Params      *params.ChainParams
+	opts        Options
+	utxoCache   *UTXOCache
+	blockCache  *BlockCache
+	// clock judges how far ahead of the network time blocks are
+	clock *NetworkTime
+	// mu guards lastHash, the hash of the tip
+	mu       sync.RWMutex
+	lastHash []byte
 }
 
 type Iterator struct {
 	CurrentHash []byte
-	Database *badger.DB
+	Database    storage.Store
+	cache       *BlockCache
 }
 
+// FindTransaction searches the best chain for a transaction from the tip down.
+// It fails with ErrPruned when it reaches blocks whose transactions were pruned.
 func (bc *BlockChain) FindTransaction(ID []byte) (CoinTransaction, error) {
 	iter := bc.Iterator()
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return CoinTransaction{}, err
+		}
+		if block.Pruned() {
+			return CoinTransaction{}, errors.Wrapf(ErrPruned, "transaction %x is not in the blocks above height %d", ID, block.Height)
+		}
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
@@ -44,211 +61,512 @@ func (bc *BlockChain) FindTransaction(ID []byte) (CoinTransaction, error) {
 			break
 		}
 	}
-	return CoinTransaction{}, errors.New("transaction does not exists")
+	return CoinTransaction{}, errors.Wrapf(ErrTxNotFound, "%x", ID)
 }
 
-func (bc *BlockChain) SignTransaction(tx *CoinTransaction, privKey ecdsa.PrivateKey) {
+func (bc *BlockChain) prevTransactions(tx *CoinTransaction) (map[string]CoinTransaction, error) {
 	prevTXs := make(map[string]CoinTransaction)
 
 	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
+		prevTX, err := bc.findPrevTransaction(in.ID)
 		if err != nil {
-			log.Panicf("can not find a transaction with ID: %x", in.ID)
+			return nil, errors.Wrapf(err, "can not find a transaction with ID: %x", in.ID)
 		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
-
-	tx.Sign(privKey, prevTXs)
+	return prevTXs, nil
 }
 
-func (bc *BlockChain) VerifyTransaction(tx *CoinTransaction) bool {
-	prevTXs := make(map[string]CoinTransaction)
-
-	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
-		if err != nil {
-			log.Panicf("can not find a transaction with ID: %x", in.ID)
-		}
+// findPrevTransaction finds a transaction whose outputs are spent. When its
+// block was pruned, the transaction is rebuilt from its unspent outputs.
+func (bc *BlockChain) findPrevTransaction(ID []byte) (CoinTransaction, error) {
+	tx, err := bc.FindTransaction(ID)
+	if errors.Cause(err) != ErrPruned {
+		return tx, err
+	}
+	outs, found, utxoErr := UTXOSet{BlockChain: bc}.outputs(ID)
+	if utxoErr != nil {
+		return CoinTransaction{}, utxoErr
+	}
+	if !found {
+		return CoinTransaction{}, errors.Wrapf(err, "no unspent outputs of %x", ID)
+	}
+	return outs.transaction(ID), nil
+}
 
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+func (bc *BlockChain) SignTransaction(tx *CoinTransaction, privKey ecdsa.PrivateKey) error {
+	prevTXs, err := bc.prevTransactions(tx)
+	if err != nil {
+		return err
 	}
+	return tx.Sign(privKey, prevTXs)
+}
 
+func (bc *BlockChain) VerifyTransaction(tx *CoinTransaction) (bool, error) {
+	prevTXs, err := bc.prevTransactions(tx)
+	if err != nil {
+		return false, err
+	}
 	return tx.Verify(prevTXs)
 }
 
-func hasDB() bool {
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+func hasDB(opts Options) bool {
+	if _, err := os.Stat(opts.dbFile()); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
-func (chain *BlockChain) AddBlock(data []*CoinTransaction) *Block {
-	var lastHash []byte
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(lastHashKey))
-		if err != nil {
-			log.Fatalf("error setting the genesis hash: %v", err)
-		}
-		lastHash, err = item.Value()
+// lastBlock reads the tip of the chain inside a database transaction
+func lastBlock(txn storage.Txn) (*Block, error) {
+	lastHash, err := txn.Get([]byte(lastHashKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting the last hash")
+	}
+	lastBlockData, err := txn.Get(lastHash)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting the last block %x", lastHash)
+	}
+	return Deserialize(lastBlockData)
+}
+
+// MineBlock runs the proof of work for a block on top of the current tip and adds it to the chain
+func (chain *BlockChain) MineBlock(data []*CoinTransaction) (*Block, error) {
+	var last *Block
+	err := chain.Database.View(func(txn storage.Txn) error {
+		var err error
+		last, err = lastBlock(txn)
 		return err
 	})
 	if err != nil {
-		log.Fatalf("error adding a new block: %v", err)
+		return nil, errors.Wrap(err, "error mining a new block")
+	}
+	commitment, err := UTXOSet{BlockChain: chain}.CommitmentAfter(&Block{Transactions: data, Height: last.Height + 1})
+	if err != nil {
+		return nil, err
 	}
-	newBlock := CreateBlock(data, lastHash)
-	err = chain.Database.Update(func(txn*badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
+	timestamp, err := chain.minTimestamp(last.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if now := chain.clock.Now().Unix(); now > timestamp {
+		timestamp = now
+	}
+	newBlock := createBlockAt(timestamp, data, last.Hash, last.Height+1, chain.Params.Difficulty, commitment)
+	if err := CheckBlockSize(newBlock, chain.Params); err != nil {
+		return nil, err
+	}
+	if err := chain.AddBlock(newBlock); err != nil {
+		return nil, err
+	}
+	return newBlock, nil
+}
+
+// AddBlock stores a block and makes it the tip when its branch has more work
+// than the one of the current tip, see chainWork, pointing the height index at
+// the branch of the new tip. The parent of the block must be stored, a block
+// whose parent is unknown fails with ErrBlockNotFound, and its height must be
+// one above the one of the parent. A block known by its header only is
+// backfilled, see LoadUTXO.
+func (chain *BlockChain) AddBlock(block *Block) error {
+	newTip, stored := false, false
+	err := chain.Database.Update(func(txn storage.Txn) error {
+		if data, err := txn.Get(block.Hash); err == nil {
+			stored = true
+			return chain.backfill(txn, data, block)
+		}
+		if len(block.PrevHash) == 0 {
+			return errors.Wrapf(ErrInvalidBlock, "block %x is not the genesis of the chain", block.Hash)
+		}
+		parent, err := readHeader(txn, block.PrevHash)
 		if err != nil {
-			log.Fatalf("error saving the new block: %v", err)
+			return errors.Wrap(err, "error getting the parent")
 		}
-		err = txn.Set([]byte(lastHashKey), newBlock.Hash)
-		chain.LastHash = lastHash
-		return err
+		if block.Height != parent.Height+1 {
+			return errors.Wrapf(ErrInvalidBlock, "block %x has height %d on top of height %d", block.Hash, block.Height, parent.Height)
+		}
+		if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+			return errors.Wrap(err, "error saving the new block")
+		}
+
+		last, err := lastBlock(txn)
+		if err != nil {
+			return err
+		}
+		if chain.chainWork(block).Cmp(chain.chainWork(last)) <= 0 {
+			return nil
+		}
+		if err := txn.Set([]byte(lastHashKey), block.Hash); err != nil {
+			return err
+		}
+		newTip = true
+		return indexBestChain(txn, block)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not add block %x", block.Hash)
+	}
+	if stored {
+		// the header may have been replaced by the whole block
+		chain.blockCache.invalidate(block.Hash)
+	}
+	if newTip {
+		chain.setLastHash(block.Hash)
+	}
+	return nil
+}
+
+// removeTip takes back a block AddBlock made the tip on top of the previous
+// one, when its transactions can not be applied. The parent becomes the tip
+// again and the block is deleted.
+func (chain *BlockChain) removeTip(block *Block) error {
+	err := chain.Database.Update(func(txn storage.Txn) error {
+		if err := txn.Set([]byte(lastHashKey), block.PrevHash); err != nil {
+			return err
+		}
+		if err := txn.Delete(heightKey(block.Height)); err != nil {
+			return err
+		}
+		return txn.Delete(block.Hash)
 	})
 	if err != nil {
-		log.Fatalf("could not add new block: %v", err)
+		return errors.Wrapf(err, "could not remove block %x", block.Hash)
 	}
-	return newBlock
+	chain.blockCache.invalidate(block.Hash)
+	chain.setLastHash(block.PrevHash)
+	return nil
 }
 
-func Genesis(txn *CoinTransaction) *Block {
-	return CreateBlock([]*CoinTransaction{txn}, []byte{})
+// chainWork is the proof of work accumulated by the branch ending in block. The
+// difficulty is the same for every block of a chain, so it is the work of one
+// block times the number of blocks of the branch, which AddBlock keeps at the
+// height plus one by checking every height against the parent.
+func (chain *BlockChain) chainWork(block *Block) *big.Int {
+	work := blockWork(chain.Params.Difficulty)
+	return work.Mul(work, big.NewInt(int64(block.Height)+1))
 }
-func Continue(address string) *BlockChain {
-	if hasDB() == false {
-		fmt.Println("No existing blockchain found, create one!")
-		runtime.Goexit()
-	}
 
-	var lastHash []byte
+// LastHash returns the hash of the tip of the chain
+func (chain *BlockChain) LastHash() []byte {
+	chain.mu.RLock()
+	defer chain.mu.RUnlock()
+	return chain.lastHash
+}
 
-	opts := badger.DefaultOptions
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
+func (chain *BlockChain) setLastHash(hash []byte) {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+	chain.lastHash = hash
+}
+
+// GetBestHeight returns the height of the tip of the chain
+func (chain *BlockChain) GetBestHeight() (int, error) {
+	var lastHash []byte
+	err := chain.Database.View(func(txn storage.Txn) error {
+		var err error
+		lastHash, err = txn.Get([]byte(lastHashKey))
+		return errors.Wrap(err, "error getting the last hash")
+	})
+	var last *Block
+	if err == nil {
+		last, err = readBlock(chain.Database, chain.blockCache, lastHash)
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting the best height")
+	}
+	return last.Height, nil
+}
 
-	db, err := badger.Open(opts)
+// GetBlock returns the block with the given hash
+func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
+	block, err := chain.BlockByHash(blockHash)
 	if err != nil {
-		log.Panicf("error opening the database: %v", err)
+		return Block{}, err
 	}
+	return *block, nil
+}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
+// GetBlockHashes returns the hashes of all blocks from the tip to the genesis,
+// on a pruned chain down to the oldest block that still has its transactions
+func (chain *BlockChain) GetBlockHashes() ([][]byte, error) {
+	var blocks [][]byte
+	iter := chain.Iterator()
+	for {
+		block, err := iter.Next()
 		if err != nil {
-			log.Panicf("error getting last hash: %v", err)
+			return nil, err
+		}
+		if block.Pruned() {
+			break
+		}
+		blocks = append(blocks, block.Hash)
+		if len(block.PrevHash) == 0 {
+			break
 		}
-		lastHash, err = item.Value()
+	}
+	return blocks, nil
+}
 
-		return err
-	})
+// ValidateAddress fails with wallet.ErrInvalidAddress unless address belongs to the network of the chain
+func (chain *BlockChain) ValidateAddress(address string) error {
+	if !wallet.ValidateAddress(address, chain.Params.AddressVersion) {
+		return errors.Wrapf(wallet.ErrInvalidAddress, "%s is not a %s address", address, chain.Params.Name)
+	}
+	return nil
+}
+
+// openDB opens the store of opts, the badger database of the data directory
+// unless a store was given, creating the directory when needed
+func openDB(opts Options) (storage.Store, error) {
+	if opts.Store != nil {
+		return opts.Store, nil
+	}
+	if err := os.MkdirAll(opts.dataDir(), 0700); err != nil {
+		return nil, errors.Wrap(err, "error creating the data directory")
+	}
+	db, err := storage.OpenBadger(opts.dbPath())
 	if err != nil {
-		log.Panicf("error setting last hash: %v", err)
+		return nil, err
 	}
+	db.StartMaintenance(opts.Maintenance)
+	return db, nil
+}
 
-	chain := BlockChain{lastHash, db}
+// badgerDB returns the badger database of the chain, failing for other stores
+func (chain *BlockChain) badgerDB() (*storage.Badger, error) {
+	db, ok := chain.Database.(*storage.Badger)
+	if !ok {
+		return nil, errors.New("the chain is not kept in a badger database")
+	}
+	return db, nil
+}
 
-	return &chain
+// DiskUsage returns the size of the database files of the chain
+func (chain *BlockChain) DiskUsage() (storage.DiskUsage, error) {
+	db, err := chain.badgerDB()
+	if err != nil {
+		return storage.DiskUsage{}, err
+	}
+	return db.DiskUsage()
 }
 
+// CompactDB garbage collects the value log of the database right away, with
+// the discard ratio of the maintenance options but regardless of the size of
+// the value log
+func (chain *BlockChain) CompactDB() (storage.MaintenanceReport, error) {
+	db, err := chain.badgerDB()
+	if err != nil {
+		return storage.MaintenanceReport{}, err
+	}
+	opts := chain.opts.Maintenance
+	opts.MinValueLogSize = 0
+	report := db.Maintain(opts)
+	return report, report.Err
+}
+
+// Open opens the existing chain of opts, failing with ErrNoChain when none was created there
+func Open(opts Options) (*BlockChain, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.Store == nil && hasDB(opts) == false {
+		return nil, errors.Wrapf(ErrNoChain, "in %s", opts.dataDir())
+	}
 
-func InitBlockChain(address string) *BlockChain {
 	var lastHash []byte
 
-	if hasDB() {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+	db, err := openDB(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	opts := badger.DefaultOptions
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
+	err = db.View(func(txn storage.Txn) error {
+		lastHash, err = txn.Get([]byte(lastHashKey))
+		if err == storage.ErrKeyNotFound {
+			return ErrNoChain
+		}
+		return errors.Wrap(err, "error getting last hash")
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	db, err := badger.Open(opts)
+	var genesisHash []byte
+	err = migrate(db, opts.params())
+	if err == nil {
+		genesisHash, err = loadGenesisHash(db, lastHash)
+	}
+	if err == nil {
+		err = checkGenesis(opts.params(), genesisHash)
+	}
 	if err != nil {
-		log.Panicf("error opening the database: %v", err)
+		db.Close()
+		return nil, err
 	}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := GenesisTransaction(address, genesisData)
-		genesis := Genesis(cbtx)
-		fmt.Println("Genesis created")
-		err = txn.Set(genesis.Hash, genesis.Serialize())
-		if err != nil {
-			log.Panicf("error setting the genesis hash: %v", err)
-		}
-		err = txn.Set([]byte("lh"), genesis.Hash)
+	chain := BlockChain{
+		GenesisHash: genesisHash,
+		lastHash:    lastHash,
+		Database:    db,
+		Params:      opts.params(),
+		opts:        opts,
+		blockCache:  opts.blockCache(),
+		clock:       NewNetworkTime(),
+	}
+	chain.utxoCache = opts.utxoCache(&chain)
+	if err := (UTXOSet{BlockChain: &chain}).catchUp(); err != nil {
+		db.Close()
+		return nil, err
+	}
 
-		lastHash = genesis.Hash
+	return &chain, nil
+}
 
-		return err
+// Init creates a new chain for opts with the genesis of its parameters, see GenesisBlock
+// for when it pays to address. It fails with ErrChainExists when there already is a chain.
+func Init(opts Options, address string) (*BlockChain, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.Store == nil && hasDB(opts) {
+		return nil, errors.Wrapf(ErrChainExists, "in %s", opts.dataDir())
+	}
+	genesis, err := GenesisBlock(opts.params(), address)
+	if err != nil {
+		return nil, err
+	}
+	return initChain(opts, genesis)
+}
 
-	})
+// initChain creates a new chain for opts starting at genesis, unless its store already has one
+func initChain(opts Options, genesis *Block) (*BlockChain, error) {
+	db, err := openDB(opts)
+	if err != nil {
+		return nil, err
+	}
 
+	err = db.Update(func(txn storage.Txn) error {
+		if _, err := txn.Get([]byte(lastHashKey)); err == nil {
+			return ErrChainExists
+		}
+		err := txn.Set(genesis.Hash, genesis.Serialize())
+		if err != nil {
+			return errors.Wrap(err, "error setting the genesis hash")
+		}
+		if err := txn.Set([]byte(genesisKey), genesis.Hash); err != nil {
+			return errors.Wrap(err, "error setting the genesis hash")
+		}
+		if err := txn.Set(heightKey(0), genesis.Hash); err != nil {
+			return errors.Wrap(err, "error indexing the genesis")
+		}
+		if err := txn.Set([]byte(schemaVersionKey), encodeSchemaVersion(SchemaVersion)); err != nil {
+			return errors.Wrap(err, "error setting the schema version")
+		}
+		return txn.Set([]byte(lastHashKey), genesis.Hash)
+	})
 	if err != nil {
-		log.Panicf("error adding the genesis block: %v", err)
+		db.Close()
+		return nil, errors.Wrap(err, "error adding the genesis block")
+	}
+
+	blockchain := BlockChain{
+		GenesisHash: genesis.Hash,
+		lastHash:    genesis.Hash,
+		Database:    db,
+		Params:      opts.params(),
+		opts:        opts,
+		blockCache:  opts.blockCache(),
+		clock:       NewNetworkTime(),
 	}
+	blockchain.utxoCache = opts.utxoCache(&blockchain)
+	return &blockchain, nil
+}
+
+// DataDir returns the directory holding the chain data
+func (chain *BlockChain) DataDir() string {
+	return chain.opts.dataDir()
+}
+
+// UTXOCache returns the cache in front of the UTXO set, nil when it is disabled
+func (chain *BlockChain) UTXOCache() *UTXOCache {
+	return chain.utxoCache
+}
 
-	blockchain := BlockChain{lastHash, db}
-	return &blockchain
+// NetworkTime returns the clock of the chain, adjusted by the clocks of its peers
+func (chain *BlockChain) NetworkTime() *NetworkTime {
+	return chain.clock
 }
 
-func (chain *BlockChain) FindUTXO() map[string]CoinTxOutputs {
+// BlockCache returns the cache of decoded blocks, nil when it is disabled
+func (chain *BlockChain) BlockCache() *BlockCache {
+	return chain.blockCache
+}
+
+// Close flushes the UTXO cache and releases the store of the chain, including one given in Options
+func (chain *BlockChain) Close() error {
+	var flushErr error
+	if chain.utxoCache != nil {
+		flushErr = chain.utxoCache.Flush()
+	}
+	if err := chain.Database.Close(); err != nil {
+		return errors.Wrap(err, "error closing the database")
+	}
+	return flushErr
+}
+
+// FindUTXO replays the best chain from the genesis and returns the outputs left unspent
+func (chain *BlockChain) FindUTXO() (map[string]CoinTxOutputs, error) {
 	UTXO := make(map[string]CoinTxOutputs)
-	spendTXOs := make(map[string][]int)
-	iter := chain.Iterator()
+	iter, err := chain.ForwardIterator(0, -1)
+	if err != nil {
+		return nil, err
+	}
 
-	for {
-		block := iter.Next()
+	for iter.Valid() {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-			Outputs:
-			for outInx, out := range tx.Outputs {
-				if spendTXOs[txID] != nil {
-					for _, spendOut := range spendTXOs[txID] {
-						if spendOut == outInx {
-							continue Outputs
+			if tx.IsCoinTransaction() == false {
+				for _, in := range tx.Inputs {
+					inTxID := hex.EncodeToString(in.ID)
+					outs := UTXO[inTxID]
+					remaining := CoinTxOutputs{Height: outs.Height}
+					for outIdx, out := range outs.Outputs {
+						if outs.Index(outIdx) != in.Out {
+							remaining.Outputs = append(remaining.Outputs, out)
+							remaining.Indexes = append(remaining.Indexes, outs.Index(outIdx))
 						}
 					}
+					if len(remaining.Outputs) == 0 {
+						delete(UTXO, inTxID)
+					} else {
+						UTXO[inTxID] = remaining
+					}
 				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
 			}
-			if tx.IsCoinTransaction() == false {
-				for _, in := range tx.Inputs {
-					intTxID := hex.EncodeToString(in.ID)
-					spendTXOs[intTxID] = append(spendTXOs[intTxID], in.Out)
-				}
+			outs := CoinTxOutputs{Height: block.Height}
+			for outIdx, out := range tx.Outputs {
+				outs.Outputs = append(outs.Outputs, out)
+				outs.Indexes = append(outs.Indexes, outIdx)
 			}
-		}
-
-		if len(block.PrevHash) == 0 {
-			break
+			UTXO[hex.EncodeToString(tx.ID)] = outs
 		}
 	}
-	return UTXO
+	return UTXO, nil
 }
 
-
 func (chain *BlockChain) Iterator() *Iterator {
-	iter := &Iterator{chain.LastHash, chain.Database}
+	iter := &Iterator{chain.LastHash(), chain.Database, chain.blockCache}
 	return iter
 }
 
-func (iter *Iterator) Next() *Block {
-	var block *Block
-	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
-		if err != nil {
-			log.Fatalf("error with iteration on hash: %x\n%v", iter.CurrentHash, err)
-		}
-		encodedBlock, err := item.Value()
-		block = Deserialize(encodedBlock)
-		return err
-	})
+func (iter *Iterator) Next() (*Block, error) {
+	block, err := readBlock(iter.Database, iter.cache, iter.CurrentHash)
 	if err != nil {
-		log.Fatalf("error getting data from hash: %x\n%v", iter.CurrentHash, err)
+		return nil, errors.Wrapf(err, "error getting data from hash: %x", iter.CurrentHash)
 	}
 	iter.CurrentHash = block.PrevHash
-	return block
-}
\ No newline at end of file
+	return block, nil
+}
@@ -0,0 +1,166 @@
+package blockchain
+
+import (
+	"github.com/AntonBozhinov/sentinel/wallet"
+	"github.com/pkg/errors"
+)
+
+// maxBumpAttempts bounds how often a bump is rebuilt while its size settles
+const maxBumpAttempts = 10
+
+// BumpFee speeds up a stuck pool transaction so it pays at least feeRate per byte.
+// When the wallets own the coins it spends, the transaction is replaced by one
+// with a smaller change output (replace-by-fee). When they only receive one of
+// its outputs, a child spending that output pays for the parent (child-pays-for-parent).
+func BumpFee(pool *Mempool, wallets *wallet.Wallets, txID []byte, feeRate int) (*CoinTransaction, error) {
+	entry, ok := pool.Get(txID)
+	if !ok {
+		return nil, errors.Wrapf(ErrTxNotFound, "transaction %x is not in the mempool", txID)
+	}
+	if feeRate <= entry.FeeRate() {
+		return nil, errors.Errorf("fee rate %d must be higher than the current fee rate %d", feeRate, entry.FeeRate())
+	}
+
+	if sender, ok := inputsOwner(wallets, entry.Tx); ok {
+		return bumpByReplacement(pool, entry, sender, feeRate)
+	}
+
+	for outIdx, out := range entry.Tx.Outputs {
+		_, receiver, ok := wallets.FindByPublicKeyHash(out.PubKeyHash)
+		if ok && !pool.IsSpent(Outpoint{entry.Tx.ID, outIdx}) {
+			return bumpByChild(pool, entry, outIdx, receiver, feeRate)
+		}
+	}
+	return nil, errors.Wrapf(wallet.ErrUnknownWallet, "transaction %x neither spends nor pays to a known wallet", txID)
+}
+
+// inputsOwner returns the wallet signing every input of tx
+func inputsOwner(wallets *wallet.Wallets, tx *CoinTransaction) (*wallet.Wallet, bool) {
+	var owner *wallet.Wallet
+	for _, in := range tx.Inputs {
+		_, w, ok := wallets.FindByPublicKeyHash(wallet.PublicKeyHash(in.PubKey))
+		if !ok || (owner != nil && owner != w) {
+			return nil, false
+		}
+		owner = w
+	}
+	return owner, owner != nil
+}
+
+func bumpByReplacement(pool *Mempool, entry *MempoolEntry, sender *wallet.Wallet, feeRate int) (*CoinTransaction, error) {
+	pubKeyHash := wallet.PublicKeyHash(sender.PublicKey)
+	evictedFees := entry.Fee
+	for _, descendant := range pool.Descendants(entry.Tx.ID) {
+		evictedFees += descendant.Fee
+	}
+
+	var inputs []CoinTxInput
+	for _, in := range entry.Tx.Inputs {
+		inputs = append(inputs, CoinTxInput{ID: in.ID, Out: in.Out, PubKey: sender.PublicKey})
+	}
+	outputs := append([]CoinTxOutput{}, entry.Tx.Outputs...)
+	change := -1
+	for outIdx, out := range outputs {
+		if out.IsLockedWithKey(pubKeyHash) {
+			change = outIdx
+		}
+	}
+	inValue := entry.Fee
+	for _, out := range outputs {
+		inValue += out.Value
+	}
+
+	UTXOSet := UTXOSet{BlockChain: pool.BlockChain}
+	unspent, err := UTXOSet.FindUnspentOutputs(pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	var extra []UnspentOutput
+	for _, utxo := range unspent {
+		if !pool.IsSpent(utxo.Outpoint) {
+			extra = append(extra, utxo)
+		}
+	}
+
+	for attempt := 0; attempt < maxBumpAttempts; attempt++ {
+		// signing writes into the inputs, the next attempt needs them unsigned
+		tx := CoinTransaction{Inputs: append([]CoinTxInput{}, inputs...), Outputs: outputs}
+		tx.ID = tx.Hash()
+		if err := pool.SignTransaction(&tx, sender.PrivateKey); err != nil {
+			return nil, err
+		}
+
+		outValue := 0
+		for _, out := range tx.Outputs {
+			outValue += out.Value
+		}
+		fee := inValue - outValue
+		size := tx.Size()
+		required := feeRate * size
+		if minimum := evictedFees + MinRelayFeeRate*size; minimum > required {
+			required = minimum
+		}
+		if fee >= required {
+			if err := pool.Add(&tx); err != nil {
+				return nil, err
+			}
+			return &tx, nil
+		}
+
+		missing := required - fee
+		inputs = append([]CoinTxInput{}, inputs...)
+		outputs = append([]CoinTxOutput{}, outputs...)
+		if change >= 0 && outputs[change].Value > missing {
+			outputs[change].Value -= missing
+			continue
+		}
+		if len(extra) == 0 {
+			return nil, errors.Wrap(ErrInsufficientFunds, "can not bump the fee")
+		}
+		inputs = append(inputs, CoinTxInput{ID: extra[0].ID, Out: extra[0].Out, PubKey: sender.PublicKey})
+		inValue += extra[0].Value
+		if change >= 0 {
+			outputs[change].Value += extra[0].Value
+		} else {
+			outputs = append(outputs, CoinTxOutput{Value: extra[0].Value, PubKeyHash: pubKeyHash})
+			change = len(outputs) - 1
+		}
+		extra = extra[1:]
+	}
+	return nil, errors.New("could not settle the size of the replacement transaction")
+}
+
+func bumpByChild(pool *Mempool, parent *MempoolEntry, outIdx int, receiver *wallet.Wallet, feeRate int) (*CoinTransaction, error) {
+	pubKeyHash := wallet.PublicKeyHash(receiver.PublicKey)
+	value := parent.Tx.Outputs[outIdx].Value
+	ancestorFee, ancestorSize := pool.AncestorScore(parent.Tx.ID)
+	fee := 0
+
+	for attempt := 0; attempt < maxBumpAttempts; attempt++ {
+		if fee >= value {
+			return nil, errors.Wrapf(ErrInsufficientFunds, "output %d of %x is worth %d, not enough to pay a fee of %d", outIdx, parent.Tx.ID, value, fee)
+		}
+		tx := CoinTransaction{
+			Inputs:  []CoinTxInput{{ID: parent.Tx.ID, Out: outIdx, PubKey: receiver.PublicKey}},
+			Outputs: []CoinTxOutput{{Value: value - fee, PubKeyHash: pubKeyHash}},
+		}
+		tx.ID = tx.Hash()
+		if err := pool.SignTransaction(&tx, receiver.PrivateKey); err != nil {
+			return nil, err
+		}
+
+		size := tx.Size()
+		required := feeRate*(ancestorSize+size) - ancestorFee
+		if minimum := MinRelayFeeRate * size; minimum > required {
+			required = minimum
+		}
+		if fee >= required {
+			if err := pool.Add(&tx); err != nil {
+				return nil, err
+			}
+			return &tx, nil
+		}
+		fee = required
+	}
+	return nil, errors.New("could not settle the size of the child transaction")
+}
@@ -0,0 +1,257 @@
+package blockchain
+
+import (
+	"github.com/pkg/errors"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// bnbMaxTries bounds the branch and bound search before it gives up
+const bnbMaxTries = 100000
+
+// CoinSelection is the set of outputs funding a payment
+type CoinSelection struct {
+	Inputs []UnspentOutput
+	Fee    int
+	// Change is the value returned to the sender, zero when the leftover
+	// was too small to be worth an output and went to the fee
+	Change int
+}
+
+// CoinSelector picks the outputs funding a payment of amount at feeRate per byte
+type CoinSelector interface {
+	Select(utxos []UnspentOutput, amount, feeRate int) (*CoinSelection, error)
+}
+
+// LargestFirst spends the biggest outputs first, using as few inputs as possible
+type LargestFirst struct{}
+
+// SmallestFirst spends the smallest outputs first, consolidating dust
+type SmallestFirst struct{}
+
+// BranchAndBound searches for a set of outputs matching the payment and fee
+// closely enough that no change output is needed. It falls back to
+// LargestFirst when there is no such set.
+type BranchAndBound struct{}
+
+// RandomSelection spends outputs in random order so payments do not reveal
+// which outputs belong together
+type RandomSelection struct{}
+
+// ManualSelection spends exactly the outputs chosen by the user
+type ManualSelection struct {
+	Inputs []UnspentOutput
+}
+
+// CoinSelectors are the strategies available by name
+var CoinSelectors = map[string]CoinSelector{
+	"largest":  LargestFirst{},
+	"smallest": SmallestFirst{},
+	"bnb":      BranchAndBound{},
+	"random":   RandomSelection{},
+}
+
+// NewCoinSelector returns the strategy registered under name
+func NewCoinSelector(name string) (CoinSelector, error) {
+	selector, ok := CoinSelectors[name]
+	if !ok {
+		return nil, errors.Errorf("unknown coin selection strategy %q", name)
+	}
+	return selector, nil
+}
+
+// NewManualSelection looks up the outpoints in the UTXO set and makes sure
+// none of them is spent, already spent in the pool or locked to another key
+func NewManualSelection(pool *Mempool, pubKeyHash []byte, outpoints []Outpoint) (*ManualSelection, error) {
+	UTXO := UTXOSet{BlockChain: pool.BlockChain}
+	selection := &ManualSelection{}
+	seen := make(map[string]bool)
+	for _, outpoint := range outpoints {
+		if seen[outpoint.String()] {
+			return nil, errors.Errorf("outpoint %s is listed twice", outpoint)
+		}
+		seen[outpoint.String()] = true
+
+		out, ok, err := UTXO.FindOutput(outpoint)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.Errorf("outpoint %s does not exist or is already spent", outpoint)
+		}
+		if !out.IsLockedWithKey(pubKeyHash) {
+			return nil, errors.Errorf("outpoint %s is locked to another key", outpoint)
+		}
+		if pool.IsSpent(outpoint) {
+			return nil, errors.Errorf("outpoint %s is already spent by a mempool transaction", outpoint)
+		}
+		selection.Inputs = append(selection.Inputs, UnspentOutput{Outpoint: outpoint, CoinTxOutput: out})
+	}
+	if len(selection.Inputs) == 0 {
+		return nil, errors.New("no outpoints to spend")
+	}
+	return selection, nil
+}
+
+// estimateTxSize returns the serialized size of a signed transaction with the
+// given number of inputs and outputs, erring on the large side
+func estimateTxSize(inputs, outputs int) int {
+	tx := CoinTransaction{ID: make([]byte, 32)}
+	for i := 0; i < inputs; i++ {
+		tx.Inputs = append(tx.Inputs, CoinTxInput{
+			ID:        make([]byte, 32),
+			Out:       1 << 30,
+			Signature: make([]byte, 64),
+			PubKey:    make([]byte, 64),
+		})
+	}
+	for i := 0; i < outputs; i++ {
+		tx.Outputs = append(tx.Outputs, CoinTxOutput{Value: 1 << 62, PubKeyHash: make([]byte, 20)})
+	}
+	return tx.Size()
+}
+
+// inputCost is the fee an additional input adds at feeRate
+func inputCost(feeRate int) int {
+	return feeRate * (estimateTxSize(2, 1) - estimateTxSize(1, 1))
+}
+
+// accumulate takes outputs in the given order until they pay for amount and fee
+func accumulate(utxos []UnspentOutput, amount, feeRate int) (*CoinSelection, error) {
+	selection := &CoinSelection{}
+	total := 0
+	for _, utxo := range utxos {
+		selection.Inputs = append(selection.Inputs, utxo)
+		total += utxo.Value
+
+		withoutChange := feeRate * estimateTxSize(len(selection.Inputs), 1)
+		withChange := feeRate * estimateTxSize(len(selection.Inputs), 2)
+		if total >= amount+withChange && total-amount-withChange > inputCost(feeRate) {
+			selection.Fee = withChange
+			selection.Change = total - amount - withChange
+			return selection, nil
+		}
+		if total >= amount+withoutChange {
+			selection.Fee = total - amount
+			return selection, nil
+		}
+	}
+	return nil, errors.Wrapf(ErrInsufficientFunds, "have %d, need %d plus fees", total, amount)
+}
+
+// Select ignores the available outputs and spends all of the chosen ones
+func (m *ManualSelection) Select(utxos []UnspentOutput, amount, feeRate int) (*CoinSelection, error) {
+	total := 0
+	for _, utxo := range m.Inputs {
+		total += utxo.Value
+	}
+	selection := &CoinSelection{Inputs: m.Inputs}
+	withoutChange := feeRate * estimateTxSize(len(m.Inputs), 1)
+	withChange := feeRate * estimateTxSize(len(m.Inputs), 2)
+	if total < amount+withoutChange {
+		return nil, errors.Wrapf(ErrInsufficientFunds, "the chosen outputs are worth %d, need %d plus a fee of %d", total, amount, withoutChange)
+	}
+	if total-amount-withChange > inputCost(feeRate) {
+		selection.Fee = withChange
+		selection.Change = total - amount - withChange
+	} else {
+		selection.Fee = total - amount
+	}
+	return selection, nil
+}
+
+func (LargestFirst) Select(utxos []UnspentOutput, amount, feeRate int) (*CoinSelection, error) {
+	sorted := append([]UnspentOutput{}, utxos...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Value > sorted[j].Value
+	})
+	return accumulate(sorted, amount, feeRate)
+}
+
+func (SmallestFirst) Select(utxos []UnspentOutput, amount, feeRate int) (*CoinSelection, error) {
+	sorted := append([]UnspentOutput{}, utxos...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Value < sorted[j].Value
+	})
+	return accumulate(sorted, amount, feeRate)
+}
+
+func (RandomSelection) Select(utxos []UnspentOutput, amount, feeRate int) (*CoinSelection, error) {
+	shuffled := append([]UnspentOutput{}, utxos...)
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	random.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return accumulate(shuffled, amount, feeRate)
+}
+
+// Select runs a depth first search over the outputs sorted by value, where
+// each output counts with its effective value, what it is worth after paying
+// for its own input. A set is accepted when it covers the payment and the fee
+// of a transaction without change and wastes less than an extra input would cost.
+func (BranchAndBound) Select(utxos []UnspentOutput, amount, feeRate int) (*CoinSelection, error) {
+	sorted := append([]UnspentOutput{}, utxos...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Value > sorted[j].Value
+	})
+
+	cost := inputCost(feeRate)
+	target := amount + feeRate*estimateTxSize(0, 1)
+	tolerance := cost
+
+	var effective []int
+	remaining := 0
+	for _, utxo := range sorted {
+		value := utxo.Value - cost
+		effective = append(effective, value)
+		if value > 0 {
+			remaining += value
+		}
+	}
+
+	var best []bool
+	current := make([]bool, len(sorted))
+	tries := 0
+	var search func(depth, total, remaining int) bool
+	search = func(depth, total, remaining int) bool {
+		tries++
+		if tries > bnbMaxTries || total > target+tolerance || total+remaining < target {
+			return false
+		}
+		if total >= target {
+			best = append([]bool{}, current...)
+			return true
+		}
+		if depth == len(sorted) {
+			return false
+		}
+		value := effective[depth]
+		if value <= 0 {
+			return search(depth+1, total, remaining)
+		}
+		current[depth] = true
+		if search(depth+1, total+value, remaining-value) {
+			return true
+		}
+		current[depth] = false
+		return search(depth+1, total, remaining-value)
+	}
+
+	if !search(0, 0, remaining) {
+		return LargestFirst{}.Select(utxos, amount, feeRate)
+	}
+	selection := &CoinSelection{}
+	total := 0
+	for i, selected := range best {
+		if selected {
+			selection.Inputs = append(selection.Inputs, sorted[i])
+			total += sorted[i].Value
+		}
+	}
+	if total-amount < feeRate*estimateTxSize(len(selection.Inputs), 1) {
+		return LargestFirst{}.Select(utxos, amount, feeRate)
+	}
+	selection.Fee = total - amount
+	return selection, nil
+}
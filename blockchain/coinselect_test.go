@@ -0,0 +1,262 @@
+package blockchain
+
+import (
+	"fmt"
+	"github.com/AntonBozhinov/sentinel/wallet"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// testUTXOs makes outputs of values with distinct outpoints
+func testUTXOs(values ...int) []UnspentOutput {
+	var utxos []UnspentOutput
+	for i, value := range values {
+		utxos = append(utxos, UnspentOutput{
+			Outpoint:     Outpoint{[]byte(fmt.Sprintf("transaction %d", i)), 0},
+			CoinTxOutput: CoinTxOutput{Value: value},
+		})
+	}
+	return utxos
+}
+
+func selectedValues(selection *CoinSelection) []int {
+	var values []int
+	for _, utxo := range selection.Inputs {
+		values = append(values, utxo.Value)
+	}
+	return values
+}
+
+// checkSelection checks the selection pays amount and its fee at feeRate for a
+// transaction with a change output only when there is change
+func checkSelection(t *testing.T, name string, selection *CoinSelection, amount, feeRate int) {
+	total := 0
+	for _, utxo := range selection.Inputs {
+		total += utxo.Value
+	}
+	if total != amount+selection.Fee+selection.Change {
+		t.Errorf("%s: inputs of %d do not add up to amount %d, fee %d and change %d", name, total, amount, selection.Fee, selection.Change)
+	}
+	outputs := 1
+	if selection.Change > 0 {
+		outputs = 2
+	}
+	if estimate := feeRate * estimateTxSize(len(selection.Inputs), outputs); selection.Fee < estimate {
+		t.Errorf("%s: fee %d is below the estimate %d", name, selection.Fee, estimate)
+	}
+}
+
+func TestCoinSelectors(t *testing.T) {
+	feeRate := 2
+	withChange := feeRate * estimateTxSize(1, 2)
+	withoutChange := feeRate * estimateTxSize(1, 1)
+	utxos := testUTXOs(10000, 500000, 70000)
+
+	tests := []struct {
+		name     string
+		selector CoinSelector
+		amount   int
+		inputs   []int
+		change   bool
+	}{
+		{"largest with change", LargestFirst{}, 300000, []int{500000}, true},
+		{"largest exact match", LargestFirst{}, 500000 - withoutChange, []int{500000}, false},
+		{"largest leftover below an input to the fee", LargestFirst{}, 500000 - withChange - inputCost(feeRate)/2, []int{500000}, false},
+		{"largest taking more inputs", LargestFirst{}, 540000, []int{500000, 70000}, true},
+		{"smallest with change", SmallestFirst{}, 1000, []int{10000}, true},
+		{"smallest exact match", SmallestFirst{}, 10000 - withoutChange, []int{10000}, false},
+		{"smallest taking more inputs", SmallestFirst{}, 50000, []int{10000, 70000}, true},
+	}
+	for _, test := range tests {
+		selection, err := test.selector.Select(utxos, test.amount, feeRate)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		checkSelection(t, test.name, selection, test.amount, feeRate)
+		if fmt.Sprint(selectedValues(selection)) != fmt.Sprint(test.inputs) {
+			t.Errorf("%s: spent %v, want %v", test.name, selectedValues(selection), test.inputs)
+		}
+		if (selection.Change > 0) != test.change {
+			t.Errorf("%s: change %d", test.name, selection.Change)
+		}
+	}
+
+	selection, err := LargestFirst{}.Select(testUTXOs(100000), 90000, feeRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selection.Fee != withChange || selection.Change != 100000-90000-withChange {
+		t.Errorf("fee %d and change %d, want %d and %d", selection.Fee, selection.Change, withChange, 100000-90000-withChange)
+	}
+
+	for name, selector := range CoinSelectors {
+		if _, err := selector.Select(utxos, 580000, feeRate); errors.Cause(err) != ErrInsufficientFunds {
+			t.Errorf("%s spending more than there is: got %v, want insufficient funds", name, err)
+		}
+		if _, err := selector.Select(nil, 1, feeRate); errors.Cause(err) != ErrInsufficientFunds {
+			t.Errorf("%s spending nothing: got %v, want insufficient funds", name, err)
+		}
+		if _, err := selector.Select(utxos, 580000, 0); err != nil {
+			t.Errorf("%s spending everything without a fee: %v", name, err)
+		}
+	}
+}
+
+func TestRandomSelection(t *testing.T) {
+	utxos := testUTXOs(1000, 2000, 3000, 4000, 5000)
+	first := make(map[int]bool)
+	for i := 0; i < 200; i++ {
+		selection, err := RandomSelection{}.Select(utxos, 2500, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSelection(t, "random", selection, 2500, 1)
+		first[selection.Inputs[0].Value] = true
+	}
+	if len(first) < 2 {
+		t.Errorf("the same output came first in every selection")
+	}
+}
+
+func TestBranchAndBound(t *testing.T) {
+	feeRate := 1
+	// 7000 and 3000 pay exactly for the payment and the fee without change
+	amount := 10000 - feeRate*estimateTxSize(2, 1)
+	selection, err := BranchAndBound{}.Select(testUTXOs(20000, 7000, 5000, 3000), amount, feeRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSelection(t, "exact match", selection, amount, feeRate)
+	if fmt.Sprint(selectedValues(selection)) != fmt.Sprint([]int{7000, 3000}) || selection.Change != 0 {
+		t.Errorf("spent %v with change %d, want 7000 and 3000 without change", selectedValues(selection), selection.Change)
+	}
+
+	// without an exact match it falls back to the largest output with change
+	selection, err = BranchAndBound{}.Select(testUTXOs(20000, 7000), 1000, feeRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSelection(t, "fallback", selection, 1000, feeRate)
+	if fmt.Sprint(selectedValues(selection)) != fmt.Sprint([]int{20000}) || selection.Change == 0 {
+		t.Errorf("spent %v with change %d, want 20000 with change", selectedValues(selection), selection.Change)
+	}
+}
+
+func TestManualSelection(t *testing.T) {
+	feeRate := 2
+	manual := &ManualSelection{Inputs: testUTXOs(1000, 20000)}
+	// the available outputs are ignored
+	selection, err := manual.Select(testUTXOs(1<<40), 5000, feeRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSelection(t, "manual with change", selection, 5000, feeRate)
+	if len(selection.Inputs) != 2 || selection.Change == 0 {
+		t.Errorf("spent %v with change %d, want both outputs with change", selectedValues(selection), selection.Change)
+	}
+
+	amount := 21000 - feeRate*estimateTxSize(2, 1)
+	selection, err = manual.Select(nil, amount, feeRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSelection(t, "manual exact match", selection, amount, feeRate)
+	if selection.Change != 0 {
+		t.Errorf("change %d, want none", selection.Change)
+	}
+
+	if _, err := manual.Select(nil, amount+1, feeRate); errors.Cause(err) != ErrInsufficientFunds {
+		t.Errorf("got %v, want insufficient funds", err)
+	}
+}
+
+// TestCoinSelectionFees sends with every strategy and checks the estimated
+// fee pays the fee rate of the signed transaction
+func TestCoinSelectionFees(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chain, pool, wallets, address := newTestChain(t, dir)
+	defer chain.Close()
+	w := wallets.Wallets[address]
+	from, err := wallets.AddWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := wallets.Wallets[from]
+
+	var outputs []CoinTxOutput
+	for _, value := range []int{3000, 5000, 8000, 13000, 21000, 34000} {
+		outputs = append(outputs, CoinTxOutput{Value: value, PubKeyHash: wallet.PublicKeyHash(sender.PublicKey)})
+	}
+	coin := testCoin(t, chain, w)
+	outputs = append(outputs, CoinTxOutput{Value: coin.Value - 100000, PubKeyHash: wallet.PublicKeyHash(w.PublicKey)})
+	if err := pool.Add(newTestPayment(t, pool, w, []Outpoint{coin.Outpoint}, outputs)); err != nil {
+		t.Fatal(err)
+	}
+	mineTestBlocks(t, pool, address, 1)
+
+	feeRate := 3
+	for _, name := range []string{"largest", "smallest", "bnb", "random"} {
+		selector, err := NewCoinSelector(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := NewTransaction(wallets, from, address, 4000, feeRate, selector, pool)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := pool.Add(tx); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		entry, _ := pool.Get(tx.ID)
+		if entry.Fee < feeRate*entry.Size {
+			t.Errorf("%s pays %d for %d bytes, less than %d per byte", name, entry.Fee, entry.Size, feeRate)
+		}
+	}
+	if _, err := NewCoinSelector("unknown"); err == nil {
+		t.Error("an unknown strategy was found")
+	}
+}
+
+func TestNewManualSelection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chain, pool, wallets, address := newTestChain(t, dir)
+	defer chain.Close()
+	w := wallets.Wallets[address]
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	coins := splitTestCoins(t, pool, w, address, 2, 100000)
+	spend := newTestTxWithFee(t, pool, w, coins[1], 1, 1000)
+	if err := pool.Add(spend); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewManualSelection(pool, pubKeyHash, []Outpoint{coins[0].Outpoint}); err != nil {
+		t.Error(err)
+	}
+	tests := []struct {
+		name       string
+		pubKeyHash []byte
+		outpoints  []Outpoint
+	}{
+		{"nothing", pubKeyHash, nil},
+		{"listed twice", pubKeyHash, []Outpoint{coins[0].Outpoint, coins[0].Outpoint}},
+		{"unknown", pubKeyHash, []Outpoint{{[]byte("no such transaction"), 0}}},
+		{"another key", make([]byte, 20), []Outpoint{coins[0].Outpoint}},
+		{"spent in the mempool", pubKeyHash, []Outpoint{coins[1].Outpoint}},
+	}
+	for _, test := range tests {
+		if _, err := NewManualSelection(pool, test.pubKeyHash, test.outpoints); err == nil {
+			t.Errorf("%s: the selection was accepted", test.name)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package blockchain
+
+import (
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/AntonBozhinov/sentinel/wallet"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// newTestChain creates a regtest chain in memory whose genesis pays a new
+// wallet, returning the chain, its mempool, the wallets and the address. The
+// wallets are kept in dir.
+func newTestChain(t *testing.T, dir string) (*BlockChain, *Mempool, *wallet.Wallets, string) {
+	return newTestChainWith(t, dir, Options{Store: storage.NewMemory(), Params: &params.Regtest})
+}
+
+// newTestChainWith creates a chain with opts like newTestChain
+func newTestChainWith(t *testing.T, dir string, opts Options) (*BlockChain, *Mempool, *wallet.Wallets, string) {
+	wallets, err := wallet.OpenWallets(dir, params.Regtest.AddressVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := wallets.AddWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := Init(opts, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (UTXOSet{BlockChain: chain}).Reindex(); err != nil {
+		chain.Close()
+		t.Fatal(err)
+	}
+	pool, err := NewMempool(chain)
+	if err != nil {
+		chain.Close()
+		t.Fatal(err)
+	}
+	return chain, pool, wallets, address
+}
+
+// newTestTx builds a transaction spending inputs of w with outputs of values
+// paying back to w, signed against the chain and the pool
+func newTestTx(t *testing.T, pool *Mempool, w *wallet.Wallet, inputs []Outpoint, values ...int) *CoinTransaction {
+	var outputs []CoinTxOutput
+	for _, value := range values {
+		outputs = append(outputs, CoinTxOutput{Value: value, PubKeyHash: wallet.PublicKeyHash(w.PublicKey)})
+	}
+	return newTestPayment(t, pool, w, inputs, outputs)
+}
+
+// newTestPayment builds a transaction spending inputs of w with outputs,
+// signed against the chain and the pool
+func newTestPayment(t *testing.T, pool *Mempool, w *wallet.Wallet, inputs []Outpoint, outputs []CoinTxOutput) *CoinTransaction {
+	tx := CoinTransaction{Outputs: outputs}
+	for _, in := range inputs {
+		tx.Inputs = append(tx.Inputs, CoinTxInput{ID: in.ID, Out: in.Out, PubKey: w.PublicKey})
+	}
+	tx.ID = tx.Hash()
+	if err := pool.SignTransaction(&tx, w.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	return &tx
+}
+
+// testCoin returns the largest unspent output of w
+func testCoin(t *testing.T, chain *BlockChain, w *wallet.Wallet) UnspentOutput {
+	coins, err := UTXOSet{BlockChain: chain}.FindUnspentOutputs(wallet.PublicKeyHash(w.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(coins) == 0 {
+		t.Fatal("the wallet has no coins")
+	}
+	largest := coins[0]
+	for _, coin := range coins {
+		if coin.Value > largest.Value {
+			largest = coin
+		}
+	}
+	return largest
+}
+
+// mineTestBlocks mines n blocks of templates from the pool paying address
+func mineTestBlocks(t *testing.T, pool *Mempool, address string, n int) []*Block {
+	var blocks []*Block
+	for i := 0; i < n; i++ {
+		tmpl, err := NewBlockTemplate(pool, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := tmpl.Mine(pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// TestConcurrentAccess mines blocks and adds transactions to the mempool while
+// other goroutines read the chain, the UTXO set and the mempool. The writers
+// share a lock, as the ones of a node do, the readers take none. Run it with
+// go test -race.
+func TestConcurrentAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chain, pool, wallets, miner := newTestChain(t, dir)
+	defer chain.Close()
+	to, err := wallets.AddWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	minerHash := wallet.PublicKeyHash(wallets.Wallets[miner].PublicKey)
+	const blocks = 20
+
+	var writers sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	mined := make(chan struct{})
+	// the mutex is not fair, the miner waits for an attempt to add a
+	// transaction before every block so it can not starve the other writer
+	tried := make(chan struct{}, 1)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(mined)
+		for i := 0; i < blocks; i++ {
+			<-tried
+			err := func() error {
+				writers.Lock()
+				defer writers.Unlock()
+				coinbase, err := RewardTransaction(miner, "", chain.Params.BlockReward)
+				if err != nil {
+					return err
+				}
+				data := append([]*CoinTransaction{coinbase}, pool.SelectPackages(chain.Params.MaxBlockSize/2)...)
+				block, err := chain.MineBlock(data)
+				if err != nil {
+					return err
+				}
+				if err := (&UTXOSet{BlockChain: chain}).Update(block); err != nil {
+					return err
+				}
+				return pool.RemoveForBlock(block)
+			}()
+			if err != nil {
+				errs <- errors.Wrap(err, "mining")
+				return
+			}
+		}
+	}()
+
+	added := 0
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(tried)
+		selector, err := NewCoinSelector("largest")
+		if err != nil {
+			errs <- err
+			return
+		}
+		for {
+			select {
+			case <-mined:
+				return
+			default:
+			}
+			err := func() error {
+				writers.Lock()
+				defer writers.Unlock()
+				tx, err := NewTransaction(wallets, miner, to, 1000, 1, selector, pool)
+				if errors.Cause(err) == ErrInsufficientFunds {
+					// the coins of the miner wait in the mempool for the next block
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := pool.Add(tx); err != nil {
+					return err
+				}
+				added++
+				return nil
+			}()
+			if err != nil {
+				errs <- errors.Wrap(err, "adding a transaction")
+				return
+			}
+			select {
+			case tried <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	readers := []func() error{
+		func() error {
+			_, err := chain.FindUTXO()
+			return err
+		},
+		func() error {
+			iter := chain.Iterator()
+			for hash := chain.LastHash(); len(hash) > 0; {
+				block, err := iter.Next()
+				if err != nil {
+					return err
+				}
+				hash = block.PrevHash
+			}
+			return nil
+		},
+		func() error {
+			_, err := chain.GetBestHeight()
+			return err
+		},
+		func() error {
+			_, err := UTXOSet{BlockChain: chain}.FindUnspentOutputs(minerHash)
+			return err
+		},
+		func() error {
+			for _, entry := range pool.Entries() {
+				pool.AncestorScore(entry.Tx.ID)
+			}
+			pool.SelectPackages(chain.Params.MaxBlockSize)
+			return nil
+		},
+	}
+	for _, read := range readers {
+		wg.Add(1)
+		go func(read func() error) {
+			defer wg.Done()
+			for {
+				select {
+				case <-mined:
+					return
+				default:
+				}
+				if err := read(); err != nil {
+					errs <- errors.Wrap(err, "reading")
+					return
+				}
+			}
+		}(read)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		return
+	}
+
+	if height, err := chain.GetBestHeight(); err != nil || height != blocks {
+		t.Fatalf("best height %d, %v, want %d", height, err, blocks)
+	}
+	if added == 0 {
+		t.Error("no transaction was added to the mempool")
+	}
+	if err := chain.VerifyChain(VerifyUTXO, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,23 @@
+package blockchain
+
+import "github.com/pkg/errors"
+
+// Errors returned by the package, possibly wrapped with more context.
+// Compare them against errors.Cause(err).
+var (
+	ErrNoChain           = errors.New("no existing blockchain found")
+	ErrChainExists       = errors.New("blockchain already exists")
+	ErrBlockNotFound     = errors.New("block not found")
+	ErrTxNotFound        = errors.New("transaction not found")
+	ErrInsufficientFunds = errors.New("not enough funds")
+	ErrInvalidTx         = errors.New("invalid transaction")
+	ErrInvalidBlock      = errors.New("invalid block")
+	ErrFeeTooLow         = errors.New("fee too low")
+	ErrTxInMempool       = errors.New("transaction already in the mempool")
+	ErrCorruptData       = errors.New("corrupt data")
+	ErrGenesisMismatch   = errors.New("genesis does not match the chain parameters")
+	ErrPruned            = errors.New("block data pruned")
+	ErrUnknownSnapshot   = errors.New("snapshot is not pinned in the chain parameters")
+	ErrNewerSchema       = errors.New("database was written by a newer version")
+	ErrLegacyBlocks      = errors.New("database holds blocks of a format no longer valid")
+)
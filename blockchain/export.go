@@ -0,0 +1,197 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// exportHeader starts a chain export. It is followed by the blocks of the best
+// chain from the genesis up, each one in the form of Block.Serialize.
+type exportHeader struct {
+	Network     string
+	GenesisHash []byte
+	Blocks      int
+}
+
+// ExportBlocks writes the best chain to w, from the genesis to the current tip,
+// and returns the number of blocks written. A pruned chain can not be exported.
+func (chain *BlockChain) ExportBlocks(w io.Writer) (int, error) {
+	pruned, err := chain.PruneHeight()
+	if err != nil {
+		return 0, err
+	}
+	if pruned > 0 {
+		return 0, errors.Wrapf(ErrPruned, "the blocks below height %d can not be exported", pruned)
+	}
+	iter, err := chain.ForwardIterator(0, -1)
+	if err != nil {
+		return 0, err
+	}
+
+	enc := gob.NewEncoder(w)
+	header := exportHeader{chain.Params.Name, chain.GenesisHash, iter.to + 1}
+	if err := enc.Encode(header); err != nil {
+		return 0, errors.Wrap(err, "error writing the export header")
+	}
+	written := 0
+	for iter.Valid() {
+		block, err := iter.Next()
+		if err != nil {
+			return written, err
+		}
+		if err := enc.Encode(block.Serialize()); err != nil {
+			return written, errors.Wrapf(err, "error writing block %x", block.Hash)
+		}
+		written++
+	}
+	return written, nil
+}
+
+// ImportBlocks adds the blocks of an export read from r to the chain of opts,
+// creating the chain from the genesis of the export when there is none. Every
+// block is validated before it is connected, see ValidateBlock. Blocks the chain
+// already has are skipped, or backfilled for a chain loaded from a snapshot,
+// and an export diverging from the best chain is refused. It returns the chain
+// and the number of blocks added to it.
+func ImportBlocks(opts Options, r io.Reader) (*BlockChain, int, error) {
+	if err := opts.validate(); err != nil {
+		return nil, 0, err
+	}
+	chainParams := opts.params()
+	dec := gob.NewDecoder(r)
+	var header exportHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, 0, errors.Wrapf(ErrCorruptData, "error reading the export header: %v", err)
+	}
+	if header.Network != chainParams.Name {
+		return nil, 0, errors.Wrapf(ErrGenesisMismatch, "the export is of %s, not %s", header.Network, chainParams.Name)
+	}
+	if err := checkGenesis(chainParams, header.GenesisHash); err != nil {
+		return nil, 0, err
+	}
+	if header.Blocks <= 0 {
+		return nil, 0, errors.Wrap(ErrCorruptData, "the export has no blocks")
+	}
+	readBlock := func(height int) (*Block, error) {
+		var data []byte
+		if err := dec.Decode(&data); err != nil {
+			return nil, errors.Wrapf(ErrCorruptData, "error reading the block at height %d: %v", height, err)
+		}
+		block, err := Deserialize(data)
+		if err != nil {
+			return nil, err
+		}
+		if block.Height != height {
+			return nil, errors.Wrapf(ErrCorruptData, "block %x has height %d instead of %d", block.Hash, block.Height, height)
+		}
+		return block, nil
+	}
+
+	genesis, err := readBlock(0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(genesis.PrevHash) != 0 || bytes.Compare(genesis.Hash, header.GenesisHash) != 0 {
+		return nil, 0, errors.Wrapf(ErrCorruptData, "the export does not start with its genesis %x", header.GenesisHash)
+	}
+	if err := CheckBlock(genesis, chainParams); err != nil {
+		return nil, 0, err
+	}
+
+	added := 0
+	var chain *BlockChain
+	exists, err := hasChain(opts)
+	switch {
+	case err != nil:
+	case exists:
+		chain, err = Open(opts)
+	default:
+		chain, err = initChain(opts, genesis)
+		if err == nil {
+			added++
+			if err = (UTXOSet{BlockChain: chain}).Reindex(); err != nil {
+				chain.Close()
+			}
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if bytes.Compare(chain.GenesisHash, genesis.Hash) != 0 {
+		chain.Close()
+		return nil, 0, errors.Wrapf(ErrGenesisMismatch, "the export starts at genesis %x, the chain at %x", genesis.Hash, chain.GenesisHash)
+	}
+	n, err := chain.importBlocks(header.Blocks, readBlock)
+	added += n
+	if err != nil {
+		chain.Close()
+		return nil, added, errors.Wrapf(err, "error importing after %d blocks", added)
+	}
+	return chain, added, nil
+}
+
+// hasChain reports whether the store of opts holds a chain, for a badger
+// database whether its directory exists
+func hasChain(opts Options) (bool, error) {
+	if opts.Store == nil {
+		return hasDB(opts), nil
+	}
+	found := false
+	err := opts.Store.View(func(txn storage.Txn) error {
+		_, err := txn.Get([]byte(lastHashKey))
+		if err == storage.ErrKeyNotFound {
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	return found, errors.Wrap(err, "error getting last hash")
+}
+
+// importBlocks reads the blocks above the genesis of an export and connects
+// the ones the chain does not have yet
+func (chain *BlockChain) importBlocks(blocks int, readBlock func(height int) (*Block, error)) (int, error) {
+	pool, err := NewMempool(chain)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	for height := 1; height < blocks; height++ {
+		block, err := readBlock(height)
+		if err != nil {
+			return added, err
+		}
+		var local []byte
+		err = chain.Database.View(func(txn storage.Txn) error {
+			hash, err := txn.Get(heightKey(height))
+			if err == storage.ErrKeyNotFound {
+				return nil
+			}
+			local = hash
+			return err
+		})
+		if err != nil {
+			return added, err
+		}
+		if local != nil {
+			if bytes.Compare(local, block.Hash) != 0 {
+				return added, errors.Wrapf(ErrInvalidBlock, "block %x at height %d conflicts with %x of the chain", block.Hash, height, local)
+			}
+			if err := CheckBlock(block, chain.Params); err != nil {
+				return added, err
+			}
+			if err := chain.AddBlock(block); err != nil {
+				return added, err
+			}
+			continue
+		}
+		if _, err := ConnectBlock(pool, block); err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
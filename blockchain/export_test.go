@@ -0,0 +1,102 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// writeExport writes an export of blocks the way ExportBlocks does
+func writeExport(t *testing.T, chain *BlockChain, blocks []*Block) *bytes.Buffer {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(exportHeader{chain.Params.Name, chain.GenesisHash, len(blocks)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range blocks {
+		if err := enc.Encode(block.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &buf
+}
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source, pool, wallets, address := newTestChain(t, dir)
+	defer source.Close()
+	w := wallets.Wallets[address]
+	coins := splitTestCoins(t, pool, w, address, 2, 100000)
+	if err := pool.Add(newTestTxWithFee(t, pool, w, coins[0], 1, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	mineTestBlocks(t, pool, address, 3)
+
+	var export bytes.Buffer
+	written, err := source.ExportBlocks(&export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 5 {
+		t.Errorf("exported %d blocks, want 5", written)
+	}
+	data := export.Bytes()
+
+	chain, added, err := ImportBlocks(Options{Store: storage.NewMemory(), Params: &params.Regtest}, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Close()
+	if added != written || bytes.Compare(chain.LastHash(), source.LastHash()) != 0 {
+		t.Errorf("imported %d blocks up to %x, want %d up to %x", added, chain.LastHash(), written, source.LastHash())
+	}
+	if bytes.Compare(storedUTXOHash(t, chain), storedUTXOHash(t, source)) != 0 {
+		t.Error("the imported UTXO set differs from the one of the source")
+	}
+	if err := chain.VerifyChain(VerifyUTXO, nil); err != nil {
+		t.Error(err)
+	}
+
+	var blocks []*Block
+	for height := 0; height < written; height++ {
+		block, err := source.BlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+	tampered := *blocks[3]
+	tampered.Timestamp++
+	other, _, _, _ := newTestChain(t, dir)
+	defer other.Close()
+
+	tests := []struct {
+		name  string
+		opts  Options
+		input []byte
+		want  error
+	}{
+		{"another network", Options{Store: storage.NewMemory(), Params: &params.Testnet}, data, ErrGenesisMismatch},
+		{"another genesis", Options{Store: other.Database, Params: &params.Regtest}, data, ErrGenesisMismatch},
+		{"truncated", Options{Store: storage.NewMemory(), Params: &params.Regtest}, data[:len(data)-10], ErrCorruptData},
+		{"empty", Options{Store: storage.NewMemory(), Params: &params.Regtest}, nil, ErrCorruptData},
+		{"tampered block", Options{Store: storage.NewMemory(), Params: &params.Regtest},
+			writeExport(t, source, []*Block{blocks[0], blocks[1], blocks[2], &tampered}).Bytes(), ErrInvalidBlock},
+		{"blocks out of order", Options{Store: storage.NewMemory(), Params: &params.Regtest},
+			writeExport(t, source, []*Block{blocks[0], blocks[2], blocks[1]}).Bytes(), ErrCorruptData},
+	}
+	for _, test := range tests {
+		if _, _, err := ImportBlocks(test.opts, bytes.NewReader(test.input)); errors.Cause(err) != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
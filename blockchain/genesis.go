@@ -0,0 +1,109 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/AntonBozhinov/sentinel/wallet"
+	"github.com/pkg/errors"
+	"golang.org/x/tools/container/intsets"
+	"time"
+)
+
+// genesisKey stores the hash of the first block of the chain
+const genesisKey = "genesis"
+
+// Genesis builds the first block of a chain around its coinbase
+func Genesis(txn *CoinTransaction, timestamp int64, difficulty int) *Block {
+	return createBlockAt(timestamp, []*CoinTransaction{txn}, []byte{}, 0, difficulty, nil)
+}
+
+// GenesisBlock builds the genesis of the network of p. When its spec has no
+// allocations the whole supply goes to address, as in the first chains, and
+// otherwise address must be empty. A spec with a timestamp always gives the
+// same block, whose hash is checked against the pinned genesis hash.
+func GenesisBlock(p *params.ChainParams, address string) (*Block, error) {
+	allocations := p.Genesis.Allocations
+	switch {
+	case len(allocations) == 0 && address == "":
+		return nil, errors.Wrapf(wallet.ErrInvalidAddress, "the genesis of %s needs an address to pay to", p.Name)
+	case len(allocations) == 0:
+		allocations = []params.Allocation{{Address: address, Amount: intsets.MaxInt - 1}}
+	case address != "":
+		return nil, errors.Errorf("the genesis of %s pays to its allocations, not to %s", p.Name, address)
+	}
+
+	total := 0
+	for _, allocation := range allocations {
+		if !wallet.ValidateAddress(allocation.Address, p.AddressVersion) {
+			return nil, errors.Wrapf(wallet.ErrInvalidAddress, "genesis allocation to %s is not a %s address", allocation.Address, p.Name)
+		}
+		if allocation.Amount <= 0 || allocation.Amount > intsets.MaxInt-total {
+			return nil, errors.Errorf("genesis allocation of %d to %s is out of range", allocation.Amount, allocation.Address)
+		}
+		total += allocation.Amount
+	}
+
+	cbtx, err := GenesisTransaction(allocations, p.Genesis.ExtraData)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := p.Genesis.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().Unix()
+	}
+	genesis := Genesis(cbtx, timestamp, p.Difficulty)
+	if err := checkGenesis(p, genesis.Hash); err != nil {
+		return nil, err
+	}
+	return genesis, nil
+}
+
+// checkGenesis fails with ErrGenesisMismatch when p pins another genesis hash
+func checkGenesis(p *params.ChainParams, hash []byte) error {
+	if p.GenesisHash == "" {
+		return nil
+	}
+	pinned, err := hex.DecodeString(p.GenesisHash)
+	if err != nil {
+		return errors.Wrapf(err, "genesis hash %q of %s is not hex", p.GenesisHash, p.Name)
+	}
+	if bytes.Compare(pinned, hash) != 0 {
+		return errors.Wrapf(ErrGenesisMismatch, "genesis %x, %s pins %x", hash, p.Name, pinned)
+	}
+	return nil
+}
+
+// loadGenesisHash reads the genesis hash of the chain, walking back from the
+// tip and remembering it for chains created before it was stored
+func loadGenesisHash(db storage.Store, lastHash []byte) ([]byte, error) {
+	var hash []byte
+	err := db.View(func(txn storage.Txn) error {
+		var err error
+		hash, err = txn.Get([]byte(genesisKey))
+		if err == storage.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil || hash != nil {
+		return hash, errors.Wrap(err, "error getting the genesis hash")
+	}
+
+	iter := &Iterator{CurrentHash: lastHash, Database: db}
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if len(block.PrevHash) == 0 {
+			hash = block.Hash
+			break
+		}
+	}
+	err = db.Update(func(txn storage.Txn) error {
+		return txn.Set([]byte(genesisKey), hash)
+	})
+	return hash, errors.Wrap(err, "error saving the genesis hash")
+}
@@ -0,0 +1,225 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+)
+
+// heightPrefix keys the hash of the block at every height of the best chain
+var heightPrefix = []byte("height-")
+
+func heightKey(height int) []byte {
+	key := make([]byte, len(heightPrefix)+8)
+	copy(key, heightPrefix)
+	binary.BigEndian.PutUint64(key[len(heightPrefix):], uint64(height))
+	return key
+}
+
+// indexBestChain points the height index at the chain ending in tip. It walks
+// back from the tip until it reaches a block the index already holds, so
+// extending the chain costs one write and a reorganization one per replaced block.
+// Replacing pruned blocks fails with ErrPruned, they can not be disconnected.
+func indexBestChain(txn storage.Txn, tip *Block) error {
+	pruned, err := pruneHeight(txn)
+	if err != nil {
+		return err
+	}
+	block := tip
+	for {
+		indexed, err := txn.Get(heightKey(block.Height))
+		if err != nil && err != storage.ErrKeyNotFound {
+			return err
+		}
+		if bytes.Compare(indexed, block.Hash) == 0 {
+			return nil
+		}
+		if block.Height < pruned {
+			return errors.Wrapf(ErrPruned, "can not reorganize below height %d", pruned)
+		}
+		if err := txn.Set(heightKey(block.Height), block.Hash); err != nil {
+			return errors.Wrapf(err, "error indexing block %x", block.Hash)
+		}
+		if len(block.PrevHash) == 0 {
+			return nil
+		}
+		data, err := txn.Get(block.PrevHash)
+		if err != nil {
+			return errors.Wrapf(err, "error getting block %x", block.PrevHash)
+		}
+		if block, err = Deserialize(data); err != nil {
+			return err
+		}
+	}
+}
+
+// heightIndexBatch bounds the blocks ensureHeightIndex rewrites in one transaction
+const heightIndexBatch = 1000
+
+// ensureHeightIndex builds the height index of chains created before it
+// existed, see migrations. Blocks stored before they recorded their height read
+// as height 0, so the heights are counted along PrevHash from the genesis up
+// and written back into the blocks of the best chain. Blocks off the best
+// chain keep the height they were stored with.
+func ensureHeightIndex(db storage.Store) error {
+	var hashes [][]byte
+	err := db.View(func(txn storage.Txn) error {
+		hash, err := txn.Get([]byte(lastHashKey))
+		if err != nil {
+			return errors.Wrap(err, "error getting the last hash")
+		}
+		for {
+			data, err := txn.Get(hash)
+			if err != nil {
+				return errors.Wrapf(err, "error getting block %x", hash)
+			}
+			block, err := Deserialize(data)
+			if err != nil {
+				return err
+			}
+			hashes = append(hashes, hash)
+			if len(block.PrevHash) == 0 {
+				return nil
+			}
+			hash = block.PrevHash
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "error walking the best chain")
+	}
+
+	for from := 0; from < len(hashes); from += heightIndexBatch {
+		err := db.Update(func(txn storage.Txn) error {
+			for height := from; height < len(hashes) && height < from+heightIndexBatch; height++ {
+				hash := hashes[len(hashes)-1-height]
+				data, err := txn.Get(hash)
+				if err != nil {
+					return errors.Wrapf(err, "error getting block %x", hash)
+				}
+				block, err := Deserialize(data)
+				if err != nil {
+					return err
+				}
+				if block.Height != height {
+					block.Height = height
+					if err := txn.Set(hash, block.Serialize()); err != nil {
+						return errors.Wrapf(err, "error setting the height of block %x", hash)
+					}
+				}
+				if err := txn.Set(heightKey(height), hash); err != nil {
+					return errors.Wrapf(err, "error indexing block %x", hash)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "error building the height index")
+		}
+	}
+	return nil
+}
+
+// BlockByHash returns the block with the given hash, on the best chain or not.
+// It fails with ErrPruned when only the header of the block is left.
+func (chain *BlockChain) BlockByHash(hash []byte) (*Block, error) {
+	block, err := readBlock(chain.Database, chain.blockCache, hash)
+	if err != nil {
+		return nil, err
+	}
+	if block.Pruned() {
+		return nil, errors.Wrapf(ErrPruned, "block %x at height %d", hash, block.Height)
+	}
+	return block, nil
+}
+
+// BlockByHeight returns the block of the best chain at height
+func (chain *BlockChain) BlockByHeight(height int) (*Block, error) {
+	var hash []byte
+	err := chain.Database.View(func(txn storage.Txn) error {
+		var err error
+		hash, err = txn.Get(heightKey(height))
+		if err == storage.ErrKeyNotFound {
+			return errors.Wrapf(ErrBlockNotFound, "no block at height %d", height)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	block, err := readBlock(chain.Database, chain.blockCache, hash)
+	if errors.Cause(err) == ErrBlockNotFound {
+		return nil, errors.Wrapf(ErrBlockNotFound, "%x at height %d", hash, height)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if block.Pruned() {
+		return nil, errors.Wrapf(ErrPruned, "block %x at height %d", hash, height)
+	}
+	return block, nil
+}
+
+// blockAtHeight reads the block of the best chain at height inside a transaction
+func blockAtHeight(txn storage.Txn, height int) (*Block, error) {
+	hash, err := txn.Get(heightKey(height))
+	if err == storage.ErrKeyNotFound {
+		return nil, errors.Wrapf(ErrBlockNotFound, "no block at height %d", height)
+	}
+	if err != nil {
+		return nil, err
+	}
+	blockData, err := txn.Get(hash)
+	if err == storage.ErrKeyNotFound {
+		return nil, errors.Wrapf(ErrBlockNotFound, "%x at height %d", hash, height)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := Deserialize(blockData)
+	if err == nil && block.Pruned() {
+		return nil, errors.Wrapf(ErrPruned, "block %x at height %d", hash, height)
+	}
+	return block, err
+}
+
+// ForwardIterator walks the best chain from lower to higher heights
+type ForwardIterator struct {
+	chain *BlockChain
+	next  int
+	to    int
+}
+
+// ForwardIterator iterates over the blocks of the best chain from height from
+// to height to, both included. A negative or too high to ends at the tip.
+func (chain *BlockChain) ForwardIterator(from, to int) (*ForwardIterator, error) {
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+	if to < 0 || to > bestHeight {
+		to = bestHeight
+	}
+	if from < 0 {
+		from = 0
+	}
+	return &ForwardIterator{chain, from, to}, nil
+}
+
+// Valid reports whether Next has another block to return
+func (iter *ForwardIterator) Valid() bool {
+	return iter.next <= iter.to
+}
+
+// Next returns the block at the current height and moves to the following one
+func (iter *ForwardIterator) Next() (*Block, error) {
+	if !iter.Valid() {
+		return nil, errors.Wrapf(ErrBlockNotFound, "iteration ended at height %d", iter.to)
+	}
+	block, err := iter.chain.BlockByHeight(iter.next)
+	if err != nil {
+		return nil, err
+	}
+	iter.next++
+	return block, nil
+}
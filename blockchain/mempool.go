@@ -0,0 +1,677 @@
+package blockchain
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/ecdsa"
+	"encoding/gob"
+	"encoding/hex"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// MinRelayFeeRate is the lowest fee per serialized byte accepted into the mempool.
+	// A replacement has to pay it again on top of the fees of everything it evicts.
+	MinRelayFeeRate = 1
+	// MaxReplacementEvictions limits how many transactions a single replacement may evict
+	MaxReplacementEvictions = 100
+	// MaxAncestors limits the length of unconfirmed transaction chains
+	MaxAncestors = 25
+)
+
+var mempoolPrefix = []byte("mempool-")
+
+// MempoolEntry is a transaction waiting to be included in a block
+type MempoolEntry struct {
+	Tx   *CoinTransaction
+	Fee  int
+	Size int
+	Time int64
+	// ancestorFee and ancestorSize add up the entry and its unconfirmed
+	// ancestors, the pool keeps them up to date as transactions come and go
+	ancestorFee  int
+	ancestorSize int
+}
+
+// Mempool holds the valid unconfirmed transactions. Entries are persisted in the
+// chain database so the pool survives restarts of the node and the CLI. The
+// pool is safe for concurrent use, the exported fields of entries are never
+// changed once accepted.
+type Mempool struct {
+	BlockChain *BlockChain
+	// mu guards entries and spends
+	mu      sync.RWMutex
+	entries map[string]*MempoolEntry
+	// spends maps an outpoint to the id of the pool transaction spending it
+	spends map[string]string
+}
+
+func mempoolKey(txID []byte) []byte {
+	key := make([]byte, 0, len(mempoolPrefix)+len(txID))
+	key = append(key, mempoolPrefix...)
+	return append(key, txID...)
+}
+
+// FeeRate is the fee paid per serialized byte
+func (e *MempoolEntry) FeeRate() int {
+	return e.Fee / e.Size
+}
+
+// Serialize the entry. Encoding into memory can not fail,
+// a panic here is a programming error.
+func (e *MempoolEntry) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(e)
+	if err != nil {
+		log.Panicf("error serializing a mempool entry: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func deserializeMempoolEntry(data []byte) (*MempoolEntry, error) {
+	var entry MempoolEntry
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&entry)
+	if err != nil {
+		return nil, errors.Wrapf(ErrCorruptData, "error deserializing a mempool entry: %v", err)
+	}
+	return &entry, nil
+}
+
+// higherFeeRate compares fee rates without losing precision to integer division
+func higherFeeRate(fee, size, otherFee, otherSize int) bool {
+	return fee*otherSize > otherFee*size
+}
+
+// NewMempool loads the persisted pool of the chain, dropping transactions
+// whose inputs were confirmed or spent in the meantime
+func NewMempool(chain *BlockChain) (*Mempool, error) {
+	mp := &Mempool{BlockChain: chain}
+	if err := mp.Reload(); err != nil {
+		return nil, err
+	}
+	return mp, nil
+}
+
+// Reload replaces the pool with the persisted one, dropping transactions
+// whose inputs are no longer unspent, as after a reorganization of the chain
+func (mp *Mempool) Reload() error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.entries = make(map[string]*MempoolEntry)
+	mp.spends = make(map[string]string)
+	err := mp.BlockChain.Database.View(func(txn storage.Txn) error {
+		it := txn.NewIterator(storage.IteratorOptions{Prefix: mempoolPrefix})
+		defer it.Close()
+		for ; it.Valid(); it.Next() {
+			v, err := it.Value()
+			if err != nil {
+				return err
+			}
+			entry, err := deserializeMempoolEntry(v)
+			if err != nil {
+				return err
+			}
+			mp.index(entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "error loading the mempool")
+	}
+	for _, entry := range mp.entries {
+		mp.setAncestorScore(entry)
+	}
+
+	UTXOSet := UTXOSet{BlockChain: mp.BlockChain}
+	for _, entry := range mp.sortedEntries() {
+		if _, ok := mp.entries[hex.EncodeToString(entry.Tx.ID)]; !ok {
+			continue
+		}
+		for _, in := range entry.Tx.Inputs {
+			if _, ok := mp.entries[hex.EncodeToString(in.ID)]; ok {
+				continue
+			}
+			_, ok, err := UTXOSet.FindOutput(Outpoint{in.ID, in.Out})
+			if err != nil {
+				return err
+			}
+			if !ok {
+				if err := mp.remove(entry.Tx.ID); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Count returns the number of transactions in the pool
+func (mp *Mempool) Count() int {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return len(mp.entries)
+}
+
+// Get returns the pool entry of a transaction
+func (mp *Mempool) Get(txID []byte) (*MempoolEntry, bool) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return mp.get(txID)
+}
+
+func (mp *Mempool) get(txID []byte) (*MempoolEntry, bool) {
+	entry, ok := mp.entries[hex.EncodeToString(txID)]
+	return entry, ok
+}
+
+// Entries returns all pool entries in the order they were accepted
+func (mp *Mempool) Entries() []*MempoolEntry {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return mp.sortedEntries()
+}
+
+func (mp *Mempool) sortedEntries() []*MempoolEntry {
+	entries := make([]*MempoolEntry, 0, len(mp.entries))
+	for _, entry := range mp.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Time != entries[j].Time {
+			return entries[i].Time < entries[j].Time
+		}
+		return bytes.Compare(entries[i].Tx.ID, entries[j].Tx.ID) < 0
+	})
+	return entries
+}
+
+// IsSpent reports whether a pool transaction already spends the outpoint
+func (mp *Mempool) IsSpent(outpoint Outpoint) bool {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	_, ok := mp.spends[outpoint.String()]
+	return ok
+}
+
+// Add validates a transaction against the UTXO set and the pool and accepts it.
+// A transaction spending outputs already spent in the pool replaces the
+// conflicting transactions only when it pays a strictly higher fee and fee rate.
+func (mp *Mempool) Add(tx *CoinTransaction) error {
+	if tx.IsCoinTransaction() {
+		return errors.Wrap(ErrInvalidTx, "coinbase transactions are not accepted into the mempool")
+	}
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if _, ok := mp.get(tx.ID); ok {
+		return errors.Wrapf(ErrTxInMempool, "%x", tx.ID)
+	}
+
+	entry, conflicts, err := mp.check(tx)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		if err := mp.checkReplacement(entry, conflicts); err != nil {
+			return err
+		}
+	}
+
+	// the replacement and what it evicts are written at once, a failed write
+	// leaves the pool as it was
+	evicted := mp.evictions(conflicts)
+	err = mp.BlockChain.Database.Update(func(txn storage.Txn) error {
+		for _, e := range evicted {
+			if err := txn.Delete(mempoolKey(e.Tx.ID)); err != nil {
+				return err
+			}
+		}
+		return txn.Set(mempoolKey(tx.ID), entry.Serialize())
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error saving mempool transaction %x", tx.ID)
+	}
+	for _, e := range evicted {
+		mp.drop(e)
+	}
+	mp.index(entry)
+	mp.setAncestorScore(entry)
+	return nil
+}
+
+// check validates the size, ID, inputs, signatures and fee of a transaction and returns
+// the pool transactions it conflicts with
+func (mp *Mempool) check(tx *CoinTransaction) (*MempoolEntry, []*MempoolEntry, error) {
+	if size, limit := tx.Size(), mp.BlockChain.Params.MaxTxSize; size > limit {
+		return nil, nil, errors.Wrapf(ErrInvalidTx, "transaction has %d bytes, the limit is %d", size, limit)
+	}
+	if bytes.Compare(unsignedHash(tx), tx.ID) != 0 {
+		return nil, nil, errors.Wrapf(ErrInvalidTx, "transaction %x does not hash to its ID", tx.ID)
+	}
+	var conflicts []*MempoolEntry
+	UTXOSet := UTXOSet{BlockChain: mp.BlockChain}
+	seen := make(map[string]bool)
+	inValue := 0
+
+	for _, in := range tx.Inputs {
+		outpoint := Outpoint{in.ID, in.Out}
+		if seen[outpoint.String()] {
+			return nil, nil, errors.Wrapf(ErrInvalidTx, "input %s is spent twice", outpoint)
+		}
+		seen[outpoint.String()] = true
+
+		var out CoinTxOutput
+		if parent, ok := mp.get(in.ID); ok {
+			if in.Out < 0 || in.Out >= len(parent.Tx.Outputs) {
+				return nil, nil, errors.Wrapf(ErrInvalidTx, "input %s does not exist", outpoint)
+			}
+			out = parent.Tx.Outputs[in.Out]
+		} else {
+			output, ok, err := UTXOSet.FindOutput(outpoint)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !ok {
+				return nil, nil, errors.Wrapf(ErrInvalidTx, "input %s is missing or already spent", outpoint)
+			}
+			out = output
+		}
+		if !in.UsesKey(out.PubKeyHash) {
+			return nil, nil, errors.Wrapf(ErrInvalidTx, "input %s is not signed by the owner of the output", outpoint)
+		}
+		inValue += out.Value
+
+		if spender, ok := mp.spends[outpoint.String()]; ok {
+			conflict := mp.entries[spender]
+			duplicate := false
+			for _, c := range conflicts {
+				duplicate = duplicate || c == conflict
+			}
+			if !duplicate {
+				conflicts = append(conflicts, conflict)
+			}
+		}
+	}
+
+	outValue := 0
+	for _, out := range tx.Outputs {
+		if out.Value <= 0 {
+			return nil, nil, errors.Wrap(ErrInvalidTx, "transaction outputs must have a positive value")
+		}
+		outValue += out.Value
+	}
+	if outValue > inValue {
+		return nil, nil, errors.Wrapf(ErrInvalidTx, "transaction spends %d but its inputs are only worth %d", outValue, inValue)
+	}
+
+	entry := &MempoolEntry{
+		Tx:   tx,
+		Fee:  inValue - outValue,
+		Size: tx.Size(),
+		Time: time.Now().UnixNano(),
+	}
+	if entry.Fee < MinRelayFeeRate*entry.Size {
+		return nil, nil, errors.Wrapf(ErrFeeTooLow, "fee %d is below the minimum relay fee %d", entry.Fee, MinRelayFeeRate*entry.Size)
+	}
+
+	prevTXs, err := mp.prevTransactions(tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	valid, err := tx.Verify(prevTXs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !valid {
+		return nil, nil, errors.Wrapf(ErrInvalidTx, "transaction %x has an invalid signature", tx.ID)
+	}
+
+	if len(mp.ancestors(tx)) > MaxAncestors {
+		return nil, nil, errors.Wrapf(ErrInvalidTx, "transaction has more than %d unconfirmed ancestors", MaxAncestors)
+	}
+	return entry, conflicts, nil
+}
+
+// checkReplacement applies the anti-DoS rules for replace-by-fee: the
+// replacement must not evict too many transactions, must not depend on what it
+// evicts, must beat the fee rate of every direct conflict and must pay for the
+// evicted fees plus its own relay.
+func (mp *Mempool) checkReplacement(entry *MempoolEntry, conflicts []*MempoolEntry) error {
+	evicted := mp.evictions(conflicts)
+	if len(evicted) > MaxReplacementEvictions {
+		return errors.Wrapf(ErrInvalidTx, "replacement would evict %d transactions, the limit is %d", len(evicted), MaxReplacementEvictions)
+	}
+
+	for _, in := range entry.Tx.Inputs {
+		if _, ok := evicted[hex.EncodeToString(in.ID)]; ok {
+			return errors.Wrapf(ErrInvalidTx, "replacement spends an output of the transaction %x it replaces", in.ID)
+		}
+	}
+
+	for _, conflict := range conflicts {
+		if !higherFeeRate(entry.Fee, entry.Size, conflict.Fee, conflict.Size) {
+			return errors.Wrapf(ErrFeeTooLow, "replacement fee rate must be higher than the fee rate of %x", conflict.Tx.ID)
+		}
+	}
+
+	evictedFees := 0
+	for _, e := range evicted {
+		evictedFees += e.Fee
+	}
+	if entry.Fee-evictedFees < MinRelayFeeRate*entry.Size {
+		return errors.Wrapf(ErrFeeTooLow, "replacement fee %d must exceed the replaced fees %d by at least %d",
+			entry.Fee, evictedFees, MinRelayFeeRate*entry.Size)
+	}
+	return nil
+}
+
+// evictions returns the conflicting transactions and their descendants by ID,
+// everything a replacement removes from the pool
+func (mp *Mempool) evictions(conflicts []*MempoolEntry) map[string]*MempoolEntry {
+	evicted := make(map[string]*MempoolEntry)
+	for _, conflict := range conflicts {
+		evicted[hex.EncodeToString(conflict.Tx.ID)] = conflict
+		for _, descendant := range mp.descendants(conflict.Tx.ID) {
+			evicted[hex.EncodeToString(descendant.Tx.ID)] = descendant
+		}
+	}
+	return evicted
+}
+
+func (mp *Mempool) index(entry *MempoolEntry) {
+	txID := hex.EncodeToString(entry.Tx.ID)
+	mp.entries[txID] = entry
+	for _, in := range entry.Tx.Inputs {
+		mp.spends[Outpoint{in.ID, in.Out}.String()] = txID
+	}
+}
+
+func (mp *Mempool) unindex(entry *MempoolEntry) error {
+	err := mp.BlockChain.Database.Update(func(txn storage.Txn) error {
+		return txn.Delete(mempoolKey(entry.Tx.ID))
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error removing mempool transaction %x", entry.Tx.ID)
+	}
+	mp.drop(entry)
+	return nil
+}
+
+// drop removes an entry from the indexes, the descendants it leaves behind
+// no longer count it in their ancestor scores
+func (mp *Mempool) drop(entry *MempoolEntry) {
+	for _, descendant := range mp.descendants(entry.Tx.ID) {
+		descendant.ancestorFee -= entry.Fee
+		descendant.ancestorSize -= entry.Size
+	}
+	delete(mp.entries, hex.EncodeToString(entry.Tx.ID))
+	for _, in := range entry.Tx.Inputs {
+		delete(mp.spends, Outpoint{in.ID, in.Out}.String())
+	}
+}
+
+// setAncestorScore adds up the ancestor fee and size of an entry whose ancestors are all indexed
+func (mp *Mempool) setAncestorScore(entry *MempoolEntry) {
+	entry.ancestorFee, entry.ancestorSize = entry.Fee, entry.Size
+	for _, ancestor := range mp.ancestors(entry.Tx) {
+		entry.ancestorFee += ancestor.Fee
+		entry.ancestorSize += ancestor.Size
+	}
+}
+
+// Remove drops a transaction and everything spending its outputs from the pool
+func (mp *Mempool) Remove(txID []byte) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.remove(txID)
+}
+
+func (mp *Mempool) remove(txID []byte) error {
+	entry, ok := mp.get(txID)
+	if !ok {
+		return nil
+	}
+	for _, descendant := range mp.descendants(txID) {
+		if err := mp.unindex(descendant); err != nil {
+			return err
+		}
+	}
+	return mp.unindex(entry)
+}
+
+// RemoveForBlock drops the transactions confirmed by a block together with
+// the pool transactions that conflict with them
+func (mp *Mempool) RemoveForBlock(block *Block) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for _, tx := range block.Transactions {
+		if entry, ok := mp.get(tx.ID); ok {
+			if err := mp.unindex(entry); err != nil {
+				return err
+			}
+		}
+	}
+	for _, tx := range block.Transactions {
+		if tx.IsCoinTransaction() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			if spender, ok := mp.spends[Outpoint{in.ID, in.Out}.String()]; ok {
+				if err := mp.remove(mp.entries[spender].Tx.ID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (mp *Mempool) ancestors(tx *CoinTransaction) []*MempoolEntry {
+	var ancestors []*MempoolEntry
+	visited := make(map[string]bool)
+	queue := []*CoinTransaction{tx}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, in := range current.Inputs {
+			parentID := hex.EncodeToString(in.ID)
+			parent, ok := mp.entries[parentID]
+			if !ok || visited[parentID] {
+				continue
+			}
+			visited[parentID] = true
+			ancestors = append(ancestors, parent)
+			queue = append(queue, parent.Tx)
+		}
+	}
+	return ancestors
+}
+
+// Ancestors returns the unconfirmed transactions a pool transaction depends on
+func (mp *Mempool) Ancestors(txID []byte) []*MempoolEntry {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	entry, ok := mp.get(txID)
+	if !ok {
+		return nil
+	}
+	return mp.ancestors(entry.Tx)
+}
+
+// Descendants returns the pool transactions spending the outputs of a
+// transaction, directly or through other pool transactions
+func (mp *Mempool) Descendants(txID []byte) []*MempoolEntry {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return mp.descendants(txID)
+}
+
+func (mp *Mempool) descendants(txID []byte) []*MempoolEntry {
+	var descendants []*MempoolEntry
+	visited := make(map[string]bool)
+	queue := [][]byte{txID}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		outputs := 0
+		if entry, ok := mp.get(current); ok {
+			outputs = len(entry.Tx.Outputs)
+		}
+		for out := 0; out < outputs; out++ {
+			childID, ok := mp.spends[Outpoint{current, out}.String()]
+			if !ok || visited[childID] {
+				continue
+			}
+			visited[childID] = true
+			child := mp.entries[childID]
+			descendants = append(descendants, child)
+			queue = append(queue, child.Tx.ID)
+		}
+	}
+	return descendants
+}
+
+// AncestorScore returns the fee and size of a transaction together with all of
+// its unconfirmed ancestors, the package a miner has to include to collect its fee
+func (mp *Mempool) AncestorScore(txID []byte) (int, int) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	entry, ok := mp.get(txID)
+	if !ok {
+		return 0, 0
+	}
+	return entry.ancestorFee, entry.ancestorSize
+}
+
+// packageCandidate is a pool transaction with the fee and size of its package,
+// itself and the ancestors not selected yet, as of when it was queued
+type packageCandidate struct {
+	entry *MempoolEntry
+	fee   int
+	size  int
+}
+
+// packageQueue is a heap of candidates, the package with the highest fee rate
+// first and ties going to the lower transaction ID
+type packageQueue []packageCandidate
+
+func (q packageQueue) Len() int      { return len(q) }
+func (q packageQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q packageQueue) Less(i, j int) bool {
+	a, b := q[i], q[j]
+	if higherFeeRate(a.fee, a.size, b.fee, b.size) {
+		return true
+	}
+	if higherFeeRate(b.fee, b.size, a.fee, a.size) {
+		return false
+	}
+	return bytes.Compare(a.entry.Tx.ID, b.entry.Tx.ID) < 0
+}
+
+func (q *packageQueue) Push(x interface{}) {
+	*q = append(*q, x.(packageCandidate))
+}
+
+func (q *packageQueue) Pop() interface{} {
+	old := *q
+	candidate := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return candidate
+}
+
+// SelectPackages picks transactions for a block of at most maxSize bytes by
+// repeatedly taking the package with the highest ancestor fee rate, so a high
+// fee child pulls its low fee parents in with it. The result is in an order
+// where parents always come before their children. The packages start out as
+// the ancestor scores of the entries and only the ones of the descendants of a
+// selected transaction are queued again, shrunk by it.
+func (mp *Mempool) SelectPackages(maxSize int) []*CoinTransaction {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	var selected []*CoinTransaction
+	included := make(map[string]bool)
+	// packages holds the current package of every transaction not selected yet
+	packages := make(map[string]packageCandidate, len(mp.entries))
+	queue := make(packageQueue, 0, len(mp.entries))
+	for txID, entry := range mp.entries {
+		candidate := packageCandidate{entry, entry.ancestorFee, entry.ancestorSize}
+		packages[txID] = candidate
+		queue = append(queue, candidate)
+	}
+	heap.Init(&queue)
+	size := 0
+
+	for queue.Len() > 0 {
+		best := heap.Pop(&queue).(packageCandidate)
+		txID := hex.EncodeToString(best.entry.Tx.ID)
+		// packages only shrink, a candidate of another size was queued again since
+		if included[txID] || packages[txID].size != best.size || size+best.size > maxSize {
+			continue
+		}
+
+		var pkg []*MempoolEntry
+		for _, ancestor := range mp.ancestors(best.entry.Tx) {
+			if !included[hex.EncodeToString(ancestor.Tx.ID)] {
+				pkg = append(pkg, ancestor)
+			}
+		}
+		sort.Slice(pkg, func(i, j int) bool {
+			return len(mp.ancestors(pkg[i].Tx)) < len(mp.ancestors(pkg[j].Tx))
+		})
+		pkg = append(pkg, best.entry)
+		for _, entry := range pkg {
+			included[hex.EncodeToString(entry.Tx.ID)] = true
+			selected = append(selected, entry.Tx)
+			for _, descendant := range mp.descendants(entry.Tx.ID) {
+				descendantID := hex.EncodeToString(descendant.Tx.ID)
+				if included[descendantID] {
+					continue
+				}
+				candidate := packages[descendantID]
+				candidate.fee -= entry.Fee
+				candidate.size -= entry.Size
+				packages[descendantID] = candidate
+				heap.Push(&queue, candidate)
+			}
+		}
+		size += best.size
+	}
+	return selected
+}
+
+// prevTransactions resolves the transactions referenced by the inputs of tx,
+// looking in the pool first and in the chain after that
+func (mp *Mempool) prevTransactions(tx *CoinTransaction) (map[string]CoinTransaction, error) {
+	prevTXs := make(map[string]CoinTransaction)
+	for _, in := range tx.Inputs {
+		if parent, ok := mp.get(in.ID); ok {
+			prevTXs[hex.EncodeToString(in.ID)] = *parent.Tx
+			continue
+		}
+		prevTX, err := mp.BlockChain.findPrevTransaction(in.ID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can not find a transaction with ID: %x", in.ID)
+		}
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
+	return prevTXs, nil
+}
+
+// SignTransaction signs a transaction that may spend outputs of pool transactions
+func (mp *Mempool) SignTransaction(tx *CoinTransaction, privKey ecdsa.PrivateKey) error {
+	mp.mu.RLock()
+	prevTXs, err := mp.prevTransactions(tx)
+	mp.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return tx.Sign(privKey, prevTXs)
+}
@@ -0,0 +1,279 @@
+package blockchain
+
+import (
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/wallet"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// splitTestCoins confirms n coins of value for w, split off its largest coin
+func splitTestCoins(t *testing.T, pool *Mempool, w *wallet.Wallet, address string, n, value int) []UnspentOutput {
+	coin := testCoin(t, pool.BlockChain, w)
+	values := []int{coin.Value - n*value - 10000}
+	for i := 0; i < n; i++ {
+		values = append(values, value)
+	}
+	tx := newTestTx(t, pool, w, []Outpoint{coin.Outpoint}, values...)
+	if err := pool.Add(tx); err != nil {
+		t.Fatal(err)
+	}
+	mineTestBlocks(t, pool, address, 1)
+	var coins []UnspentOutput
+	for i := 1; i <= n; i++ {
+		coins = append(coins, UnspentOutput{Outpoint: Outpoint{tx.ID, i}, CoinTxOutput: tx.Outputs[i]})
+	}
+	return coins
+}
+
+// newTestTxWithFee spends coin back to w in outputs parts, paying fee
+func newTestTxWithFee(t *testing.T, pool *Mempool, w *wallet.Wallet, coin UnspentOutput, outputs, fee int) *CoinTransaction {
+	value := coin.Value - fee
+	values := []int{value - (outputs-1)*(value/outputs)}
+	for i := 1; i < outputs; i++ {
+		values = append(values, value/outputs)
+	}
+	return newTestTx(t, pool, w, []Outpoint{coin.Outpoint}, values...)
+}
+
+// sizeWithFee is the size of the transaction newTestTxWithFee builds, give or
+// take the few bytes the encoding of other values takes
+func sizeWithFee(t *testing.T, pool *Mempool, w *wallet.Wallet, coin UnspentOutput, outputs int) int {
+	return newTestTxWithFee(t, pool, w, coin, outputs, 1000).Size()
+}
+
+func newTestMempool(t *testing.T) (*Mempool, *wallet.Wallet, string, func()) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, pool, wallets, address := newTestChain(t, dir)
+	return pool, wallets.Wallets[address], address, func() {
+		chain.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReplaceByFee(t *testing.T) {
+	pool, w, address, done := newTestMempool(t)
+	defer done()
+	coins := splitTestCoins(t, pool, w, address, 3, 1000000)
+
+	// the fee rate of the replacement must be higher than the one of the
+	// conflict, even when it pays more in total
+	size := sizeWithFee(t, pool, w, coins[0], 1)
+	original := newTestTxWithFee(t, pool, w, coins[0], 1, 100*size)
+	if err := pool.Add(original); err != nil {
+		t.Fatal(err)
+	}
+	largeSize := sizeWithFee(t, pool, w, coins[0], 10)
+	lowerRate := newTestTxWithFee(t, pool, w, coins[0], 10, 100*size+2*largeSize)
+	if err := pool.Add(lowerRate); errors.Cause(err) != ErrFeeTooLow {
+		t.Errorf("replacement with a lower fee rate: got %v, want fee too low", err)
+	}
+
+	// the replacement must pay the fees of everything it evicts and its own relay
+	size = sizeWithFee(t, pool, w, coins[1], 1)
+	original = newTestTxWithFee(t, pool, w, coins[1], 1, 2*size)
+	if err := pool.Add(original); err != nil {
+		t.Fatal(err)
+	}
+	lowerFee := newTestTxWithFee(t, pool, w, coins[1], 1, 5*size/2)
+	if err := pool.Add(lowerFee); errors.Cause(err) != ErrFeeTooLow {
+		t.Errorf("replacement not paying for its relay: got %v, want fee too low", err)
+	}
+
+	// a replacement evicts the conflict and its descendants
+	child := newTestTx(t, pool, w, []Outpoint{{original.ID, 0}}, original.Outputs[0].Value-2*size)
+	if err := pool.Add(child); err != nil {
+		t.Fatal(err)
+	}
+	grandchild := newTestTx(t, pool, w, []Outpoint{{child.ID, 0}}, child.Outputs[0].Value-2*size)
+	if err := pool.Add(grandchild); err != nil {
+		t.Fatal(err)
+	}
+	notEnough := newTestTxWithFee(t, pool, w, coins[1], 1, 5*size)
+	if err := pool.Add(notEnough); errors.Cause(err) != ErrFeeTooLow {
+		t.Errorf("replacement not paying for the evicted descendants: got %v, want fee too low", err)
+	}
+	replacement := newTestTxWithFee(t, pool, w, coins[1], 1, 8*size)
+	if err := pool.Add(replacement); err != nil {
+		t.Fatal(err)
+	}
+	// the replacement is persisted together with its evictions
+	if err := pool.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range []*CoinTransaction{original, child, grandchild} {
+		if _, ok := pool.Get(tx.ID); ok {
+			t.Errorf("%x is still in the pool after its replacement", tx.ID)
+		}
+	}
+	if _, ok := pool.Get(replacement.ID); !ok {
+		t.Error("the replacement is not in the pool")
+	}
+	if pool.IsSpent(Outpoint{child.ID, 0}) {
+		t.Error("the output spent by an evicted transaction is still marked as spent")
+	}
+
+	// a replacement can not spend an output of what it replaces
+	spendsConflict := newTestTx(t, pool, w, []Outpoint{coins[1].Outpoint, {replacement.ID, 0}}, coins[1].Value+replacement.Outputs[0].Value-100*size)
+	if err := pool.Add(spendsConflict); errors.Cause(err) != ErrInvalidTx {
+		t.Errorf("replacement spending its conflict: got %v, want an invalid transaction", err)
+	}
+}
+
+func TestMempoolRejectsWrongID(t *testing.T) {
+	pool, w, address, done := newTestMempool(t)
+	defer done()
+	coin := splitTestCoins(t, pool, w, address, 1, 1000000)[0]
+
+	// the ID of a transaction is its hash before signing, a block with one
+	// hashed after signing is invalid
+	tx := newTestTxWithFee(t, pool, w, coin, 1, 10000)
+	tx.ID = tx.Hash()
+	if err := pool.Add(tx); errors.Cause(err) != ErrInvalidTx {
+		t.Errorf("got %v, want an invalid transaction", err)
+	}
+}
+
+func TestReplacementEvictionLimit(t *testing.T) {
+	pool, w, address, done := newTestMempool(t)
+	defer done()
+	coin := splitTestCoins(t, pool, w, address, 1, 100000000)[0]
+
+	// a parent whose outputs are spent by one child each, the parent and its
+	// children are one more than a replacement may evict
+	children := MaxReplacementEvictions
+	parent := newTestTxWithFee(t, pool, w, coin, children, 100000)
+	if err := pool.Add(parent); err != nil {
+		t.Fatal(err)
+	}
+	for out := range parent.Outputs {
+		child := newTestTx(t, pool, w, []Outpoint{{parent.ID, out}}, parent.Outputs[out].Value-1000)
+		if err := pool.Add(child); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replacement := newTestTxWithFee(t, pool, w, coin, 1, 10000000)
+	if err := pool.Add(replacement); errors.Cause(err) != ErrInvalidTx {
+		t.Errorf("replacement evicting %d transactions: got %v, want an invalid transaction", children+1, err)
+	}
+	if pool.Count() != children+1 {
+		t.Errorf("%d transactions in the pool, want %d", pool.Count(), children+1)
+	}
+}
+
+func TestSelectPackages(t *testing.T) {
+	pool, w, address, done := newTestMempool(t)
+	defer done()
+	coins := splitTestCoins(t, pool, w, address, 2, 1000000)
+
+	// a parent paying little with a child paying a lot, and an unrelated
+	// transaction paying a fee rate between the two
+	size := sizeWithFee(t, pool, w, coins[0], 1)
+	parent := newTestTxWithFee(t, pool, w, coins[0], 1, size)
+	if err := pool.Add(parent); err != nil {
+		t.Fatal(err)
+	}
+	child := newTestTx(t, pool, w, []Outpoint{{parent.ID, 0}}, parent.Outputs[0].Value-50*size)
+	if err := pool.Add(child); err != nil {
+		t.Fatal(err)
+	}
+	unrelated := newTestTxWithFee(t, pool, w, coins[1], 1, 10*size)
+	if err := pool.Add(unrelated); err != nil {
+		t.Fatal(err)
+	}
+
+	parentEntry, _ := pool.Get(parent.ID)
+	childEntry, _ := pool.Get(child.ID)
+	fee, packageSize := pool.AncestorScore(child.ID)
+	if fee != parentEntry.Fee+childEntry.Fee || packageSize != parentEntry.Size+childEntry.Size {
+		t.Errorf("ancestor score of the child %d/%d, want %d/%d", fee, packageSize, parentEntry.Fee+childEntry.Fee, parentEntry.Size+childEntry.Size)
+	}
+
+	selected := pool.SelectPackages(pool.BlockChain.Params.MaxBlockSize)
+	if len(selected) != 3 || string(selected[0].ID) != string(parent.ID) || string(selected[1].ID) != string(child.ID) {
+		t.Fatalf("the package of the child does not come first")
+	}
+	// the package fits, the unrelated transaction does not fit next to it
+	selected = pool.SelectPackages(parentEntry.Size + childEntry.Size)
+	if len(selected) != 2 || string(selected[0].ID) != string(parent.ID) || string(selected[1].ID) != string(child.ID) {
+		t.Errorf("got %d transactions, want the parent and the child", len(selected))
+	}
+	// the child does not fit without its parent
+	selected = pool.SelectPackages(childEntry.Size + 1)
+	if len(selected) != 0 {
+		t.Errorf("got %d transactions, want none", len(selected))
+	}
+}
+
+func TestBumpFee(t *testing.T) {
+	pool, w, address, done := newTestMempool(t)
+	defer done()
+	coins := splitTestCoins(t, pool, w, address, 2, 1000000)
+
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	senders, err := wallet.OpenWallets(filepath.Join(dir, "sender"), params.Regtest.AddressVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	senders.Wallets[address] = w
+	receivers, err := wallet.OpenWallets(filepath.Join(dir, "receiver"), params.Regtest.AddressVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverAddress, err := receivers.AddWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := receivers.Wallets[receiverAddress]
+
+	// the sender replaces its own transaction
+	size := sizeWithFee(t, pool, w, coins[0], 1)
+	stuck := newTestTxWithFee(t, pool, w, coins[0], 1, size)
+	if err := pool.Add(stuck); err != nil {
+		t.Fatal(err)
+	}
+	bumped, err := BumpFee(pool, senders, stuck.ID, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pool.Get(stuck.ID); ok {
+		t.Error("the replaced transaction is still in the pool")
+	}
+	if entry, ok := pool.Get(bumped.ID); !ok || entry.Fee < 5*entry.Size {
+		t.Error("the replacement does not pay the fee rate")
+	}
+
+	// the receiver pays for the parent with a child, in a pool of its own
+	mineTestBlocks(t, pool, address, 1)
+	payment := newTestPayment(t, pool, w, []Outpoint{coins[1].Outpoint}, []CoinTxOutput{
+		{Value: coins[1].Value - size, PubKeyHash: wallet.PublicKeyHash(receiver.PublicKey)},
+	})
+	if err := pool.Add(payment); err != nil {
+		t.Fatal(err)
+	}
+	child, err := BumpFee(pool, receivers, payment.ID, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(child.Inputs) != 1 || string(child.Inputs[0].ID) != string(payment.ID) {
+		t.Fatal("the child does not spend the payment")
+	}
+	fee, packageSize := pool.AncestorScore(child.ID)
+	if fee < 5*packageSize {
+		t.Errorf("the package pays %d for %d bytes, less than 5 per byte", fee, packageSize)
+	}
+	selected := pool.SelectPackages(packageSize)
+	if len(selected) != 2 || string(selected[0].ID) != string(payment.ID) || string(selected[1].ID) != string(child.ID) {
+		t.Error("the payment is not selected with its child")
+	}
+}
@@ -27,7 +27,14 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	return &node
 }
 
+// NewMerkleTree hashes data pairwise up to a single root. The last node of
+// every level with an odd number of nodes, a single leaf included, is paired
+// with itself. The root of no data at all is the hash of nothing.
 func NewMerkleTree(data [][]byte) *MerkleTree {
+	if len(data) == 0 {
+		return &MerkleTree{NewMerkleNode(nil, nil, nil)}
+	}
+
 	var nodes []MerkleNode
 
 	if len(data)%2 != 0 {
@@ -39,7 +46,10 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 		nodes = append(nodes, *node)
 	}
 
-	for i := 0; i < len(data)/2; i++ {
+	for len(nodes) > 1 {
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes) - 1])
+		}
 		var level []MerkleNode
 		for j := 0; j < len(nodes); j += 2 {
 			node := NewMerkleNode(&nodes[j], &nodes[j + 1], nil)
@@ -0,0 +1,72 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMerkleTreeSizes(t *testing.T) {
+	var roots [][]byte
+	for n := 0; n <= 12; n++ {
+		var data [][]byte
+		for i := 0; i < n; i++ {
+			data = append(data, []byte(fmt.Sprintf("transaction %d", i)))
+		}
+		root := NewMerkleTree(data).RootNode.Data
+		if len(root) != 32 {
+			t.Fatalf("root of %d leaves has %d bytes", n, len(root))
+		}
+		for i, other := range roots {
+			if bytes.Equal(root, other) {
+				t.Errorf("%d and %d leaves have the same root", i, n)
+			}
+		}
+		roots = append(roots, root)
+	}
+}
+
+// TestMineTransactionCounts mines a block with every number of transactions
+// from 1 to 9, the merkle tree of each has levels of odd length
+func TestMineTransactionCounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chain, pool, wallets, address := newTestChain(t, dir)
+	defer chain.Close()
+	w := wallets.Wallets[address]
+	coin := testCoin(t, chain, w)
+	outpoint, value := coin.Outpoint, coin.Value
+
+	for n := 1; n <= 9; n++ {
+		for i := 1; i < n; i++ {
+			value -= 1000
+			tx := newTestTx(t, pool, w, []Outpoint{outpoint}, value)
+			if err := pool.Add(tx); err != nil {
+				t.Fatal(err)
+			}
+			outpoint = Outpoint{tx.ID, 0}
+		}
+		tmpl, err := NewBlockTemplate(pool, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := tmpl.Mine(pool)
+		if err != nil {
+			t.Fatalf("mining %d transactions: %v", n, err)
+		}
+		if len(block.Transactions) != n {
+			t.Fatalf("block has %d transactions, want %d", len(block.Transactions), n)
+		}
+		if err := CheckBlock(block, chain.Params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := chain.VerifyChain(VerifyUTXO, nil); err != nil {
+		t.Error(err)
+	}
+}
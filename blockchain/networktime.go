@@ -0,0 +1,82 @@
+package blockchain
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxTimeAdjustment limits how far peers can move the network time away from the local clock
+	MaxTimeAdjustment = 70 * time.Minute
+	// minTimeSamples is the number of peers that must report their clock before it is adjusted
+	minTimeSamples = 5
+	// maxTimeSamples bounds the offsets kept, the oldest peer is forgotten first
+	maxTimeSamples = 200
+)
+
+// NetworkTime is the local clock adjusted by the median offset of the clocks
+// of the peers, so a node with a wrong clock still judges block timestamps
+// like the rest of the network. It is safe for concurrent use.
+type NetworkTime struct {
+	mu      sync.Mutex
+	offsets map[string]time.Duration
+	// peers in the order their first sample arrived
+	peers  []string
+	offset time.Duration
+}
+
+// NewNetworkTime creates a clock following the local one until peers report theirs
+func NewNetworkTime() *NetworkTime {
+	return &NetworkTime{offsets: make(map[string]time.Duration)}
+}
+
+// AddSample records the time a peer reported, replacing its earlier sample
+// under the same key. The clock is adjusted once minTimeSamples peers
+// reported, by their median offset. A median beyond MaxTimeAdjustment is not
+// trusted and leaves the local clock.
+func (t *NetworkTime) AddSample(peer string, peerTime time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.offsets[peer]; !ok {
+		if len(t.peers) == maxTimeSamples {
+			delete(t.offsets, t.peers[0])
+			t.peers = t.peers[1:]
+		}
+		t.peers = append(t.peers, peer)
+	}
+	t.offsets[peer] = peerTime.Sub(time.Now()).Round(time.Second)
+
+	if len(t.offsets) < minTimeSamples {
+		return
+	}
+	offsets := make([]time.Duration, 0, len(t.offsets))
+	for _, offset := range t.offsets {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	median := offsets[len(offsets)/2]
+	if median > MaxTimeAdjustment || median < -MaxTimeAdjustment {
+		median = 0
+	}
+	t.offset = median
+}
+
+// Offset returns how far the network time is ahead of the local clock
+func (t *NetworkTime) Offset() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.offset
+}
+
+// Samples returns the number of peers whose clock is known
+func (t *NetworkTime) Samples() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.offsets)
+}
+
+// Now returns the adjusted network time
+func (t *NetworkTime) Now() time.Time {
+	return time.Now().Add(t.Offset())
+}
@@ -0,0 +1,61 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func addSamples(clock *NetworkTime, prefix string, n int, offset time.Duration) {
+	for i := 0; i < n; i++ {
+		clock.AddSample(fmt.Sprintf("%s %d", prefix, i), time.Now().Add(offset))
+	}
+}
+
+func TestNetworkTimeMedian(t *testing.T) {
+	clock := NewNetworkTime()
+	offsets := []time.Duration{10 * time.Second, 100 * time.Second, -5 * time.Second, 30 * time.Second}
+	for i, offset := range offsets {
+		clock.AddSample(fmt.Sprintf("peer %d", i), time.Now().Add(offset))
+	}
+	if clock.Offset() != 0 {
+		t.Errorf("offset %v with %d samples, want the local clock", clock.Offset(), len(offsets))
+	}
+
+	clock.AddSample("peer 4", time.Now().Add(20*time.Second))
+	if clock.Offset() != 20*time.Second {
+		t.Errorf("offset %v, want the median of 20s", clock.Offset())
+	}
+	if now := clock.Now(); now.Sub(time.Now()) < 19*time.Second || now.Sub(time.Now()) > 21*time.Second {
+		t.Errorf("network time %v is not 20s ahead of the local clock", now)
+	}
+
+	// a peer reporting again replaces its sample
+	clock.AddSample("peer 4", time.Now().Add(40*time.Second))
+	if clock.Samples() != 5 || clock.Offset() != 30*time.Second {
+		t.Errorf("%d samples with offset %v, want 5 with the median of 30s", clock.Samples(), clock.Offset())
+	}
+
+	// a median too far off is not trusted
+	addSamples(clock, "far", 6, 2*MaxTimeAdjustment)
+	if clock.Offset() != 0 {
+		t.Errorf("offset %v, want the local clock", clock.Offset())
+	}
+}
+
+func TestNetworkTimeSampleLimit(t *testing.T) {
+	clock := NewNetworkTime()
+	addSamples(clock, "old", maxTimeSamples/2, 10*time.Minute)
+	addSamples(clock, "new", maxTimeSamples, time.Minute)
+	if clock.Samples() != maxTimeSamples {
+		t.Errorf("%d samples, want %d", clock.Samples(), maxTimeSamples)
+	}
+	// the oldest peers were forgotten first
+	if clock.Offset() != time.Minute {
+		t.Errorf("offset %v, want the median of the newest peers", clock.Offset())
+	}
+	clock.AddSample("old 0", time.Now())
+	if clock.Samples() != maxTimeSamples {
+		t.Errorf("%d samples, want %d", clock.Samples(), maxTimeSamples)
+	}
+}
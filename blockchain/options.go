@@ -0,0 +1,93 @@
+package blockchain
+
+import (
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"path/filepath"
+	"time"
+)
+
+// DefaultDataDir is used when Options leave the data directory empty
+const DefaultDataDir = "./tmp"
+
+// Options configure where a chain keeps its data. Chains opened with
+// different data directories are independent, so a process can hold several.
+type Options struct {
+	DataDir string
+	// Store replaces the badger database of DataDir, e.g. with storage.NewMemory()
+	Store storage.Store
+	// Params of the network, mainnet when nil
+	Params *params.ChainParams
+	// UTXOCacheSize is the number of transactions the UTXO cache holds,
+	// DefaultUTXOCacheSize when zero, a negative size disables the cache
+	UTXOCacheSize int
+	// UTXOFlushInterval bounds how long changes stay in the UTXO cache only,
+	// DefaultUTXOFlushInterval when zero
+	UTXOFlushInterval time.Duration
+	// BlockCacheSize is the number of bytes of serialized blocks the cache of
+	// decoded blocks holds, DefaultBlockCacheSize when zero, a negative size disables the cache
+	BlockCacheSize int
+	// PruneDepth, when positive, is the number of recent blocks kept whole, the
+	// older ones are reduced to their headers. It must be at least MinPruneDepth.
+	PruneDepth int
+	// Maintenance schedules the value log garbage collection of the badger database
+	Maintenance storage.MaintenanceOptions
+}
+
+// validate refuses options a chain can not be opened with
+func (opts Options) validate() error {
+	if opts.PruneDepth > 0 && opts.PruneDepth < MinPruneDepth {
+		return errors.Errorf("prune depth %d is below the minimum of %d blocks", opts.PruneDepth, MinPruneDepth)
+	}
+	return opts.Maintenance.Validate()
+}
+
+func (opts Options) params() *params.ChainParams {
+	if opts.Params == nil {
+		return &params.Mainnet
+	}
+	return opts.Params
+}
+
+// utxoCache creates the UTXO cache of a chain opened with opts, nil when it is disabled
+func (opts Options) utxoCache(chain *BlockChain) *UTXOCache {
+	size, interval := opts.UTXOCacheSize, opts.UTXOFlushInterval
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = DefaultUTXOCacheSize
+	}
+	if interval == 0 {
+		interval = DefaultUTXOFlushInterval
+	}
+	return NewUTXOCache(chain, size, interval)
+}
+
+// blockCache creates the block cache of a chain opened with opts, nil when it is disabled
+func (opts Options) blockCache() *BlockCache {
+	size := opts.BlockCacheSize
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = DefaultBlockCacheSize
+	}
+	return NewBlockCache(size)
+}
+
+func (opts Options) dataDir() string {
+	if opts.DataDir == "" {
+		return DefaultDataDir
+	}
+	return opts.DataDir
+}
+
+func (opts Options) dbPath() string {
+	return filepath.Join(opts.dataDir(), "blocks")
+}
+
+func (opts Options) dbFile() string {
+	return filepath.Join(opts.dbPath(), "MANIFEST")
+}
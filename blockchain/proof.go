@@ -5,25 +5,23 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"log"
 	"math"
 	"math/big"
 )
 
-
 // TODO: difficulty must be set dynamic based on time to mine a block
-const Difficulty = 18
-
 type ProofOfWork struct {
-	Block  *Block
-	Target *big.Int
+	Block      *Block
+	Target     *big.Int
+	Difficulty int
 }
 
-func NewProof(b *Block) *ProofOfWork {
+// NewProof prepares the proof of work of a block whose hash needs difficulty leading zero bits
+func NewProof(b *Block, difficulty int) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
+	target.Lsh(target, uint(256-difficulty))
 
-	pow := &ProofOfWork{b, target}
+	pow := &ProofOfWork{b, target, difficulty}
 
 	return pow
 }
@@ -33,8 +31,10 @@ func (pow *ProofOfWork) InitData(nonce int) []byte {
 		[][]byte{
 			pow.Block.PrevHash,
 			pow.Block.HashTransaction(),
+			ToHex(pow.Block.Timestamp),
 			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
+			ToHex(int64(pow.Difficulty)),
+			pow.Block.UTXOCommitment,
 		},
 		[]byte{},
 	)
@@ -67,6 +67,12 @@ func (pow *ProofOfWork) Run() (int, []byte) {
 	return nonce, hash[:]
 }
 
+// Hash computes the hash of the block from its contents and nonce
+func (pow *ProofOfWork) Hash() []byte {
+	hash := sha256.Sum256(pow.InitData(pow.Block.Nonce))
+	return hash[:]
+}
+
 func (pow *ProofOfWork) Validate() bool {
 	var intHash big.Int
 
@@ -78,12 +84,21 @@ func (pow *ProofOfWork) Validate() bool {
 	return intHash.Cmp(pow.Target) == -1
 }
 
-func ToHex(num int64) []byte {
-	buff := new(bytes.Buffer)
-	err := binary.Write(buff, binary.BigEndian, num)
-	if err != nil {
-		log.Panic(err)
+// MeetsTarget reports whether the hash the block carries is below the target,
+// all that can be checked of a block known by its header only
+func (pow *ProofOfWork) MeetsTarget() bool {
+	var intHash big.Int
+	intHash.SetBytes(pow.Block.Hash)
+	return len(pow.Block.Hash) == sha256.Size && intHash.Cmp(pow.Target) == -1
+}
 
-	}
-	return buff.Bytes()
+// blockWork is the expected number of hashes to find a block at difficulty
+func blockWork(difficulty int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(difficulty))
+}
+
+func ToHex(num int64) []byte {
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint64(buff, uint64(num))
+	return buff
 }
\ No newline at end of file
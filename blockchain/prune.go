@@ -0,0 +1,126 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MinPruneDepth is the smallest number of recent blocks a pruned chain keeps
+	// whole. Reorganizations deeper than the depth are refused.
+	MinPruneDepth = 100
+	// pruneHeightKey stores the lowest height of the best chain whose block still has its transactions
+	pruneHeightKey = "pruneheight"
+	// pruneBatchBlocks bounds the blocks stripped in one database transaction
+	pruneBatchBlocks = 1000
+)
+
+// pruneHeight reads the lowest height with a complete block inside a transaction, zero when nothing was pruned
+func pruneHeight(txn storage.Txn) (int, error) {
+	data, err := txn.Get([]byte(pruneHeightKey))
+	if err == storage.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting the prune height")
+	}
+	return decodeHeight(data)
+}
+
+func encodeHeight(height int) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(height))
+	return data
+}
+
+func decodeHeight(data []byte) (int, error) {
+	if len(data) != 8 {
+		return 0, errors.Wrap(ErrCorruptData, "height is not 8 bytes long")
+	}
+	return int(binary.BigEndian.Uint64(data)), nil
+}
+
+// PruneHeight is the lowest height of the best chain whose block still has its
+// transactions, blocks below it are only kept as headers. It is zero unless the chain was pruned.
+func (chain *BlockChain) PruneHeight() (int, error) {
+	var height int
+	err := chain.Database.View(func(txn storage.Txn) error {
+		var err error
+		height, err = pruneHeight(txn)
+		return err
+	})
+	return height, err
+}
+
+// prune replaces the blocks more than Options.PruneDepth below the tip with their
+// headers and drops their undo data. Only blocks whose changes reached the UTXO
+// set on disk are pruned, the ones still in the UTXO cache may have to be replayed.
+func (chain *BlockChain) prune() error {
+	depth := chain.opts.PruneDepth
+	if depth <= 0 {
+		return nil
+	}
+	for {
+		done := true
+		var pruned [][]byte
+		err := chain.Database.Update(func(txn storage.Txn) error {
+			from, err := pruneHeight(txn)
+			if err != nil {
+				return err
+			}
+			last, err := lastBlock(txn)
+			if err != nil {
+				return err
+			}
+			to := last.Height - depth
+			utxoTip, err := txn.Get([]byte(utxoTipKey))
+			if err == storage.ErrKeyNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			data, err := txn.Get(utxoTip)
+			if err != nil {
+				return errors.Wrapf(err, "error getting the UTXO tip %x", utxoTip)
+			}
+			utxoTipBlock, err := Deserialize(data)
+			if err != nil {
+				return err
+			}
+			if utxoTipBlock.Height < to {
+				to = utxoTipBlock.Height
+			}
+			if to >= from+pruneBatchBlocks {
+				to = from + pruneBatchBlocks - 1
+				done = false
+			}
+			if to < from {
+				return nil
+			}
+
+			for height := from; height <= to; height++ {
+				block, err := blockAtHeight(txn, height)
+				if err != nil {
+					return err
+				}
+				if err := txn.Set(block.Hash, block.Header().Serialize()); err != nil {
+					return errors.Wrapf(err, "error pruning block %x", block.Hash)
+				}
+				pruned = append(pruned, block.Hash)
+				if err := txn.Delete(undoKey(block.Hash)); err != nil {
+					return errors.Wrapf(err, "error deleting the undo data of block %x", block.Hash)
+				}
+			}
+			return txn.Set([]byte(pruneHeightKey), encodeHeight(to+1))
+		})
+		if err != nil {
+			return errors.Wrap(err, "error pruning the chain")
+		}
+		chain.blockCache.invalidate(pruned...)
+		if done {
+			return nil
+		}
+	}
+}
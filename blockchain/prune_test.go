@@ -0,0 +1,83 @@
+package blockchain
+
+import (
+	"bytes"
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{Store: storage.NewMemory(), Params: &params.Regtest, PruneDepth: MinPruneDepth, UTXOCacheSize: -1}
+	chain, pool, wallets, address := newTestChainWith(t, dir, opts)
+	defer chain.Close()
+	w := wallets.Wallets[address]
+	genesisCoin := testCoin(t, chain, w)
+
+	// the tip and the blocks below it up to the depth are kept whole
+	blocks := mineTestBlocks(t, pool, address, MinPruneDepth-1)
+	if height, err := chain.PruneHeight(); err != nil || height != 0 {
+		t.Errorf("prune height %d, %v at height %d, want nothing pruned", height, err, MinPruneDepth-1)
+	}
+	blocks = append(blocks, mineTestBlocks(t, pool, address, 11)...)
+	if height, err := chain.PruneHeight(); err != nil || height != 11 {
+		t.Fatalf("prune height %d, %v, want 11", height, err)
+	}
+
+	for _, block := range blocks {
+		_, err := chain.BlockByHash(block.Hash)
+		if block.Height < 11 && errors.Cause(err) != ErrPruned {
+			t.Errorf("block at height %d: got %v, want pruned", block.Height, err)
+		}
+		if block.Height >= 11 && err != nil {
+			t.Errorf("block at height %d: %v", block.Height, err)
+		}
+		err = chain.Database.View(func(txn storage.Txn) error {
+			_, err := txn.Get(undoKey(block.Hash))
+			return err
+		})
+		if block.Height < 11 && err != storage.ErrKeyNotFound {
+			t.Errorf("undo data at height %d: got %v, want it deleted", block.Height, err)
+		}
+		if block.Height >= 11 && err != nil {
+			t.Errorf("undo data at height %d: %v", block.Height, err)
+		}
+	}
+
+	// the headers still link up and the UTXO set is whole
+	if err := chain.VerifyChain(VerifyBlocks, nil); err != nil {
+		t.Error(err)
+	}
+	if err := chain.VerifyChain(VerifyTransactions, nil); errors.Cause(err) != ErrPruned {
+		t.Errorf("replay of a pruned chain: got %v, want pruned", err)
+	}
+	if _, err := chain.ExportBlocks(ioutil.Discard); errors.Cause(err) != ErrPruned {
+		t.Errorf("export of a pruned chain: got %v, want pruned", err)
+	}
+	spend := newTestTx(t, pool, w, []Outpoint{genesisCoin.Outpoint}, genesisCoin.Value-1000)
+	if err := pool.Add(spend); err != nil {
+		t.Fatal(err)
+	}
+	tip := mineTestBlocks(t, pool, address, 1)[0]
+	if len(tip.Transactions) != 2 || bytes.Compare(tip.Transactions[1].ID, spend.ID) != 0 {
+		t.Errorf("the spend of the genesis coin was not mined")
+	}
+	if height, err := chain.PruneHeight(); err != nil || height != 12 {
+		t.Errorf("prune height %d, %v, want 12", height, err)
+	}
+}
+
+func TestPruneDepth(t *testing.T) {
+	opts := Options{Store: storage.NewMemory(), Params: &params.Regtest, PruneDepth: MinPruneDepth - 1}
+	if _, err := Init(opts, ""); err == nil {
+		t.Errorf("a chain was created with a prune depth of %d", opts.PruneDepth)
+	}
+}
@@ -0,0 +1,134 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	// reindexKey records the height and hash of the last block a running
+	// reindex has applied, so an interrupted reindex resumes after it
+	reindexKey = "reindex"
+	// reindexBatchWrites bounds the UTXO writes committed at once during a reindex
+	reindexBatchWrites = 10000
+)
+
+// reindexProgress is the next height to apply and the hash of the block below it
+type reindexProgress struct {
+	height   int
+	lastHash []byte
+}
+
+func (p reindexProgress) serialize() []byte {
+	data := make([]byte, 8, 8+len(p.lastHash))
+	binary.BigEndian.PutUint64(data, uint64(p.height))
+	return append(data, p.lastHash...)
+}
+
+func deserializeReindexProgress(data []byte) (reindexProgress, error) {
+	if len(data) < 8 {
+		return reindexProgress{}, errors.Wrap(ErrCorruptData, "reindex progress is too short")
+	}
+	return reindexProgress{int(binary.BigEndian.Uint64(data[:8])), data[8:]}, nil
+}
+
+// Reindex rebuilds the UTXO set by replaying the best chain from the genesis up.
+// Blocks are read one at a time and their changes written in batches, so memory
+// stays flat however long the chain is. The progress is saved with every batch
+// and an interrupted reindex continues where it stopped, unless the chain it
+// was replaying has been reorganized below that point. The blocks of a pruned
+// chain are gone, its UTXO set can not be rebuilt and Reindex fails with ErrPruned.
+func (u UTXOSet) Reindex() error {
+	pruned, err := u.BlockChain.PruneHeight()
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		return errors.Wrapf(ErrPruned, "can not reindex, blocks below height %d are pruned", pruned)
+	}
+	if cache := u.BlockChain.utxoCache; cache != nil {
+		cache.Reset()
+	}
+	progress, err := u.reindexStart()
+	if err != nil {
+		return err
+	}
+	bestHeight, err := u.BlockChain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	for progress.height <= bestHeight {
+		err := u.BlockChain.Database.Update(func(txn storage.Txn) error {
+			writes := 0
+			for progress.height <= bestHeight && writes < reindexBatchWrites {
+				block, err := blockAtHeight(txn, progress.height)
+				if err != nil {
+					return err
+				}
+				n, err := applyBlock(txn, block)
+				if err != nil {
+					return errors.Wrapf(err, "error applying block %x at height %d", block.Hash, block.Height)
+				}
+				writes += n
+				progress = reindexProgress{block.Height + 1, block.Hash}
+			}
+			return txn.Set([]byte(reindexKey), progress.serialize())
+		})
+		if err != nil {
+			return errors.Wrap(err, "error reindexing unspent transaction outputs (UTXO)")
+		}
+		if u.Progress != nil {
+			u.Progress(progress.height-1, bestHeight)
+		}
+	}
+
+	err = u.BlockChain.Database.Update(func(txn storage.Txn) error {
+		return txn.Delete([]byte(reindexKey))
+	})
+	return errors.Wrap(err, "error finishing the reindex")
+}
+
+// reindexStart returns where the reindex begins, clearing the UTXO set unless
+// an interrupted reindex of the same chain can be resumed
+func (u UTXOSet) reindexStart() (reindexProgress, error) {
+	var saved []byte
+	err := u.BlockChain.Database.View(func(txn storage.Txn) error {
+		var err error
+		saved, err = txn.Get([]byte(reindexKey))
+		if err == storage.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return reindexProgress{}, errors.Wrap(err, "error reading the reindex progress")
+	}
+	if saved != nil {
+		progress, err := deserializeReindexProgress(saved)
+		if err != nil {
+			return reindexProgress{}, err
+		}
+		block, err := u.BlockChain.BlockByHeight(progress.height - 1)
+		if err == nil && bytes.Compare(block.Hash, progress.lastHash) == 0 {
+			return progress, nil
+		}
+		if err != nil && errors.Cause(err) != ErrBlockNotFound {
+			return reindexProgress{}, err
+		}
+	}
+
+	if err := u.DeleteByPrefix(utxoPrefix); err != nil {
+		return reindexProgress{}, err
+	}
+	progress := reindexProgress{}
+	err = u.BlockChain.Database.Update(func(txn storage.Txn) error {
+		if err := txn.Set([]byte(utxoHashKey), NewMuHash().Serialize()); err != nil {
+			return err
+		}
+		return txn.Set([]byte(reindexKey), progress.serialize())
+	})
+	return progress, errors.Wrap(err, "error starting the reindex")
+}
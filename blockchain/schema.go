@@ -0,0 +1,180 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+)
+
+// schemaVersionKey stores the version of the format of the database
+const schemaVersionKey = "schema"
+
+// SchemaVersion is the format of the databases written by this version of the
+// package. A database without a version predates versioning and is version 0.
+// Raise it with a migration whenever the way keys or values are stored changes.
+//
+// The migrations upgrade how a chain is stored, not its blocks. A database
+// from before versioning whose blocks were mined without the timestamp in
+// their proof of work or without UTXO commitments is refused with
+// ErrLegacyBlocks, see checkBlockFormat, such blocks can only be mined again.
+const SchemaVersion = 3
+
+// migration upgrades a database from the version before it to version. It
+// must be safe to run again, a migration interrupted before the version was
+// recorded is simply repeated on the next open.
+type migration struct {
+	version     int
+	description string
+	migrate     func(db storage.Store) error
+}
+
+// migrations in the order they are applied, one per schema version
+var migrations = []migration{
+	{1, "record the genesis hash", migrateGenesisKey},
+	{2, "index the best chain by height", ensureHeightIndex},
+	{3, "record the hash of the UTXO set", ensureUTXOHash},
+}
+
+func encodeSchemaVersion(version int) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(version))
+	return data
+}
+
+// schemaVersion reads the version of the database inside a transaction
+func schemaVersion(txn storage.Txn) (int, error) {
+	data, err := txn.Get([]byte(schemaVersionKey))
+	if err == storage.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting the schema version")
+	}
+	if len(data) != 4 {
+		return 0, errors.Wrap(ErrCorruptData, "schema version is not 4 bytes long")
+	}
+	return int(binary.BigEndian.Uint32(data)), nil
+}
+
+// SchemaVersion returns the version of the format of the database of the chain
+func (chain *BlockChain) SchemaVersion() (int, error) {
+	var version int
+	err := chain.Database.View(func(txn storage.Txn) error {
+		var err error
+		version, err = schemaVersion(txn)
+		return err
+	})
+	return version, err
+}
+
+// migrate upgrades a database step by step to SchemaVersion, recording the
+// version after every migration. A database written by a newer version of the
+// package is refused with ErrNewerSchema, one with blocks of an older format
+// with ErrLegacyBlocks, before anything is changed.
+func migrate(db storage.Store, p *params.ChainParams) error {
+	var version int
+	err := db.View(func(txn storage.Txn) error {
+		var err error
+		version, err = schemaVersion(txn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return errors.Wrapf(ErrNewerSchema, "the database has schema version %d, this version supports up to %d", version, SchemaVersion)
+	}
+	if version == 0 {
+		if err := checkBlockFormat(db, p); err != nil {
+			return err
+		}
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		if err := m.migrate(db); err != nil {
+			return errors.Wrapf(err, "error migrating the database to schema version %d, %s", m.version, m.description)
+		}
+		err := db.Update(func(txn storage.Txn) error {
+			return txn.Set([]byte(schemaVersionKey), encodeSchemaVersion(m.version))
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error recording schema version %d", m.version)
+		}
+	}
+	return nil
+}
+
+// migrateGenesisKey records the genesis hash of chains created before it was kept
+func migrateGenesisKey(db storage.Store) error {
+	var lastHash []byte
+	err := db.View(func(txn storage.Txn) error {
+		var err error
+		lastHash, err = txn.Get([]byte(lastHashKey))
+		return errors.Wrap(err, "error getting last hash")
+	})
+	if err != nil {
+		return err
+	}
+	_, err = loadGenesisHash(db, lastHash)
+	return err
+}
+
+// checkBlockFormat refuses a database from before versioning with blocks
+// CheckBlock rejects for their format: the proof of work of blocks mined
+// before it covered the timestamp does not match their hash, and blocks mined
+// before UTXO commitments lack one from ChainParams.UTXOCommitmentHeight on.
+// A chain is mined with one format from its genesis on, so the genesis and the
+// first block required to commit tell them apart. The genesis of a pruned
+// chain is only a header, pruning came after the timestamp was covered.
+func checkBlockFormat(db storage.Store, p *params.ChainParams) error {
+	var hashes [][]byte
+	var genesis *Block
+	err := db.View(func(txn storage.Txn) error {
+		hash, err := txn.Get([]byte(lastHashKey))
+		if err != nil {
+			return errors.Wrap(err, "error getting the last hash")
+		}
+		for {
+			data, err := txn.Get(hash)
+			if err != nil {
+				return errors.Wrapf(err, "error getting block %x", hash)
+			}
+			block, err := Deserialize(data)
+			if err != nil {
+				return err
+			}
+			hashes = append(hashes, hash)
+			if len(block.PrevHash) == 0 {
+				genesis = block
+				return nil
+			}
+			hash = block.PrevHash
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "error walking the best chain")
+	}
+
+	if !genesis.Pruned() && bytes.Compare(NewProof(genesis, p.Difficulty).Hash(), genesis.Hash) != 0 {
+		return errors.Wrapf(ErrLegacyBlocks, "the proof of work of genesis %x does not cover its timestamp, create a new chain", genesis.Hash)
+	}
+	height := p.UTXOCommitmentHeight
+	if height <= 0 || height >= len(hashes) {
+		return nil
+	}
+	hash := hashes[len(hashes)-1-height]
+	return db.View(func(txn storage.Txn) error {
+		header, err := readHeader(txn, hash)
+		if err != nil {
+			return err
+		}
+		if len(header.UTXOCommitment) == 0 {
+			return errors.Wrapf(ErrLegacyBlocks, "block %x at height %d does not commit to the UTXO set, create a new chain", hash, height)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,90 @@
+package blockchain
+
+import (
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// unversion removes the schema version, as in a database from before versioning
+func unversion(t *testing.T, chain *BlockChain) {
+	err := chain.Database.Update(func(txn storage.Txn) error {
+		return txn.Delete([]byte(schemaVersionKey))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rewrite stores block under its hash as it is
+func rewrite(t *testing.T, chain *BlockChain, block *Block) {
+	err := chain.Database.Update(func(txn storage.Txn) error {
+		return txn.Set(block.Hash, block.Serialize())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chain, pool, _, address := newTestChain(t, dir)
+	defer chain.Close()
+	mineTestBlocks(t, pool, address, 3)
+
+	unversion(t, chain)
+	if err := migrate(chain.Database, chain.Params); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := chain.SchemaVersion(); err != nil || version != SchemaVersion {
+		t.Fatalf("schema version %d, %v, want %d", version, err, SchemaVersion)
+	}
+	if err := chain.VerifyChain(VerifyUTXO, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestMigrateLegacyBlocks refuses databases from before versioning whose
+// blocks were mined without the timestamp in their proof of work or without
+// UTXO commitments, leaving them as they are
+func TestMigrateLegacyBlocks(t *testing.T) {
+	tests := []struct {
+		name   string
+		legacy func(genesis, first *Block)
+	}{
+		{"proof of work without the timestamp", func(genesis, first *Block) { genesis.Timestamp++ }},
+		{"no UTXO commitment", func(genesis, first *Block) { first.UTXOCommitment = nil }},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "sentinel-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		chain, pool, _, address := newTestChain(t, dir)
+		defer chain.Close()
+		first := mineTestBlocks(t, pool, address, 2)[0]
+		genesis, err := chain.BlockByHash(chain.GenesisHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		genesisCopy, firstCopy := *genesis, *first
+		test.legacy(&genesisCopy, &firstCopy)
+		rewrite(t, chain, &genesisCopy)
+		rewrite(t, chain, &firstCopy)
+
+		unversion(t, chain)
+		if err := migrate(chain.Database, chain.Params); errors.Cause(err) != ErrLegacyBlocks {
+			t.Errorf("%s: got %v, want legacy blocks", test.name, err)
+		}
+		if version, err := chain.SchemaVersion(); err != nil || version != 0 {
+			t.Errorf("%s: schema version %d, %v, want the database unchanged", test.name, version, err)
+		}
+	}
+}
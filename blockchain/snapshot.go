@@ -0,0 +1,449 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"hash"
+	"io"
+	"os"
+)
+
+const (
+	// backfillKey stores the lowest height whose block a chain loaded from
+	// a snapshot still misses. It is deleted once the history is complete.
+	backfillKey = "backfill"
+	// snapshotBatchWrites bounds the keys written at once while loading a snapshot
+	snapshotBatchWrites = 10000
+)
+
+// snapshotHeader starts a UTXO set snapshot. It is followed by the headers of
+// the best chain from the genesis to the base block, one snapshotEntry for every
+// transaction with unspent outputs and a snapshotTrailer.
+type snapshotHeader struct {
+	Network    string
+	BaseHeight int
+	BaseHash   []byte
+	Entries    int
+}
+
+type snapshotEntry struct {
+	ID      []byte
+	Outputs CoinTxOutputs
+}
+
+type snapshotTrailer struct {
+	Hash []byte
+}
+
+// SnapshotInfo describes a UTXO set snapshot, Hash is its content hash
+type SnapshotInfo struct {
+	Height       int
+	BlockHash    []byte
+	Hash         []byte
+	Transactions int
+}
+
+// snapshotHasher computes the content hash of a snapshot over its base, its
+// headers and its entries, in the order they are written. It hashes the fields
+// in a fixed layout, gob output depends on the types a process encoded before.
+type snapshotHasher struct {
+	hash.Hash
+}
+
+func newSnapshotHasher(baseHash []byte) snapshotHasher {
+	h := snapshotHasher{sha256.New()}
+	h.writeBytes(baseHash)
+	return h
+}
+
+func (h snapshotHasher) writeInt(n int64) {
+	binary.Write(h, binary.BigEndian, n)
+}
+
+func (h snapshotHasher) writeBytes(data []byte) {
+	h.writeInt(int64(len(data)))
+	h.Write(data)
+}
+
+func (h snapshotHasher) addHeader(header *Block) {
+	h.writeInt(int64(header.Height))
+	h.writeBytes(header.Hash)
+	h.writeBytes(header.PrevHash)
+	h.writeInt(header.Timestamp)
+	h.writeInt(int64(header.Nonce))
+}
+
+func (h snapshotHasher) addEntry(entry snapshotEntry) {
+	h.writeBytes(entry.ID)
+	h.writeInt(int64(entry.Outputs.Height))
+	h.writeInt(int64(len(entry.Outputs.Outputs)))
+	for i, out := range entry.Outputs.Outputs {
+		h.writeInt(int64(entry.Outputs.Index(i)))
+		h.writeInt(int64(out.Value))
+		h.writeBytes(out.PubKeyHash)
+	}
+}
+
+// readHeader reads the block with the given hash inside a transaction, pruned or not
+func readHeader(txn storage.Txn, hash []byte) (*Block, error) {
+	data, err := txn.Get(hash)
+	if err == storage.ErrKeyNotFound {
+		return nil, errors.Wrapf(ErrBlockNotFound, "%x", hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := Deserialize(data)
+	if err != nil {
+		return nil, err
+	}
+	return block.Header(), nil
+}
+
+// DumpUTXO writes a snapshot of the UTXO set at the block it was last updated
+// with to w. Its content hash covers the headers of the best chain up to that
+// block and every unspent output. A new chain is only loaded from a snapshot
+// whose hash is pinned in the chain parameters, see LoadUTXO.
+func (chain *BlockChain) DumpUTXO(w io.Writer) (*SnapshotInfo, error) {
+	if err := (UTXOSet{BlockChain: chain}).flushCache(); err != nil {
+		return nil, err
+	}
+	info := &SnapshotInfo{}
+	enc := gob.NewEncoder(w)
+	err := chain.Database.View(func(txn storage.Txn) error {
+		baseHash, err := txn.Get([]byte(utxoTipKey))
+		if err == storage.ErrKeyNotFound {
+			return errors.New("the UTXO set does not record its tip, reindex it first")
+		}
+		if err != nil {
+			return err
+		}
+		base, err := readHeader(txn, baseHash)
+		if err != nil {
+			return err
+		}
+		indexed, err := txn.Get(heightKey(base.Height))
+		if err != nil || bytes.Compare(indexed, baseHash) != 0 {
+			return errors.Errorf("the UTXO set is at block %x, which is not on the best chain", baseHash)
+		}
+
+		it := txn.NewIterator(storage.IteratorOptions{Prefix: utxoPrefix, KeysOnly: true})
+		for ; it.Valid(); it.Next() {
+			info.Transactions++
+		}
+		it.Close()
+
+		info.Height, info.BlockHash = base.Height, baseHash
+		header := snapshotHeader{chain.Params.Name, base.Height, baseHash, info.Transactions}
+		if err := enc.Encode(header); err != nil {
+			return errors.Wrap(err, "error writing the snapshot header")
+		}
+		hasher := newSnapshotHasher(baseHash)
+		for height := 0; height <= base.Height; height++ {
+			hash, err := txn.Get(heightKey(height))
+			if err != nil {
+				return errors.Wrapf(err, "error getting the block at height %d", height)
+			}
+			header, err := readHeader(txn, hash)
+			if err != nil {
+				return err
+			}
+			hasher.addHeader(header)
+			if err := enc.Encode(header); err != nil {
+				return errors.Wrapf(err, "error writing the header at height %d", height)
+			}
+		}
+
+		it = txn.NewIterator(storage.IteratorOptions{Prefix: utxoPrefix})
+		defer it.Close()
+		for ; it.Valid(); it.Next() {
+			v, err := it.Value()
+			if err != nil {
+				return err
+			}
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+			entry := snapshotEntry{it.Key()[prefixLength:], outs}
+			hasher.addEntry(entry)
+			if err := enc.Encode(entry); err != nil {
+				return errors.Wrapf(err, "error writing the outputs of %x", entry.ID)
+			}
+		}
+		info.Hash = hasher.Sum(nil)
+		return errors.Wrap(enc.Encode(snapshotTrailer{info.Hash}), "error writing the snapshot trailer")
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error dumping the UTXO set")
+	}
+	return info, nil
+}
+
+// readSnapshot decodes the snapshot in file, passing every header and entry to
+// the callbacks, and fails with ErrCorruptData unless the content hash matches the trailer
+func readSnapshot(file string, onHeader func(*Block) error, onEntry func(snapshotEntry) error) (snapshotHeader, []byte, error) {
+	var header snapshotHeader
+	f, err := os.Open(file)
+	if err != nil {
+		return header, nil, errors.Wrap(err, "error opening the snapshot")
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(f)
+	if err := dec.Decode(&header); err != nil {
+		return header, nil, errors.Wrapf(ErrCorruptData, "error reading the snapshot header: %v", err)
+	}
+	hasher := newSnapshotHasher(header.BaseHash)
+	for height := 0; height <= header.BaseHeight; height++ {
+		var block Block
+		if err := dec.Decode(&block); err != nil {
+			return header, nil, errors.Wrapf(ErrCorruptData, "error reading the header at height %d: %v", height, err)
+		}
+		hasher.addHeader(&block)
+		if err := onHeader(&block); err != nil {
+			return header, nil, err
+		}
+	}
+	for i := 0; i < header.Entries; i++ {
+		var entry snapshotEntry
+		if err := dec.Decode(&entry); err != nil {
+			return header, nil, errors.Wrapf(ErrCorruptData, "error reading the outputs: %v", err)
+		}
+		hasher.addEntry(entry)
+		if err := onEntry(entry); err != nil {
+			return header, nil, err
+		}
+	}
+	var trailer snapshotTrailer
+	if err := dec.Decode(&trailer); err != nil {
+		return header, nil, errors.Wrapf(ErrCorruptData, "error reading the snapshot trailer: %v", err)
+	}
+	sum := hasher.Sum(nil)
+	if bytes.Compare(sum, trailer.Hash) != 0 {
+		return header, nil, errors.Wrapf(ErrCorruptData, "snapshot hash %x does not match its content", trailer.Hash)
+	}
+	return header, sum, nil
+}
+
+// verifySnapshot reads the snapshot in file once, checking its headers link up
+// from the genesis of p to its base and that its hash is pinned in p
+func verifySnapshot(p *params.ChainParams, file string) (*SnapshotInfo, error) {
+	var prev *Block
+	header, sum, err := readSnapshot(file, func(block *Block) error {
+		switch {
+		case prev == nil:
+			if err := checkGenesis(p, block.Hash); err != nil {
+				return err
+			}
+		case bytes.Compare(block.PrevHash, prev.Hash) != 0:
+			return errors.Wrapf(ErrCorruptData, "header %x does not follow %x", block.Hash, prev.Hash)
+		}
+		if prev != nil && block.Height != prev.Height+1 || prev == nil && block.Height != 0 {
+			return errors.Wrapf(ErrCorruptData, "header %x has height %d", block.Hash, block.Height)
+		}
+		prev = block
+		return nil
+	}, func(snapshotEntry) error {
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if header.Network != p.Name {
+		return nil, errors.Wrapf(ErrUnknownSnapshot, "the snapshot is of %s, not %s", header.Network, p.Name)
+	}
+	if prev == nil || bytes.Compare(prev.Hash, header.BaseHash) != 0 {
+		return nil, errors.Wrap(ErrCorruptData, "the headers of the snapshot do not end at its base")
+	}
+	for _, pinned := range p.Snapshots {
+		if pinned.Height == header.BaseHeight && pinned.BlockHash == hex.EncodeToString(header.BaseHash) {
+			if pinned.Hash != hex.EncodeToString(sum) {
+				return nil, errors.Wrapf(ErrUnknownSnapshot, "hash %x differs from the pinned %s", sum, pinned.Hash)
+			}
+			return &SnapshotInfo{header.BaseHeight, header.BaseHash, sum, header.Entries}, nil
+		}
+	}
+	return nil, errors.Wrapf(ErrUnknownSnapshot, "no snapshot at height %d, block %x", header.BaseHeight, header.BaseHash)
+}
+
+// LoadUTXO creates a chain for opts from the UTXO set snapshot in file, whose
+// hash must be pinned in the chain parameters. The chain starts at the base of
+// the snapshot with the headers below it, new blocks are validated against the
+// loaded UTXO set right away. The missing blocks are backfilled as peers send
+// them, until then the chain is pruned below the base, see PruneHeight. A chain
+// loaded with a PruneDepth does not backfill.
+func LoadUTXO(opts Options, file string) (*BlockChain, *SnapshotInfo, error) {
+	if err := opts.validate(); err != nil {
+		return nil, nil, err
+	}
+	chainParams := opts.params()
+	info, err := verifySnapshot(chainParams, file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := openDB(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = db.View(func(txn storage.Txn) error {
+		if _, err := txn.Get([]byte(lastHashKey)); err == nil {
+			return errors.Wrapf(ErrChainExists, "in %s", opts.dataDir())
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	// a load that was interrupted left no last hash, it is simply written again
+	batch := make(map[string][]byte)
+	flush := func() error {
+		err := db.Update(func(txn storage.Txn) error {
+			for key, value := range batch {
+				if err := txn.Set([]byte(key), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		batch = make(map[string][]byte)
+		return errors.Wrap(err, "error writing the snapshot")
+	}
+	set := func(key, value []byte) error {
+		batch[string(key)] = value
+		if len(batch) >= snapshotBatchWrites {
+			return flush()
+		}
+		return nil
+	}
+	var genesisHash []byte
+	hash := NewMuHash()
+	_, _, err = readSnapshot(file, func(block *Block) error {
+		if block.Height == 0 {
+			genesisHash = block.Hash
+		}
+		if err := set(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		return set(heightKey(block.Height), block.Hash)
+	}, func(entry snapshotEntry) error {
+		hash.addOutputs(entry.ID, entry.Outputs)
+		return set(utxoKey(entry.ID), entry.Outputs.Serialize())
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		state := map[string][]byte{
+			schemaVersionKey: encodeSchemaVersion(SchemaVersion),
+			genesisKey:       genesisHash,
+			utxoTipKey:       info.BlockHash,
+			utxoHashKey:      hash.Serialize(),
+			pruneHeightKey:   encodeHeight(info.Height + 1),
+			lastHashKey:      info.BlockHash,
+		}
+		// a pruned chain would drop the backfilled blocks again
+		if opts.PruneDepth <= 0 {
+			state[backfillKey] = encodeHeight(0)
+		}
+		err = db.Update(func(txn storage.Txn) error {
+			for key, value := range state {
+				if err := txn.Set([]byte(key), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		db.Close()
+		return nil, nil, errors.Wrap(err, "error loading the snapshot")
+	}
+
+	chain := BlockChain{
+		GenesisHash: genesisHash,
+		Database:    db,
+		Params:      chainParams,
+		opts:        opts,
+		lastHash:    info.BlockHash,
+		blockCache:  opts.blockCache(),
+		clock:       NewNetworkTime(),
+	}
+	chain.utxoCache = opts.utxoCache(&chain)
+	return &chain, info, nil
+}
+
+// Backfilling reports whether the chain was loaded from a snapshot and still misses blocks below its base
+func (chain *BlockChain) Backfilling() (bool, error) {
+	backfilling := false
+	err := chain.Database.View(func(txn storage.Txn) error {
+		_, err := txn.Get([]byte(backfillKey))
+		if err == storage.ErrKeyNotFound {
+			return nil
+		}
+		backfilling = err == nil
+		return err
+	})
+	return backfilling, errors.Wrap(err, "error reading the backfill progress")
+}
+
+// backfill stores a block of a chain loaded from a snapshot, which only had
+// its header, once the block matches the header. When every block below the
+// base of the snapshot is complete the chain is no longer pruned.
+func (chain *BlockChain) backfill(txn storage.Txn, stored []byte, block *Block) error {
+	header, err := Deserialize(stored)
+	if err != nil {
+		return err
+	}
+	if !header.Pruned() || block.Pruned() {
+		return nil
+	}
+	next, err := txn.Get([]byte(backfillKey))
+	if err == storage.ErrKeyNotFound {
+		// the chain was pruned, the block is not needed again
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if block.Height != header.Height || bytes.Compare(NewProof(block, chain.Params.Difficulty).Hash(), header.Hash) != 0 {
+		return errors.Wrapf(ErrInvalidBlock, "block %x does not match its header", block.Hash)
+	}
+	if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+		return errors.Wrapf(err, "error backfilling block %x", block.Hash)
+	}
+
+	height, err := decodeHeight(next)
+	if err != nil {
+		return err
+	}
+	end, err := pruneHeight(txn)
+	if err != nil {
+		return err
+	}
+	for ; height < end; height++ {
+		_, err := blockAtHeight(txn, height)
+		if errors.Cause(err) == ErrPruned {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if height < end {
+		return txn.Set([]byte(backfillKey), encodeHeight(height))
+	}
+	if err := txn.Delete([]byte(backfillKey)); err != nil {
+		return err
+	}
+	return txn.Delete([]byte(pruneHeightKey))
+}
@@ -0,0 +1,160 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// storedUTXOHash reads the hash of the UTXO set the chain keeps up to date
+func storedUTXOHash(t *testing.T, chain *BlockChain) []byte {
+	if err := (UTXOSet{BlockChain: chain}).flushCache(); err != nil {
+		t.Fatal(err)
+	}
+	var sum []byte
+	err := chain.Database.View(func(txn storage.Txn) error {
+		hash, err := utxoHash(txn)
+		if err == nil {
+			sum = hash.Sum()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
+
+func TestLoadUTXO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source, pool, wallets, address := newTestChain(t, dir)
+	defer source.Close()
+	w := wallets.Wallets[address]
+	coins := splitTestCoins(t, pool, w, address, 3, 100000)
+	if err := pool.Add(newTestTxWithFee(t, pool, w, coins[0], 1, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	mineTestBlocks(t, pool, address, 3)
+
+	file := filepath.Join(dir, "utxo.snapshot")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := source.DumpUTXO(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if info.Height != 4 || bytes.Compare(info.BlockHash, source.LastHash()) != 0 {
+		t.Fatalf("snapshot at height %d, block %x, want the tip", info.Height, info.BlockHash)
+	}
+	pinned := params.Regtest
+	pinned.Snapshots = []params.Snapshot{{Height: info.Height, BlockHash: hex.EncodeToString(info.BlockHash), Hash: hex.EncodeToString(info.Hash)}}
+	wrongHash := pinned
+	wrongHash.Snapshots = []params.Snapshot{{Height: info.Height, BlockHash: hex.EncodeToString(info.BlockHash), Hash: hex.EncodeToString(make([]byte, len(info.Hash)))}}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(dir, "truncated.snapshot")
+	if err := ioutil.WriteFile(truncated, data[:len(data)-10], 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		p    *params.ChainParams
+		file string
+		want error
+	}{
+		{"not pinned", &params.Regtest, file, ErrUnknownSnapshot},
+		{"pinned with another hash", &wrongHash, file, ErrUnknownSnapshot},
+		{"truncated", &pinned, truncated, ErrCorruptData},
+	}
+	for _, test := range tests {
+		if _, _, err := LoadUTXO(Options{Store: storage.NewMemory(), Params: test.p}, test.file); errors.Cause(err) != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+	// the store is closed on failure, it is not the one of the source
+	existing := storage.NewMemory()
+	if err := existing.Update(func(txn storage.Txn) error { return txn.Set([]byte(lastHashKey), source.LastHash()) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadUTXO(Options{Store: existing, Params: &pinned}, file); errors.Cause(err) != ErrChainExists {
+		t.Errorf("loading into a chain: got %v, want %v", err, ErrChainExists)
+	}
+
+	chain, loaded, err := LoadUTXO(Options{Store: storage.NewMemory(), Params: &pinned}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Close()
+	if bytes.Compare(loaded.Hash, info.Hash) != 0 || bytes.Compare(chain.LastHash(), source.LastHash()) != 0 {
+		t.Errorf("loaded snapshot %x at %x, want %x at %x", loaded.Hash, chain.LastHash(), info.Hash, source.LastHash())
+	}
+	if bytes.Compare(storedUTXOHash(t, chain), storedUTXOHash(t, source)) != 0 {
+		t.Error("the loaded UTXO set differs from the one of the snapshot")
+	}
+	if height, err := chain.PruneHeight(); err != nil || height != info.Height+1 {
+		t.Errorf("prune height %d, %v, want %d", height, err, info.Height+1)
+	}
+	if backfilling, err := chain.Backfilling(); err != nil || !backfilling {
+		t.Errorf("backfilling %v, %v, want true", backfilling, err)
+	}
+
+	// the loaded chain validates and mines new blocks right away
+	loadedPool, err := NewMempool(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend := newTestTxWithFee(t, loadedPool, w, coins[1], 1, 1000)
+	if err := loadedPool.Add(spend); err != nil {
+		t.Fatal(err)
+	}
+	tip := mineTestBlocks(t, loadedPool, address, 1)[0]
+	if _, err := ConnectBlock(pool, tip); err != nil {
+		t.Fatalf("the source chain refused the block of the loaded one: %v", err)
+	}
+
+	// the blocks below the base are backfilled, a block not matching its header is refused
+	var below []*Block
+	for height := 0; height <= info.Height; height++ {
+		block, err := source.BlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		below = append(below, block)
+	}
+	forged := *below[1]
+	forged.Transactions = below[2].Transactions
+	if _, err := ConnectBlock(loadedPool, &forged); errors.Cause(err) != ErrInvalidBlock {
+		t.Errorf("backfilling a forged block: got %v, want an invalid block", err)
+	}
+	for _, block := range below {
+		if _, err := ConnectBlock(loadedPool, block); err != nil {
+			t.Fatalf("backfilling height %d: %v", block.Height, err)
+		}
+		backfilling, err := chain.Backfilling()
+		if err != nil || backfilling != (block.Height < info.Height) {
+			t.Errorf("backfilling %v, %v after height %d", backfilling, err, block.Height)
+		}
+	}
+	if height, err := chain.PruneHeight(); err != nil || height != 0 {
+		t.Errorf("prune height %d, %v after the backfill, want 0", height, err)
+	}
+	if err := chain.VerifyChain(VerifyUTXO, nil); err != nil {
+		t.Error(err)
+	}
+}
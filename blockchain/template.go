@@ -0,0 +1,172 @@
+package blockchain
+
+import (
+	"bytes"
+	"math"
+	"time"
+)
+
+// BlockTemplate is a block ready to be mined: a coinbase paying the reward and
+// the fees to the miner followed by the best paying transactions of the mempool
+type BlockTemplate struct {
+	PrevHash     []byte
+	Height       int
+	Difficulty   int
+	Transactions []*CoinTransaction
+	Fees         int
+	// Size bounds the serialized size of the mined block, see sizeOf
+	Size int
+	// UTXOCommitment is the hash of the UTXO set with the template applied
+	UTXOCommitment []byte
+	// MinTimestamp is the earliest valid timestamp, one after the median time past of the tip
+	MinTimestamp int64
+	clock        *NetworkTime
+}
+
+// NewBlockTemplate selects the transactions with the highest ancestor fee rate
+// from the pool that fit into a block of ChainParams.MaxBlockSize bytes and
+// ChainParams.MaxBlockTxs transactions. The size is checked on the block with
+// its final coinbase, collecting the reward and the fees, and fewer
+// transactions are selected while it is too large.
+func NewBlockTemplate(pool *Mempool, minerAddress string) (*BlockTemplate, error) {
+	if err := pool.BlockChain.ValidateAddress(minerAddress); err != nil {
+		return nil, err
+	}
+	bestHeight, err := pool.BlockChain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &BlockTemplate{
+		PrevHash:   pool.BlockChain.LastHash(),
+		Height:     bestHeight + 1,
+		Difficulty: pool.BlockChain.Params.Difficulty,
+		clock:      pool.BlockChain.clock,
+	}
+	if tmpl.MinTimestamp, err = pool.BlockChain.minTimestamp(tmpl.PrevHash); err != nil {
+		return nil, err
+	}
+
+	maxSize := pool.BlockChain.Params.MaxBlockSize
+	reward := pool.BlockChain.Params.BlockReward
+	coinbase, err := RewardTransaction(minerAddress, "", reward)
+	if err != nil {
+		return nil, err
+	}
+	budget := maxSize - tmpl.sizeOf([]*CoinTransaction{coinbase})
+	for {
+		selected := pool.SelectPackages(budget)
+		if limit := pool.BlockChain.Params.MaxBlockTxs - 1; len(selected) > limit {
+			// parents come before their children, a prefix is still valid
+			selected = selected[:limit]
+		}
+		fees := 0
+		for _, tx := range selected {
+			entry, _ := pool.Get(tx.ID)
+			fees += entry.Fee
+		}
+		coinbase, err := RewardTransaction(minerAddress, "", reward+fees)
+		if err != nil {
+			return nil, err
+		}
+		transactions := append([]*CoinTransaction{coinbase}, selected...)
+		size := tmpl.sizeOf(transactions)
+		if size <= maxSize || len(selected) == 0 {
+			tmpl.Transactions, tmpl.Fees, tmpl.Size = transactions, fees, size
+			break
+		}
+		budget -= size - maxSize
+	}
+	UTXOSet := UTXOSet{BlockChain: pool.BlockChain}
+	tmpl.UTXOCommitment, err = UTXOSet.CommitmentAfter(&Block{Transactions: tmpl.Transactions, Height: tmpl.Height})
+	if err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// sizeOf serializes the block the template becomes with transactions, with
+// the fields the proof of work fills in at their largest, so the mined block
+// is never larger
+func (tmpl *BlockTemplate) sizeOf(transactions []*CoinTransaction) int {
+	block := Block{
+		Timestamp:      math.MaxInt64,
+		Transactions:   transactions,
+		PrevHash:       tmpl.PrevHash,
+		Hash:           make([]byte, 32),
+		Nonce:          int(^uint(0) >> 1),
+		Height:         tmpl.Height,
+		UTXOCommitment: make([]byte, 32),
+	}
+	return len(block.Serialize())
+}
+
+// Solve runs the proof of work for the template, timestamped with the network
+// time or MinTimestamp when blocks came faster than the clock moved
+func (tmpl *BlockTemplate) Solve() *Block {
+	timestamp := time.Now().Unix()
+	if tmpl.clock != nil {
+		timestamp = tmpl.clock.Now().Unix()
+	}
+	if timestamp < tmpl.MinTimestamp {
+		timestamp = tmpl.MinTimestamp
+	}
+	return createBlockAt(timestamp, tmpl.Transactions, tmpl.PrevHash, tmpl.Height, tmpl.Difficulty, tmpl.UTXOCommitment)
+}
+
+// Mine solves the template, checks the size of the resulting block, see
+// CheckBlockSize, and connects it
+func (tmpl *BlockTemplate) Mine(pool *Mempool) (*Block, error) {
+	block := tmpl.Solve()
+	if err := CheckBlockSize(block, pool.BlockChain.Params); err != nil {
+		return nil, err
+	}
+	if _, err := ConnectBlock(pool, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// ConnectBlock adds a block to the chain. When it extends the tip it is
+// validated first, see ValidateBlock, then its transactions are applied to the
+// UTXO set and dropped from the pool. A block the UTXO set rejects is removed
+// again, leaving its parent as the tip. A block of another branch is only
+// checked with CheckBlock and CheckBlockTime and stored, its transactions are
+// checked once the branch becomes the best one, see Reorganize. It reports
+// whether the block became the new tip.
+func ConnectBlock(pool *Mempool, block *Block) (bool, error) {
+	chain := pool.BlockChain
+	extendsTip := bytes.Compare(block.PrevHash, chain.LastHash()) == 0
+	if extendsTip {
+		if err := chain.ValidateBlock(block); err != nil {
+			return false, err
+		}
+	} else {
+		if err := CheckBlock(block, chain.Params); err != nil {
+			return false, err
+		}
+		if err := chain.CheckBlockTime(block); err != nil {
+			return false, err
+		}
+	}
+	if err := chain.AddBlock(block); err != nil {
+		return false, err
+	}
+	if !extendsTip {
+		return false, nil
+	}
+	UTXOSet := UTXOSet{BlockChain: chain}
+	if err := UTXOSet.Update(block); err != nil {
+		// the UTXO set may have taken the block before failing, e.g. to prune
+		tip, tipErr := UTXOSet.tip()
+		if tipErr != nil {
+			return false, tipErr
+		}
+		if bytes.Compare(tip, block.Hash) != 0 {
+			if removeErr := chain.removeTip(block); removeErr != nil {
+				return false, removeErr
+			}
+		}
+		return false, err
+	}
+	return true, pool.RemoveForBlock(block)
+}
@@ -9,8 +9,9 @@ import (
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
+	"github.com/AntonBozhinov/sentinel/params"
 	"github.com/AntonBozhinov/sentinel/wallet"
-	"golang.org/x/tools/container/intsets"
+	"github.com/pkg/errors"
 	"log"
 	"math/big"
 	"strings"
@@ -22,48 +23,62 @@ type CoinTransaction struct {
 	Outputs []CoinTxOutput
 }
 
-func RewardTransaction(to, data string, amount int) *CoinTransaction {
+func RewardTransaction(to, data string, amount int) (*CoinTransaction, error) {
 	if data == "" {
 		randData := make([]byte, 24)
 		_, err := rand.Read(randData)
 		if err != nil {
-			log.Panic(err)
+			return nil, errors.Wrap(err, "error generating coinbase data")
 		}
 		data = fmt.Sprintf("%s", randData)
 	}
 	txIn := CoinTxInput{[]byte{}, -1,nil, []byte(data)}
-	txOut := NewCoinTxOutput(amount, to)
+	txOut, err := NewCoinTxOutput(amount, to)
+	if err != nil {
+		return nil, err
+	}
 
 	tx := CoinTransaction{
 		ID:      nil,
 		Inputs:  []CoinTxInput{txIn},
 		Outputs: []CoinTxOutput{*txOut},
 	}
-	tx.Hash()
-	return &tx
+	tx.ID = tx.Hash()
+	return &tx, nil
 }
 
-func GenesisTransaction(to, data string) *CoinTransaction {
-	if data == "" {
-		randData := make([]byte, 24)
-		_, err := rand.Read(randData)
+// GenesisTransaction is the coinbase of the genesis paying every allocation.
+// Its data is used as is, so the same spec always gives the same transaction.
+func GenesisTransaction(allocations []params.Allocation, data string) (*CoinTransaction, error) {
+	txIn := CoinTxInput{[]byte{}, -1,nil, []byte(data)}
+	var outputs []CoinTxOutput
+	for _, allocation := range allocations {
+		txOut, err := NewCoinTxOutput(allocation.Amount, allocation.Address)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
-		data = fmt.Sprintf("%s", randData)
+		outputs = append(outputs, *txOut)
 	}
-	txIn := CoinTxInput{[]byte{}, -1,nil, []byte(data)}
-	txOut := NewCoinTxOutput(intsets.MaxInt - 1, to)
 
 	tx := CoinTransaction{
 		ID:      nil,
 		Inputs:  []CoinTxInput{txIn},
-		Outputs: []CoinTxOutput{*txOut},
+		Outputs: outputs,
 	}
-	tx.Hash()
-	return &tx
+	tx.ID = tx.Hash()
+	return &tx, nil
 }
 
+// gob numbers types in the order a process first encodes them and writes the
+// numbers into its output. Transaction IDs and merkle roots hash that output,
+// so the order is fixed here for every process to compute the same hashes.
+func init() {
+	CoinTransaction{}.Serialize()
+	(&Block{}).Serialize()
+}
+
+// Serialize the transaction. Encoding into memory can not fail,
+// a panic here is a programming error.
 func (txn CoinTransaction) Serialize() []byte {
 	var encoded bytes.Buffer
 	enc := gob.NewEncoder(&encoded)
@@ -74,6 +89,22 @@ func (txn CoinTransaction) Serialize() []byte {
 	return encoded.Bytes()
 }
 
+// DeserializeTransaction decodes a transaction produced by Serialize
+func DeserializeTransaction(data []byte) (CoinTransaction, error) {
+	var txn CoinTransaction
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&txn)
+	if err != nil {
+		return txn, errors.Wrapf(ErrCorruptData, "error decoding a transaction: %v", err)
+	}
+	return txn, nil
+}
+
+// Size is the length of the serialized transaction, used for fee rates
+func (txn CoinTransaction) Size() int {
+	return len(txn.Serialize())
+}
+
 func (txn *CoinTransaction) Hash() []byte {
 	var hash [32]byte
 	txCopy := *txn
@@ -87,14 +118,15 @@ func (txn *CoinTransaction) IsCoinTransaction() bool {
 	return len(txn.Inputs) == 1 && len(txn.Inputs[0].ID) == 0 && txn.Inputs[0].Out == -1
 }
 
-func (txn CoinTransaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]CoinTransaction) {
+func (txn CoinTransaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]CoinTransaction) error {
 	if txn.IsCoinTransaction() {
-		return
+		return nil
 	}
 
 	for _, in := range txn.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
+		prevTX := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTX.ID == nil || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return errors.Wrapf(ErrTxNotFound, "previous output %x:%d", in.ID, in.Out)
 		}
 	}
 	txCopy := txn.TrimmedCopy()
@@ -107,12 +139,16 @@ func (txn CoinTransaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Coi
 		txCopy.Inputs[inId].PubKey = nil
 		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
 		if err != nil {
-			log.Panicf("error signing a transaction: %v", err)
+			return errors.Wrap(err, "error signing a transaction")
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
+		// r and s are padded to the same length, Verify splits the signature in half
+		size := (privKey.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		copy(signature[size-len(r.Bytes()):size], r.Bytes())
+		copy(signature[2*size-len(s.Bytes()):], s.Bytes())
 		txn.Inputs[inId].Signature = signature
 	}
-
+	return nil
 }
 
 func (txn *CoinTransaction) TrimmedCopy() CoinTransaction {
@@ -130,13 +166,14 @@ func (txn *CoinTransaction) TrimmedCopy() CoinTransaction {
 	return txCopy
 }
 
-func (txn CoinTransaction) Verify(prevTXs map[string]CoinTransaction) bool {
+func (txn CoinTransaction) Verify(prevTXs map[string]CoinTransaction) (bool, error) {
 	if txn.IsCoinTransaction() {
-		return true
+		return true, nil
 	}
 	for _, in := range txn.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("error on transaction verification: Previous transaction does not exist")
+		prevTX := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTX.ID == nil || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return false, errors.Wrapf(ErrTxNotFound, "previous output %x:%d", in.ID, in.Out)
 		}
 	}
 
@@ -162,12 +199,12 @@ func (txn CoinTransaction) Verify(prevTXs map[string]CoinTransaction) bool {
 		x.SetBytes(in.PubKey[:(keyLen / 2)])
 		y.SetBytes(in.PubKey[(keyLen / 2):])
 
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
+		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
 		if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
-			return  false
+			return false, nil
 		}
 	}
-	return true
+	return true, nil
 }
 
 func (txn CoinTransaction) String() string {
@@ -189,49 +226,67 @@ func (txn CoinTransaction) String() string {
 	return strings.Join(lines, "\n")
 }
 
-func NewTransaction(from, to string, amount int, UTXO *UTXOSet) *CoinTransaction {
+// NewTransaction builds and signs a payment paying feeRate per byte from
+// coins that are not already spent in the pool, picked by the selector
+func NewTransaction(wallets *wallet.Wallets, from, to string, amount, feeRate int, selector CoinSelector, pool *Mempool) (*CoinTransaction, error) {
 	var inputs []CoinTxInput
 	var outputs []CoinTxOutput
 
-	wallets, err := wallet.CreateWallets()
+	if err := pool.BlockChain.ValidateAddress(to); err != nil {
+		return nil, err
+	}
+	w, err := wallets.GetWallet(from)
 	if err != nil {
-		log.Panicf("error fetching wallets: %v", err)
+		return nil, err
 	}
 
-	w := wallets.GetWallet(from)
-
 	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
 
-	acc, validOutputs := UTXO.FindSpendableTransactions(pubKeyHash, amount)
-	if acc < amount {
-		log.Panic("error: not enough funds")
+	UTXO := UTXOSet{BlockChain: pool.BlockChain}
+	unspent, err := UTXO.FindUnspentOutputs(pubKeyHash)
+	if err != nil {
+		return nil, err
 	}
-	for txId, outs := range validOutputs {
-		txID, err := hex.DecodeString(txId)
-		if err != nil {
-			log.Panicf("error decoding a transaction id: %v", err)
+	var available []UnspentOutput
+	for _, utxo := range unspent {
+		if !pool.IsSpent(utxo.Outpoint) {
+			available = append(available, utxo)
 		}
-		for _, out := range outs {
-			input := CoinTxInput{
-				ID:  txID,
-				Out: out,
-				Signature: nil,
-				PubKey: w.PublicKey,
-			}
-			inputs = append(inputs, input)
+	}
+	selection, err := selector.Select(available, amount, feeRate)
+	if err != nil {
+		return nil, errors.Wrap(err, "error selecting coins")
+	}
+	for _, utxo := range selection.Inputs {
+		input := CoinTxInput{
+			ID:  utxo.ID,
+			Out: utxo.Out,
+			Signature: nil,
+			PubKey: w.PublicKey,
 		}
+		inputs = append(inputs, input)
 	}
-	outputs = append(outputs, *NewCoinTxOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewCoinTxOutput(acc - amount, from))
+	payment, err := NewCoinTxOutput(amount, to)
+	if err != nil {
+		return nil, err
+	}
+	outputs = append(outputs, *payment)
+	if selection.Change > 0 {
+		change, err := NewCoinTxOutput(selection.Change, from)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *change)
 	}
 
 	tx := CoinTransaction{
 		ID: nil,
-		Inputs: inputs, 
+		Inputs: inputs,
 		Outputs: outputs,
 	}
 	tx.ID = tx.Hash()
-	UTXO.BlockChain.SignTransaction(&tx, w.PrivateKey)
-	return &tx
+	if err := pool.SignTransaction(&tx, w.PrivateKey); err != nil {
+		return nil, errors.Wrap(err, "error signing the transaction")
+	}
+	return &tx, nil
 }
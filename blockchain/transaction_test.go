@@ -0,0 +1,66 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"github.com/AntonBozhinov/sentinel/wallet"
+	"testing"
+)
+
+// keyWithLeadingZero generates key pairs until X, or Y when y is set, is
+// shorter than 32 bytes
+func keyWithLeadingZero(t *testing.T, y bool) (*wallet.Wallet, []byte) {
+	for {
+		private, public, err := wallet.NewKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		coordinate := private.PublicKey.X
+		if y {
+			coordinate = private.PublicKey.Y
+		}
+		if coordinate.BitLen() <= 248 {
+			return &wallet.Wallet{PrivateKey: private, PublicKey: public}, public
+		}
+	}
+}
+
+// TestSignLeadingZeros signs with keys whose X or Y starts with a zero byte
+// until r or s does too. Verify splits the public key and the signature in
+// half, so both must keep their leading zeros to verify.
+func TestSignLeadingZeros(t *testing.T) {
+	for _, y := range []bool{false, true} {
+		w, public := keyWithLeadingZero(t, y)
+		if len(public) != 64 {
+			t.Fatalf("public key of %d bytes, want 64", len(public))
+		}
+		prev := CoinTransaction{
+			ID:      []byte("previous transaction"),
+			Outputs: []CoinTxOutput{{Value: 10, PubKeyHash: wallet.PublicKeyHash(public)}},
+		}
+		prevTXs := map[string]CoinTransaction{hex.EncodeToString(prev.ID): prev}
+
+		for shortR, shortS := false, false; !shortR || !shortS; {
+			tx := CoinTransaction{
+				Inputs:  []CoinTxInput{{prev.ID, 0, nil, public}},
+				Outputs: []CoinTxOutput{{Value: 9, PubKeyHash: wallet.PublicKeyHash(public)}},
+			}
+			tx.ID = tx.Hash()
+			if err := tx.Sign(w.PrivateKey, prevTXs); err != nil {
+				t.Fatal(err)
+			}
+			signature := tx.Inputs[0].Signature
+			if len(signature) != 64 {
+				t.Fatalf("signature of %d bytes, want 64", len(signature))
+			}
+			valid, err := tx.Verify(prevTXs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !valid {
+				t.Fatalf("signature %x of public key %x does not verify", signature, public)
+			}
+			shortR = shortR || signature[0] == 0
+			shortS = shortS || signature[32] == 0
+		}
+	}
+}
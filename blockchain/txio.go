@@ -3,8 +3,13 @@ package blockchain
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/hex"
+	"fmt"
 	"github.com/AntonBozhinov/sentinel/wallet"
+	"github.com/pkg/errors"
 	"log"
+	"strconv"
+	"strings"
 )
 
 // CoinTxInput is the transaction intput
@@ -21,8 +26,48 @@ type CoinTxOutput struct {
 	PubKeyHash []byte
 }
 
+// CoinTxOutputs are the unspent outputs of a transaction stored in the UTXO set
 type CoinTxOutputs struct {
 	Outputs []CoinTxOutput
+	// Indexes keeps the position of every output in its transaction,
+	// because spent outputs are removed from the list
+	Indexes []int
+	// Height of the block that confirmed the transaction
+	Height int
+}
+
+// Outpoint references a single output of a transaction
+type Outpoint struct {
+	ID  []byte
+	Out int
+}
+
+// UnspentOutput is an output of the UTXO set together with its outpoint
+type UnspentOutput struct {
+	Outpoint
+	CoinTxOutput
+	Height int
+}
+
+// ParseOutpoint reads an outpoint in the txid:index form printed by String
+func ParseOutpoint(s string) (Outpoint, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return Outpoint{}, errors.Errorf("outpoint %q is not in the txid:index form", s)
+	}
+	ID, err := hex.DecodeString(parts[0])
+	if err != nil || len(ID) == 0 {
+		return Outpoint{}, errors.Errorf("outpoint %q has an invalid transaction id", s)
+	}
+	out, err := strconv.Atoi(parts[1])
+	if err != nil || out < 0 {
+		return Outpoint{}, errors.Errorf("outpoint %q has an invalid output index", s)
+	}
+	return Outpoint{ID, out}, nil
+}
+
+func (o Outpoint) String() string {
+	return fmt.Sprintf("%x:%d", o.ID, o.Out)
 }
 
 func (in *CoinTxInput) UsesKey(pubKeyHash []byte) bool {
@@ -30,26 +75,83 @@ func (in *CoinTxInput) UsesKey(pubKeyHash []byte) bool {
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
 
-func (out *CoinTxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)
-
-	pubKeyHash = pubKeyHash[1: len(pubKeyHash) - wallet.ChecksumLength]
+func (out *CoinTxOutput) Lock(address []byte) error {
+	pubKeyHash, err := wallet.AddressPublicKeyHash(string(address))
+	if err != nil {
+		return err
+	}
 	out.PubKeyHash = pubKeyHash
+	return nil
 }
 func (out *CoinTxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
 	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
 }
 
 
-func NewCoinTxOutput(value int, address string) *CoinTxOutput {
+func NewCoinTxOutput(value int, address string) (*CoinTxOutput, error) {
 	txo := &CoinTxOutput{
 		Value: value,
 		PubKeyHash: nil,
 	}
-	txo.Lock([]byte(address))
-	return txo
+	if err := txo.Lock([]byte(address)); err != nil {
+		return nil, err
+	}
+	return txo, nil
+}
+
+// Index returns the position in the transaction of the i-th stored output
+func (outs CoinTxOutputs) Index(i int) int {
+	if i < len(outs.Indexes) {
+		return outs.Indexes[i]
+	}
+	return i
+}
+
+// Find returns the output at position out of the transaction if it is still unspent
+func (outs CoinTxOutputs) Find(out int) (CoinTxOutput, bool) {
+	for i, output := range outs.Outputs {
+		if outs.Index(i) == out {
+			return output, true
+		}
+	}
+	return CoinTxOutput{}, false
+}
+
+// withOutput returns the outputs with out added back at position index of the transaction
+func (outs CoinTxOutputs) withOutput(index int, out CoinTxOutput) CoinTxOutputs {
+	restored := CoinTxOutputs{Height: outs.Height}
+	added := false
+	for i, output := range outs.Outputs {
+		if !added && outs.Index(i) > index {
+			restored.Outputs = append(restored.Outputs, out)
+			restored.Indexes = append(restored.Indexes, index)
+			added = true
+		}
+		restored.Outputs = append(restored.Outputs, output)
+		restored.Indexes = append(restored.Indexes, outs.Index(i))
+	}
+	if !added {
+		restored.Outputs = append(restored.Outputs, out)
+		restored.Indexes = append(restored.Indexes, index)
+	}
+	return restored
+}
+
+// transaction rebuilds the transaction ID as far as its unspent outputs go, the
+// spent ones are left empty. It is all signing and verifying an input needs.
+func (outs CoinTxOutputs) transaction(ID []byte) CoinTransaction {
+	tx := CoinTransaction{ID: ID}
+	for i, out := range outs.Outputs {
+		for len(tx.Outputs) < outs.Index(i) {
+			tx.Outputs = append(tx.Outputs, CoinTxOutput{})
+		}
+		tx.Outputs = append(tx.Outputs, out)
+	}
+	return tx
 }
 
+// Serialize the outputs. Encoding into memory can not fail,
+// a panic here is a programming error.
 func (outs CoinTxOutputs) Serialize() []byte {
 	var buffer bytes.Buffer
 	encode := gob.NewEncoder(&buffer)
@@ -60,12 +162,12 @@ func (outs CoinTxOutputs) Serialize() []byte {
 	return buffer.Bytes()
 }
 
-func DeserializeOutputs(data []byte) CoinTxOutputs {
+func DeserializeOutputs(data []byte) (CoinTxOutputs, error) {
 	var outputs CoinTxOutputs
 	decode := gob.NewDecoder(bytes.NewReader(data))
 	err := decode.Decode(&outputs)
 	if err != nil {
-		log.Panicf("error deserializing transaction outputs: %v", err)
+		return outputs, errors.Wrapf(ErrCorruptData, "error deserializing transaction outputs: %v", err)
 	}
-	return outputs
+	return outputs, nil
 }
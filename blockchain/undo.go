@@ -0,0 +1,250 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"log"
+)
+
+// undoPrefix keys the undo data of every block applied to the UTXO set
+var undoPrefix = []byte("undo-")
+
+func undoKey(blockHash []byte) []byte {
+	key := make([]byte, 0, len(undoPrefix)+len(blockHash))
+	key = append(key, undoPrefix...)
+	return append(key, blockHash...)
+}
+
+// blockUndo holds the outputs a block spent, what disconnecting it puts back in the UTXO set
+type blockUndo struct {
+	Spent []UnspentOutput
+}
+
+// Serialize the undo data. Encoding into memory can not fail,
+// a panic here is a programming error.
+func (undo blockUndo) Serialize() []byte {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(undo); err != nil {
+		log.Panicf("error encoding undo data: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func deserializeUndo(data []byte) (blockUndo, error) {
+	var undo blockUndo
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&undo); err != nil {
+		return undo, errors.Wrapf(ErrCorruptData, "error decoding undo data: %v", err)
+	}
+	return undo, nil
+}
+
+// disconnectBlock reverts the changes a block made to the UTXO set, the outputs
+// it created are removed and the ones it spent restored from its undo data
+func disconnectBlock(txn storage.Txn, block *Block, undo blockUndo) error {
+	created := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		created[hex.EncodeToString(tx.ID)] = true
+		if err := txn.Delete(utxoKey(tx.ID)); err != nil {
+			return errors.Wrapf(err, "error deleting the outputs of %x", tx.ID)
+		}
+	}
+	for _, spent := range undo.Spent {
+		if created[hex.EncodeToString(spent.ID)] {
+			continue
+		}
+		key := utxoKey(spent.ID)
+		outs := CoinTxOutputs{Height: spent.Height}
+		v, err := txn.Get(key)
+		if err == nil {
+			outs, err = DeserializeOutputs(v)
+		}
+		if err != nil && err != storage.ErrKeyNotFound {
+			return errors.Wrapf(err, "error getting the outputs of %x", spent.ID)
+		}
+		outs = outs.withOutput(spent.Out, spent.CoinTxOutput)
+		if err := txn.Set(key, outs.Serialize()); err != nil {
+			return errors.Wrapf(err, "error restoring output %s", spent.Outpoint)
+		}
+	}
+	hash, err := utxoHash(txn)
+	if err != nil {
+		return err
+	}
+	hash.revertBlock(block, undo)
+	if err := txn.Set([]byte(utxoHashKey), hash.Serialize()); err != nil {
+		return errors.Wrap(err, "error restoring the UTXO set hash")
+	}
+	if err := txn.Delete(undoKey(block.Hash)); err != nil {
+		return errors.Wrapf(err, "error deleting the undo data of block %x", block.Hash)
+	}
+	return txn.Set([]byte(utxoTipKey), block.PrevHash)
+}
+
+// Reorganize moves the UTXO set from the last block applied to it to the tip of
+// the best chain. Blocks of a replaced branch are disconnected with their undo
+// data, then the blocks of the best chain above the fork are checked, see
+// checkTransactions, and applied. The first invalid block aborts the
+// reorganization, see abortReorganize. A chain without undo data for the
+// replaced branch, created before it was recorded, is reindexed instead, a
+// pruned one fails with ErrPruned.
+func (u UTXOSet) Reorganize() error {
+	if err := u.flushCache(); err != nil {
+		return err
+	}
+
+	var disconnect []*Block
+	var undos []blockUndo
+	var fork *Block
+	missingUndo := false
+	err := u.BlockChain.Database.View(func(txn storage.Txn) error {
+		hash, err := txn.Get([]byte(utxoTipKey))
+		if err == storage.ErrKeyNotFound {
+			missingUndo = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for {
+			data, err := txn.Get(hash)
+			if err == storage.ErrKeyNotFound {
+				return errors.Wrapf(ErrBlockNotFound, "%x", hash)
+			}
+			if err != nil {
+				return err
+			}
+			block, err := Deserialize(data)
+			if err != nil {
+				return err
+			}
+			indexed, err := txn.Get(heightKey(block.Height))
+			if err != nil && err != storage.ErrKeyNotFound {
+				return err
+			}
+			if bytes.Compare(indexed, block.Hash) == 0 {
+				fork = block
+				return nil
+			}
+			if block.Pruned() {
+				return errors.Wrapf(ErrPruned, "can not disconnect block %x at height %d", block.Hash, block.Height)
+			}
+			data, err = txn.Get(undoKey(block.Hash))
+			if err == storage.ErrKeyNotFound {
+				missingUndo = true
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			undo, err := deserializeUndo(data)
+			if err != nil {
+				return err
+			}
+			disconnect = append(disconnect, block)
+			undos = append(undos, undo)
+			hash = block.PrevHash
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "error finding the fork of the UTXO set")
+	}
+	if missingUndo {
+		pruned, err := u.BlockChain.PruneHeight()
+		if err != nil {
+			return err
+		}
+		if pruned > 0 {
+			return errors.Wrap(ErrPruned, "undo data is missing, the UTXO set of a pruned chain can not be rebuilt")
+		}
+		return u.Reindex()
+	}
+
+	for i, block := range disconnect {
+		err := u.BlockChain.Database.Update(func(txn storage.Txn) error {
+			return disconnectBlock(txn, block, undos[i])
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error disconnecting block %x", block.Hash)
+		}
+	}
+	if cache := u.BlockChain.utxoCache; cache != nil && len(disconnect) > 0 {
+		cache.Reset()
+	}
+
+	iter, err := u.BlockChain.ForwardIterator(fork.Height+1, -1)
+	if err != nil {
+		return err
+	}
+	for iter.Valid() {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if err := u.BlockChain.checkTransactions(block); err != nil {
+			if abortErr := u.abortReorganize(block, disconnect); abortErr != nil {
+				return abortErr
+			}
+			return err
+		}
+		if err := u.Update(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abortReorganize takes the best chain back to the branch the UTXO set was on,
+// ending in the first of the disconnected blocks, or to the parent of invalid
+// when none was. The invalid block and the blocks built on it are deleted and
+// Reorganize moves the UTXO set back.
+func (u UTXOSet) abortReorganize(invalid *Block, disconnect []*Block) error {
+	restore := invalid.PrevHash
+	if len(disconnect) > 0 {
+		restore = disconnect[0].Hash
+	}
+	var removed [][]byte
+	err := u.BlockChain.Database.Update(func(txn storage.Txn) error {
+		last, err := lastBlock(txn)
+		if err != nil {
+			return err
+		}
+		data, err := txn.Get(restore)
+		if err != nil {
+			return errors.Wrapf(err, "error getting block %x", restore)
+		}
+		tip, err := Deserialize(data)
+		if err != nil {
+			return err
+		}
+		for height := invalid.Height; height <= last.Height; height++ {
+			hash, err := txn.Get(heightKey(height))
+			if err != nil {
+				return errors.Wrapf(err, "error getting the block at height %d", height)
+			}
+			if err := txn.Delete(hash); err != nil {
+				return err
+			}
+			removed = append(removed, hash)
+		}
+		for height := tip.Height + 1; height <= last.Height; height++ {
+			if err := txn.Delete(heightKey(height)); err != nil {
+				return err
+			}
+		}
+		if err := txn.Set([]byte(lastHashKey), tip.Hash); err != nil {
+			return err
+		}
+		return indexBestChain(txn, tip)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error restoring the tip %x", restore)
+	}
+	for _, hash := range removed {
+		u.BlockChain.blockCache.invalidate(hash)
+	}
+	u.BlockChain.setLastHash(restore)
+	return u.Reorganize()
+}
@@ -2,53 +2,152 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/hex"
-	"github.com/dgraph-io/badger"
-	"log"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
 )
 
 var (
-	utxoPrefix = []byte("utxo-")
+	utxoPrefix   = []byte("utxo-")
 	prefixLength = len(utxoPrefix)
 )
 
 type UTXOSet struct {
 	BlockChain *BlockChain
+	// Progress, when set, is called by Reindex after every batch it writes
+	Progress func(height, bestHeight int)
 }
 
-func (u UTXOSet) CountTransactions() int {
+// flushCache writes the changes held by the UTXO cache, so scans of the disk see them
+func (u UTXOSet) flushCache() error {
+	if cache := u.BlockChain.utxoCache; cache != nil {
+		return cache.Flush()
+	}
+	return nil
+}
+
+// tip returns the hash of the last block applied to the UTXO set, nil when none was recorded
+func (u UTXOSet) tip() ([]byte, error) {
+	if cache := u.BlockChain.utxoCache; cache != nil {
+		cache.mu.Lock()
+		tip := cache.tip
+		cache.mu.Unlock()
+		if tip != nil {
+			return tip, nil
+		}
+	}
+	var tip []byte
+	err := u.BlockChain.Database.View(func(txn storage.Txn) error {
+		var err error
+		if tip, err = txn.Get([]byte(utxoTipKey)); err == storage.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	})
+	return tip, errors.Wrap(err, "error reading the UTXO tip")
+}
+
+func utxoKey(txID []byte) []byte {
+	key := make([]byte, 0, prefixLength+len(txID))
+	key = append(key, utxoPrefix...)
+	return append(key, txID...)
+}
+
+func (u UTXOSet) CountTransactions() (int, error) {
+	if err := u.flushCache(); err != nil {
+		return 0, err
+	}
 	db := u.BlockChain.Database
 	counter := 0
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
+	err := db.View(func(txn storage.Txn) error {
+		it := txn.NewIterator(storage.IteratorOptions{Prefix: utxoPrefix, KeysOnly: true})
 		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+		for ; it.Valid(); it.Next() {
 			counter++
 		}
 		return nil
 	})
 
+	return counter, errors.Wrap(err, "error counting transactions")
+}
+
+// UTXOSetInfo summarizes the UTXO set as of a block
+type UTXOSetInfo struct {
+	Height       int
+	BlockHash    []byte
+	Transactions int
+	Outputs      int
+	// TotalValue is unsigned, a genesis allocation near the int limit plus rewards overflows int
+	TotalValue uint64
+	Commitment []byte
+}
+
+// Info flushes the cache and summarizes the UTXO set on disk, its Commitment
+// is what the block it is at commits to
+func (u UTXOSet) Info() (*UTXOSetInfo, error) {
+	if err := u.flushCache(); err != nil {
+		return nil, err
+	}
+	info := &UTXOSetInfo{}
+	err := u.BlockChain.Database.View(func(txn storage.Txn) error {
+		tip, err := txn.Get([]byte(utxoTipKey))
+		if err != nil && err != storage.ErrKeyNotFound {
+			return err
+		}
+		if tip != nil {
+			header, err := readHeader(txn, tip)
+			if err != nil {
+				return err
+			}
+			info.Height, info.BlockHash = header.Height, tip
+		}
+		it := txn.NewIterator(storage.IteratorOptions{Prefix: utxoPrefix})
+		defer it.Close()
+		for ; it.Valid(); it.Next() {
+			v, err := it.Value()
+			if err != nil {
+				return err
+			}
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+			info.Transactions++
+			info.Outputs += len(outs.Outputs)
+			for _, out := range outs.Outputs {
+				info.TotalValue += uint64(out.Value)
+			}
+		}
+		hash, err := utxoHash(txn)
+		if err != nil {
+			return err
+		}
+		info.Commitment = hash.Sum()
+		return nil
+	})
 	if err != nil {
-		log.Panicf("error counting transactions: %v\n", err)
+		return nil, errors.Wrap(err, "error summarizing the UTXO set")
 	}
-	return counter
+	return info, nil
 }
 
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []CoinTxOutput {
+func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) ([]CoinTxOutput, error) {
+	if err := u.flushCache(); err != nil {
+		return nil, err
+	}
 	var UTXOs []CoinTxOutput
 	db := u.BlockChain.Database
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
+	err := db.View(func(txn storage.Txn) error {
+		it := txn.NewIterator(storage.IteratorOptions{Prefix: utxoPrefix})
 		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			v, err := item.Value()
+		for ; it.Valid(); it.Next() {
+			v, err := it.Value()
 			if err != nil {
-				log.Panicf("error retrieving the item value: %v\n", err)
+				return errors.Wrap(err, "error retrieving the item value")
+			}
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
 			}
-			outs := DeserializeOutputs(v)
 			for _, out := range outs.Outputs {
 				if out.IsLockedWithKey(pubKeyHash) {
 					UTXOs = append(UTXOs, out)
@@ -58,169 +157,226 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []CoinTxOutput {
 		return nil
 	})
 	if err != nil {
-		log.Panicf("error finding unspend transactions: %v\n", err)
+		return nil, errors.Wrap(err, "error finding unspend transactions")
 	}
-	return UTXOs
+	return UTXOs, nil
 }
 
-func (u UTXOSet) FindSpendableTransactions(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOuts := make(map[string][]int)
-	accumulated := 0
+// FindUnspentOutputs lists the unspent outputs locked with pubKeyHash together with their outpoints
+func (u UTXOSet) FindUnspentOutputs(pubKeyHash []byte) ([]UnspentOutput, error) {
+	if err := u.flushCache(); err != nil {
+		return nil, err
+	}
+	var UTXOs []UnspentOutput
 	db := u.BlockChain.Database
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
+	err := db.View(func(txn storage.Txn) error {
+		it := txn.NewIterator(storage.IteratorOptions{Prefix: utxoPrefix})
 		defer it.Close()
-
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			v, err := item.Value()
+		for ; it.Valid(); it.Next() {
+			v, err := it.Value()
+			if err != nil {
+				return err
+			}
+			txID := it.Key()[prefixLength:]
+			outs, err := DeserializeOutputs(v)
 			if err != nil {
 				return err
 			}
-			k = bytes.TrimPrefix(k, utxoPrefix)
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
 			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
+				if out.IsLockedWithKey(pubKeyHash) {
+					UTXOs = append(UTXOs, UnspentOutput{Outpoint{txID, outs.Index(outIdx)}, out, outs.Height})
 				}
 			}
 		}
-
 		return nil
 	})
 	if err != nil {
-		log.Panicf("error finding spendable transactions: %v\n", err)
+		return nil, errors.Wrap(err, "error finding unspent outputs")
 	}
-
-	return accumulated, unspentOuts
+	return UTXOs, nil
 }
 
-func (u *UTXOSet) Update(block *Block) {
-	db := u.BlockChain.Database;
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.IsCoinTransaction() == false {
-				for _, in := range tx.Inputs {
-					updatedOuts := CoinTxOutputs{}
-					ID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(ID)
-					if err != nil {
-						log.Panicf("error getting id: %s\n%v", ID, err)
-					}
-					v, err := item.Value()
-					if err != nil {
-						log.Panicf("error getting id: %s\n%v", ID, err)
-					}
-					outs := DeserializeOutputs(v)
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
+// FindOutput looks up a single outpoint, reporting false when it is unknown or already spent
+func (u UTXOSet) FindOutput(outpoint Outpoint) (CoinTxOutput, bool, error) {
+	if cache := u.BlockChain.utxoCache; cache != nil {
+		return cache.FindOutput(outpoint)
+	}
+	outs, found, err := u.outputs(outpoint.ID)
+	if err != nil || !found {
+		return CoinTxOutput{}, false, errors.Wrapf(err, "error finding output %s", outpoint)
+	}
+	output, found := outs.Find(outpoint.Out)
+	return output, found, nil
+}
 
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(ID); err != nil {
-							log.Panicf("error deleting output with id: %x\n%v\n", ID, err)
-						}
-					} else {
-						if err := txn.Set(ID, updatedOuts.Serialize()); err != nil {
-							log.Panicf("error setting outputs for id: %x\n%v\n", ID, err)
-						}
-					}
-				}
-			}
-			newOutputs := CoinTxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
-			}
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panicf("error setting the new outputs for transaction id: %x\n%v\n", txID, err)
-			}
+// outputs returns the unspent outputs of a transaction, reporting false when it has none
+func (u UTXOSet) outputs(txID []byte) (CoinTxOutputs, bool, error) {
+	if cache := u.BlockChain.utxoCache; cache != nil {
+		return cache.outputs(txID)
+	}
+	var outs CoinTxOutputs
+	found := false
+	err := u.BlockChain.Database.View(func(txn storage.Txn) error {
+		v, err := txn.Get(utxoKey(txID))
+		if err == storage.ErrKeyNotFound {
+			return nil
 		}
-		return nil
+		if err != nil {
+			return err
+		}
+		outs, err = DeserializeOutputs(v)
+		found = err == nil
+		return err
 	})
 	if err != nil {
-		log.Panicf("error updating UTXOSet: %v\n", err)
+		return outs, false, errors.Wrapf(err, "error getting the outputs of %x", txID)
 	}
+	return outs, found, nil
 }
 
-func (u UTXOSet) Reindex() {
-	db := u.BlockChain.Database
-
-	u.DeleteByPrefix(utxoPrefix)
-
-	UTXO := u.BlockChain.FindUTXO()
-
-	err := db.Update(func(txn *badger.Txn) error {
-		for txId, outs := range UTXO {
-			key, err := hex.DecodeString(txId)
-			if err != nil {
-				return err
-			}
-			key = append(utxoPrefix, key...)
-			err = txn.Set(key, outs.Serialize())
-			if err != nil {
-				return err
-			}
+// Update applies a block extending the chain to the UTXO set, through the cache
+// when there is one, and prunes the blocks that fell below the prune depth
+func (u *UTXOSet) Update(block *Block) error {
+	if cache := u.BlockChain.utxoCache; cache != nil {
+		if err := cache.ApplyBlock(block); err != nil {
+			return err
 		}
-		return nil
+		return u.BlockChain.prune()
+	}
+	db := u.BlockChain.Database
+	err := db.Update(func(txn storage.Txn) error {
+		_, err := applyBlock(txn, block)
+		return err
 	})
-
 	if err != nil {
-		log.Panicf("error reindexing unspent transaction outputs (UTXO): %v", err)
+		return errors.Wrap(err, "error updating UTXOSet")
 	}
+	return u.BlockChain.prune()
 }
 
-func (u *UTXOSet) DeleteByPrefix(prefix []byte)  {
-	deleteKeys := func(keysForDelete [][]byte) error {
-		if err := u.BlockChain.Database.Update(func(txn *badger.Txn) error {
-			for _, key := range keysForDelete {
-				if err :=txn.Delete(key); err != nil {
-					return err
+// applyBlock spends the inputs and adds the outputs of a block to the UTXO set,
+// recording the spent outputs as its undo data and updating the hash of the set.
+// It returns the number of keys it wrote.
+func applyBlock(txn storage.Txn, block *Block) (int, error) {
+	writes := 0
+	var undo blockUndo
+	for _, tx := range block.Transactions {
+		if tx.IsCoinTransaction() == false {
+			for _, in := range tx.Inputs {
+				ID := utxoKey(in.ID)
+				v, err := txn.Get(ID)
+				if err != nil {
+					return writes, errors.Wrapf(err, "error getting id: %x", ID)
+				}
+				outs, err := DeserializeOutputs(v)
+				if err != nil {
+					return writes, err
+				}
+				if spent, ok := outs.Find(in.Out); ok {
+					undo.Spent = append(undo.Spent, UnspentOutput{Outpoint{in.ID, in.Out}, spent, outs.Height})
+				}
+				updatedOuts := CoinTxOutputs{Height: outs.Height}
+				for outIdx, out := range outs.Outputs {
+					if outs.Index(outIdx) != in.Out {
+						updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+						updatedOuts.Indexes = append(updatedOuts.Indexes, outs.Index(outIdx))
+					}
+				}
+
+				if len(updatedOuts.Outputs) == 0 {
+					if err := txn.Delete(ID); err != nil {
+						return writes, errors.Wrapf(err, "error deleting output with id: %x", ID)
+					}
+				} else {
+					if err := txn.Set(ID, updatedOuts.Serialize()); err != nil {
+						return writes, errors.Wrapf(err, "error setting outputs for id: %x", ID)
+					}
 				}
+				writes++
 			}
-			return nil
-		}); err != nil {
-			return err
 		}
-		return nil
+		newOutputs := CoinTxOutputs{Height: block.Height}
+		for outIdx, out := range tx.Outputs {
+			newOutputs.Outputs = append(newOutputs.Outputs, out)
+			newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
+		}
+		txID := utxoKey(tx.ID)
+		if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
+			return writes, errors.Wrapf(err, "error setting the new outputs for transaction id: %x", txID)
+		}
+		writes++
+	}
+	if err := txn.Set(undoKey(block.Hash), undo.Serialize()); err != nil {
+		return writes, errors.Wrapf(err, "error setting the undo data of block %x", block.Hash)
+	}
+	hash, err := utxoHash(txn)
+	if err != nil {
+		return writes, err
 	}
+	hash.applyBlock(block, undo)
+	if err := txn.Set([]byte(utxoHashKey), hash.Serialize()); err != nil {
+		return writes, errors.Wrap(err, "error setting the UTXO set hash")
+	}
+	writes += 2
+	if err := txn.Set([]byte(utxoTipKey), block.Hash); err != nil {
+		return writes, errors.Wrap(err, "error setting the UTXO tip")
+	}
+	return writes, nil
+}
+
+func (u *UTXOSet) DeleteByPrefix(prefix []byte) error {
 	// this is the optimal amount of keys we can delete with badgerDB
 	collectSize := 100000
-	err := u.BlockChain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
+	for {
 		keysForDelete := make([][]byte, 0, collectSize)
-		keysCollected := 0
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keysForDelete = append(keysForDelete, key)
-			keysCollected++
-			if keysCollected == collectSize {
-				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panicf("error deleting keys with prefix: %s'\n%v",prefix, err)
-				}
-				keysForDelete = make([][]byte, 0,  collectSize)
-				keysCollected = 0
+		err := u.BlockChain.Database.View(func(txn storage.Txn) error {
+			it := txn.NewIterator(storage.IteratorOptions{Prefix: prefix, KeysOnly: true})
+			defer it.Close()
+			for ; it.Valid() && len(keysForDelete) < collectSize; it.Next() {
+				keysForDelete = append(keysForDelete, it.Key())
 			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error collecting keys with prefix: %s", prefix)
 		}
-		if keysCollected > 0 {
-			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panicf("error deleting keys with prefix: %s'\n%v",prefix, err)
+		if len(keysForDelete) == 0 {
+			return nil
+		}
+		err = u.BlockChain.Database.Update(func(txn storage.Txn) error {
+			for _, key := range keysForDelete {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error deleting keys with prefix: %s", prefix)
 		}
+	}
+}
 
+// catchUp brings a UTXO set behind the tip, because the chain was closed
+// before its cache was flushed, up to date with Reorganize. A set without a
+// recorded tip predates the record and is left as is.
+func (u UTXOSet) catchUp() error {
+	var utxoTip, reindexing []byte
+	err := u.BlockChain.Database.View(func(txn storage.Txn) error {
+		var err error
+		if utxoTip, err = txn.Get([]byte(utxoTipKey)); err != nil && err != storage.ErrKeyNotFound {
+			return err
+		}
+		if reindexing, err = txn.Get([]byte(reindexKey)); err != nil && err != storage.ErrKeyNotFound {
+			return err
+		}
 		return nil
 	})
 	if err != nil {
-		log.Panicf("error deleting keys with prefix: %s'\n%v",prefix, err)
+		return errors.Wrap(err, "error reading the UTXO tip")
 	}
+	if utxoTip == nil || reindexing != nil || bytes.Compare(utxoTip, u.BlockChain.LastHash()) == 0 {
+		return nil
+	}
+	return u.Reorganize()
 }
-
@@ -0,0 +1,337 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUTXOCacheSize is the number of transactions the UTXO cache holds by default
+	DefaultUTXOCacheSize = 100000
+	// DefaultUTXOFlushInterval is how long connected blocks may stay in the cache only
+	DefaultUTXOFlushInterval = time.Minute
+)
+
+// utxoTipKey stores the hash of the last block whose changes are in the UTXO set on disk
+const utxoTipKey = "utxotip"
+
+// utxoCacheEntry holds the unspent outputs of a transaction, dirty until flushed.
+// A dirty entry without outputs is deleted from disk on the next flush.
+type utxoCacheEntry struct {
+	outs  CoinTxOutputs
+	dirty bool
+}
+
+// UTXOCacheStats are the counters of a UTXO cache
+type UTXOCacheStats struct {
+	Entries int
+	Dirty   int
+	Hits    int
+	Misses  int
+	Flushes int
+}
+
+// HitRate is the share of lookups answered from memory
+func (s UTXOCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// UTXOCache is a write-back cache in front of the UTXO set on disk. Connected
+// blocks only change the cache, the changes reach the disk in one transaction
+// when the cache is full, the flush interval passed or the chain is closed.
+// The disk records the last block it holds, so a chain closed without a flush
+// catches up on open. The cache is safe for concurrent use.
+type UTXOCache struct {
+	// mu guards every field below it, lookups change the entries and the stats too
+	mu            sync.Mutex
+	chain         *BlockChain
+	size          int
+	flushInterval time.Duration
+	entries       map[string]*utxoCacheEntry
+	dirty         int
+	// undo holds the undo data of the blocks applied since the last flush, by block hash
+	undo map[string][]byte
+	// hash of the UTXO set with the changes of the cache, loaded from disk on first use
+	hash      *MuHash
+	tip       []byte
+	lastFlush time.Time
+	stats     UTXOCacheStats
+}
+
+// NewUTXOCache creates a cache of at most size transactions for the chain
+func NewUTXOCache(chain *BlockChain, size int, flushInterval time.Duration) *UTXOCache {
+	return &UTXOCache{
+		chain:         chain,
+		size:          size,
+		flushInterval: flushInterval,
+		entries:       make(map[string]*utxoCacheEntry),
+		undo:          make(map[string][]byte),
+		lastFlush:     time.Now(),
+	}
+}
+
+// Stats returns the counters of the cache
+func (c *UTXOCache) Stats() UTXOCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Dirty = c.dirty
+	return stats
+}
+
+// outputs returns the unspent outputs of a transaction, reporting false when it has none
+func (c *UTXOCache) outputs(txID []byte) (CoinTxOutputs, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, err := c.lookup(txID)
+	if err != nil || entry == nil {
+		return CoinTxOutputs{}, false, err
+	}
+	return entry.outs, len(entry.outs.Outputs) > 0, nil
+}
+
+// lookup returns the cache entry of a transaction, loading it on a miss
+func (c *UTXOCache) lookup(txID []byte) (*utxoCacheEntry, error) {
+	key := hex.EncodeToString(txID)
+	if entry, ok := c.entries[key]; ok {
+		c.stats.Hits++
+		return entry, nil
+	}
+	c.stats.Misses++
+	var entry *utxoCacheEntry
+	err := c.chain.Database.View(func(txn storage.Txn) error {
+		v, err := txn.Get(utxoKey(txID))
+		if err == storage.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+		entry = &utxoCacheEntry{outs: outs}
+		return nil
+	})
+	if err != nil || entry == nil {
+		return nil, errors.Wrapf(err, "error loading the outputs of %x", txID)
+	}
+	if len(c.entries) >= c.size {
+		c.evictClean()
+	}
+	c.entries[key] = entry
+	return entry, nil
+}
+
+// evictClean drops an entry that has no changes to flush, if there is one
+func (c *UTXOCache) evictClean() {
+	for key, entry := range c.entries {
+		if !entry.dirty {
+			delete(c.entries, key)
+			return
+		}
+	}
+}
+
+// FindOutput looks up a single outpoint, reporting false when it is unknown or already spent
+func (c *UTXOCache) FindOutput(outpoint Outpoint) (CoinTxOutput, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, err := c.lookup(outpoint.ID)
+	if err != nil || entry == nil {
+		return CoinTxOutput{}, false, err
+	}
+	out, found := entry.outs.Find(outpoint.Out)
+	return out, found, nil
+}
+
+func (c *UTXOCache) set(txID []byte, outs CoinTxOutputs) {
+	key := hex.EncodeToString(txID)
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &utxoCacheEntry{}
+		c.entries[key] = entry
+	}
+	if !entry.dirty {
+		c.dirty++
+	}
+	entry.outs = outs
+	entry.dirty = true
+}
+
+// utxoHash returns a copy of the hash of the UTXO set including the changes of the cache
+func (c *UTXOCache) utxoHash() (*MuHash, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hash, err := c.loadHash()
+	if err != nil {
+		return nil, err
+	}
+	return hash.Copy(), nil
+}
+
+// loadHash returns the hash of the UTXO set, reading it from disk on first use
+func (c *UTXOCache) loadHash() (*MuHash, error) {
+	if c.hash != nil {
+		return c.hash, nil
+	}
+	err := c.chain.Database.View(func(txn storage.Txn) error {
+		var err error
+		c.hash, err = utxoHash(txn)
+		return err
+	})
+	return c.hash, err
+}
+
+// stagedOutputs are the outputs of a transaction changed by a block being applied
+type stagedOutputs struct {
+	txID []byte
+	outs CoinTxOutputs
+}
+
+// ApplyBlock spends the inputs and adds the outputs of a block in the cache,
+// flushing when the cache is full or the flush interval passed
+func (c *UTXOCache) ApplyBlock(block *Block) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hash, err := c.loadHash()
+	if err != nil {
+		return err
+	}
+	// the changes are staged until every input is found, a block spending
+	// unknown outputs leaves the cache untouched
+	staged := make(map[string]stagedOutputs)
+	var undo blockUndo
+	for _, tx := range block.Transactions {
+		if tx.IsCoinTransaction() == false {
+			for _, in := range tx.Inputs {
+				key := hex.EncodeToString(in.ID)
+				change, ok := staged[key]
+				if !ok {
+					entry, err := c.lookup(in.ID)
+					if err != nil {
+						return err
+					}
+					if entry == nil {
+						return errors.Wrapf(ErrInvalidTx, "input %x:%d of %x spends unknown outputs", in.ID, in.Out, tx.ID)
+					}
+					change = stagedOutputs{in.ID, entry.outs}
+				}
+				outs := change.outs
+				if spent, ok := outs.Find(in.Out); ok {
+					undo.Spent = append(undo.Spent, UnspentOutput{Outpoint{in.ID, in.Out}, spent, outs.Height})
+				}
+				updatedOuts := CoinTxOutputs{Height: outs.Height}
+				for outIdx, out := range outs.Outputs {
+					if outs.Index(outIdx) != in.Out {
+						updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+						updatedOuts.Indexes = append(updatedOuts.Indexes, outs.Index(outIdx))
+					}
+				}
+				staged[key] = stagedOutputs{in.ID, updatedOuts}
+			}
+		}
+		newOutputs := CoinTxOutputs{Height: block.Height}
+		for outIdx, out := range tx.Outputs {
+			newOutputs.Outputs = append(newOutputs.Outputs, out)
+			newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
+		}
+		staged[hex.EncodeToString(tx.ID)] = stagedOutputs{tx.ID, newOutputs}
+	}
+	for _, change := range staged {
+		c.set(change.txID, change.outs)
+	}
+	hash.applyBlock(block, undo)
+	c.undo[hex.EncodeToString(block.Hash)] = undo.Serialize()
+	c.tip = block.Hash
+
+	if len(c.entries) > c.size || time.Since(c.lastFlush) >= c.flushInterval {
+		return c.flush()
+	}
+	return nil
+}
+
+// Flush writes every change of the cache to disk in a single transaction,
+// then evicts clean entries while the cache is over its size
+func (c *UTXOCache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush()
+}
+
+func (c *UTXOCache) flush() error {
+	if c.dirty > 0 {
+		err := c.chain.Database.Update(func(txn storage.Txn) error {
+			for key, entry := range c.entries {
+				if !entry.dirty {
+					continue
+				}
+				txID, err := hex.DecodeString(key)
+				if err != nil {
+					return err
+				}
+				if len(entry.outs.Outputs) == 0 {
+					err = txn.Delete(utxoKey(txID))
+				} else {
+					err = txn.Set(utxoKey(txID), entry.outs.Serialize())
+				}
+				if err != nil {
+					return errors.Wrapf(err, "error writing the outputs of %x", txID)
+				}
+			}
+			for key, undo := range c.undo {
+				blockHash, err := hex.DecodeString(key)
+				if err != nil {
+					return err
+				}
+				if err := txn.Set(undoKey(blockHash), undo); err != nil {
+					return errors.Wrapf(err, "error writing the undo data of block %x", blockHash)
+				}
+			}
+			if err := txn.Set([]byte(utxoHashKey), c.hash.Serialize()); err != nil {
+				return errors.Wrap(err, "error writing the UTXO set hash")
+			}
+			return txn.Set([]byte(utxoTipKey), c.tip)
+		})
+		if err != nil {
+			return errors.Wrap(err, "error flushing the UTXO cache")
+		}
+		c.stats.Flushes++
+	}
+
+	for key, entry := range c.entries {
+		if entry.dirty && len(entry.outs.Outputs) == 0 {
+			delete(c.entries, key)
+		}
+		entry.dirty = false
+	}
+	c.dirty = 0
+	c.undo = make(map[string][]byte)
+	c.lastFlush = time.Now()
+	for key := range c.entries {
+		if len(c.entries) <= c.size {
+			break
+		}
+		delete(c.entries, key)
+	}
+	return nil
+}
+
+// Reset drops every entry, including changes not flushed yet
+func (c *UTXOCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*utxoCacheEntry)
+	c.dirty = 0
+	c.undo = make(map[string][]byte)
+	c.hash = nil
+	c.tip = nil
+}
@@ -0,0 +1,273 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"math/big"
+)
+
+const (
+	// utxoHashKey stores the multiset hash of the UTXO set on disk, see MuHash
+	utxoHashKey = "utxohash"
+	// muHashBytes is the size of the numbers of a MuHash
+	muHashBytes = 384
+)
+
+// muHashPrime is the modulus of MuHash, the largest prime below 2^3072
+var muHashPrime = func() *big.Int {
+	p := big.NewInt(1)
+	p.Lsh(p, 8*muHashBytes)
+	return p.Sub(p, big.NewInt(1103717))
+}()
+
+// MuHash is a hash of a multiset that elements can be added to and removed
+// from in any order. Every element is mapped to a number modulo a 3072 bit prime,
+// the set is the product of its elements. Removals are kept as a separate
+// product, so only Sum has to invert a number.
+type MuHash struct {
+	numerator   *big.Int
+	denominator *big.Int
+}
+
+// NewMuHash returns the hash of the empty set
+func NewMuHash() *MuHash {
+	return &MuHash{big.NewInt(1), big.NewInt(1)}
+}
+
+// muHashElement maps data to a number modulo the prime by expanding its sha256 to 3072 bits
+func muHashElement(data []byte) *big.Int {
+	seed := sha256.Sum256(data)
+	expanded := make([]byte, 0, muHashBytes)
+	for i := byte(0); len(expanded) < muHashBytes; i++ {
+		block := sha256.Sum256(append(seed[:], i))
+		expanded = append(expanded, block[:]...)
+	}
+	element := new(big.Int).SetBytes(expanded)
+	return element.Mod(element, muHashPrime)
+}
+
+// Add puts data into the set
+func (h *MuHash) Add(data []byte) {
+	h.numerator.Mul(h.numerator, muHashElement(data))
+	h.numerator.Mod(h.numerator, muHashPrime)
+}
+
+// Remove takes data out of the set
+func (h *MuHash) Remove(data []byte) {
+	h.denominator.Mul(h.denominator, muHashElement(data))
+	h.denominator.Mod(h.denominator, muHashPrime)
+}
+
+// Copy returns a hash that changes independently of h
+func (h *MuHash) Copy() *MuHash {
+	return &MuHash{new(big.Int).Set(h.numerator), new(big.Int).Set(h.denominator)}
+}
+
+// Sum is the sha256 of the set, equal for equal sets however they were built
+func (h *MuHash) Sum() []byte {
+	value := new(big.Int).ModInverse(h.denominator, muHashPrime)
+	value.Mul(value, h.numerator)
+	value.Mod(value, muHashPrime)
+	sum := sha256.Sum256(muHashNumber(value))
+	return sum[:]
+}
+
+// muHashNumber is n in big endian, padded to muHashBytes
+func muHashNumber(n *big.Int) []byte {
+	data := make([]byte, muHashBytes)
+	b := n.Bytes()
+	copy(data[muHashBytes-len(b):], b)
+	return data
+}
+
+// Serialize the numerator followed by the denominator
+func (h *MuHash) Serialize() []byte {
+	return append(muHashNumber(h.numerator), muHashNumber(h.denominator)...)
+}
+
+func deserializeMuHash(data []byte) (*MuHash, error) {
+	if len(data) != 2*muHashBytes {
+		return nil, errors.Wrapf(ErrCorruptData, "multiset hash is %d bytes long", len(data))
+	}
+	return &MuHash{
+		new(big.Int).SetBytes(data[:muHashBytes]),
+		new(big.Int).SetBytes(data[muHashBytes:]),
+	}, nil
+}
+
+// outputElement is the member of the UTXO set hash for an unspent output, in a
+// fixed layout since gob output depends on the types a process encoded before
+func outputElement(txID []byte, index, height int, out CoinTxOutput) []byte {
+	var data []byte
+	putInt := func(n int) {
+		buffer := make([]byte, 8)
+		binary.BigEndian.PutUint64(buffer, uint64(n))
+		data = append(data, buffer...)
+	}
+	putInt(len(txID))
+	data = append(data, txID...)
+	putInt(index)
+	putInt(height)
+	putInt(out.Value)
+	putInt(len(out.PubKeyHash))
+	return append(data, out.PubKeyHash...)
+}
+
+// addOutputs puts the unspent outputs of a transaction into the set
+func (h *MuHash) addOutputs(txID []byte, outs CoinTxOutputs) {
+	for i, out := range outs.Outputs {
+		h.Add(outputElement(txID, outs.Index(i), outs.Height, out))
+	}
+}
+
+// applyBlock changes the set like connecting the block changes the UTXO set:
+// its outputs are added and the ones its undo data records as spent removed
+func (h *MuHash) applyBlock(block *Block, undo blockUndo) {
+	for _, tx := range block.Transactions {
+		for i, out := range tx.Outputs {
+			h.Add(outputElement(tx.ID, i, block.Height, out))
+		}
+	}
+	for _, spent := range undo.Spent {
+		h.Remove(outputElement(spent.ID, spent.Out, spent.Height, spent.CoinTxOutput))
+	}
+}
+
+// revertBlock undoes applyBlock
+func (h *MuHash) revertBlock(block *Block, undo blockUndo) {
+	for _, tx := range block.Transactions {
+		for i, out := range tx.Outputs {
+			h.Remove(outputElement(tx.ID, i, block.Height, out))
+		}
+	}
+	for _, spent := range undo.Spent {
+		h.Add(outputElement(spent.ID, spent.Out, spent.Height, spent.CoinTxOutput))
+	}
+}
+
+// utxoHash reads the hash of the UTXO set on disk inside a transaction. A chain
+// without one has not applied a block to its UTXO set yet, see ensureUTXOHash.
+func utxoHash(txn storage.Txn) (*MuHash, error) {
+	data, err := txn.Get([]byte(utxoHashKey))
+	if err == storage.ErrKeyNotFound {
+		return NewMuHash(), nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting the UTXO set hash")
+	}
+	return deserializeMuHash(data)
+}
+
+// ensureUTXOHash records the hash of a UTXO set created before it was, see
+// migrations. Sets that old may hold partly spent outputs without the indexes
+// the hash covers, so the set is rebuilt with Reindex, which records the hash.
+// The blocks of a pruned chain are gone and its set is hashed as it is.
+func ensureUTXOHash(db storage.Store) error {
+	recorded, pruned := false, 0
+	err := db.View(func(txn storage.Txn) error {
+		_, err := txn.Get([]byte(utxoHashKey))
+		if err != nil && err != storage.ErrKeyNotFound {
+			return err
+		}
+		recorded = err == nil
+		pruned, err = pruneHeight(txn)
+		return err
+	})
+	if err != nil || recorded {
+		return err
+	}
+	if pruned == 0 {
+		return UTXOSet{BlockChain: &BlockChain{Database: db}}.Reindex()
+	}
+	return db.Update(func(txn storage.Txn) error {
+		hash, err := computeUTXOHash(txn)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(utxoHashKey), hash.Serialize())
+	})
+}
+
+// computeUTXOHash hashes the UTXO set on disk entry by entry
+func computeUTXOHash(txn storage.Txn) (*MuHash, error) {
+	hash := NewMuHash()
+	it := txn.NewIterator(storage.IteratorOptions{Prefix: utxoPrefix})
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		v, err := it.Value()
+		if err != nil {
+			return nil, err
+		}
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return nil, err
+		}
+		hash.addOutputs(it.Key()[prefixLength:], outs)
+	}
+	return hash, nil
+}
+
+// hash returns the hash of the UTXO set including the changes held by the
+// cache, a copy the caller may change
+func (u UTXOSet) hash() (*MuHash, error) {
+	if cache := u.BlockChain.utxoCache; cache != nil {
+		return cache.utxoHash()
+	}
+	var hash *MuHash
+	err := u.BlockChain.Database.View(func(txn storage.Txn) error {
+		var err error
+		hash, err = utxoHash(txn)
+		return err
+	})
+	return hash, err
+}
+
+// Commitment is the hash of the UTXO set, what blocks commit to in their header
+func (u UTXOSet) Commitment() ([]byte, error) {
+	hash, err := u.hash()
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(), nil
+}
+
+// CommitmentAfter is the hash the UTXO set would have with a block extending
+// its tip applied, the block needs neither a hash nor a proof of work
+func (u UTXOSet) CommitmentAfter(block *Block) ([]byte, error) {
+	hash, err := u.hash()
+	if err != nil {
+		return nil, err
+	}
+	var undo blockUndo
+	created := make(map[string]*CoinTransaction)
+	spent := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinTransaction() {
+			for _, in := range tx.Inputs {
+				outpoint := Outpoint{in.ID, in.Out}
+				if spent[outpoint.String()] {
+					continue
+				}
+				spent[outpoint.String()] = true
+				if parent, ok := created[string(in.ID)]; ok {
+					if in.Out >= 0 && in.Out < len(parent.Outputs) {
+						undo.Spent = append(undo.Spent, UnspentOutput{outpoint, parent.Outputs[in.Out], block.Height})
+					}
+					continue
+				}
+				outs, found, err := u.outputs(in.ID)
+				if err != nil {
+					return nil, err
+				}
+				if out, ok := outs.Find(in.Out); found && ok {
+					undo.Spent = append(undo.Spent, UnspentOutput{outpoint, out, outs.Height})
+				}
+			}
+		}
+		created[string(tx.ID)] = tx
+	}
+	hash.applyBlock(block, undo)
+	return hash.Sum(), nil
+}
@@ -0,0 +1,253 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/pkg/errors"
+	"sort"
+)
+
+// CheckBlockSize validates the block and every transaction in it fit the size
+// limits of the chain parameters. Errors wrap ErrInvalidBlock.
+func CheckBlockSize(block *Block, p *params.ChainParams) error {
+	if size := len(block.Serialize()); size > p.MaxBlockSize {
+		return errors.Wrapf(ErrInvalidBlock, "block %x has %d bytes, the limit is %d", block.Hash, size, p.MaxBlockSize)
+	}
+	for _, tx := range block.Transactions {
+		if size := tx.Size(); size > p.MaxTxSize {
+			return errors.Wrapf(ErrInvalidBlock, "transaction %x of block %x has %d bytes, the limit is %d", tx.ID, block.Hash, size, p.MaxTxSize)
+		}
+	}
+	return nil
+}
+
+// CheckBlock validates what a block says about itself: it has between one
+// and ChainParams.MaxBlockTxs transactions, the first one is the only
+// coinbase, it fits the size limits, see CheckBlockSize, its hash is the proof
+// of work over its contents, so it also covers the merkle root of the
+// transactions, and every transaction ID is the hash of the transaction before
+// it was signed. The cheap checks come first, a block from a peer is not
+// hashed before its shape is known to be sound. Errors wrap ErrInvalidBlock.
+func CheckBlock(block *Block, p *params.ChainParams) error {
+	if len(block.Transactions) > p.MaxBlockTxs {
+		return errors.Wrapf(ErrInvalidBlock, "block %x has %d transactions, the limit is %d", block.Hash, len(block.Transactions), p.MaxBlockTxs)
+	}
+	for i, tx := range block.Transactions {
+		if tx == nil {
+			return errors.Wrapf(ErrInvalidBlock, "transaction %d of block %x is missing", i, block.Hash)
+		}
+	}
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinTransaction() {
+		return errors.Wrapf(ErrInvalidBlock, "block %x does not start with a coinbase", block.Hash)
+	}
+	for _, tx := range block.Transactions[1:] {
+		if tx.IsCoinTransaction() {
+			return errors.Wrapf(ErrInvalidBlock, "block %x has a second coinbase %x", block.Hash, tx.ID)
+		}
+	}
+	if err := CheckBlockSize(block, p); err != nil {
+		return err
+	}
+	pow := NewProof(block, p.Difficulty)
+	if bytes.Compare(pow.Hash(), block.Hash) != 0 {
+		return errors.Wrapf(ErrInvalidBlock, "block %x does not match the hash of its header and transactions", block.Hash)
+	}
+	if !pow.Validate() {
+		return errors.Wrapf(ErrInvalidBlock, "block %x has an invalid proof of work", block.Hash)
+	}
+	for _, tx := range block.Transactions {
+		if bytes.Compare(unsignedHash(tx), tx.ID) != 0 {
+			return errors.Wrapf(ErrInvalidBlock, "transaction %x of block %x does not hash to its ID", tx.ID, block.Hash)
+		}
+	}
+	return nil
+}
+
+// unsignedHash hashes a transaction without the signatures of its inputs, which
+// is how its ID is computed before signing
+func unsignedHash(tx *CoinTransaction) []byte {
+	txCopy := *tx
+	txCopy.Inputs = make([]CoinTxInput, len(tx.Inputs))
+	for i, in := range tx.Inputs {
+		txCopy.Inputs[i] = CoinTxInput{in.ID, in.Out, nil, in.PubKey}
+	}
+	return txCopy.Hash()
+}
+
+// medianTimestamp returns the median of timestamps, which it sorts
+func medianTimestamp(timestamps []int64) int64 {
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// MedianTimePast returns the median timestamp of the block with hash and the
+// ones below it, ChainParams.MedianTimeBlocks blocks or all of them near the genesis
+func (chain *BlockChain) MedianTimePast(hash []byte) (int64, error) {
+	n := chain.Params.MedianTimeBlocks
+	if n <= 0 {
+		n = 1
+	}
+	timestamps := make([]int64, 0, n)
+	for len(timestamps) < n {
+		block, err := readBlock(chain.Database, chain.blockCache, hash)
+		if err != nil {
+			return 0, errors.Wrap(err, "error computing the median time past")
+		}
+		timestamps = append(timestamps, block.Timestamp)
+		if len(block.PrevHash) == 0 {
+			break
+		}
+		hash = block.PrevHash
+	}
+	return medianTimestamp(timestamps), nil
+}
+
+// minTimestamp returns the earliest timestamp CheckBlockTime accepts for a
+// block on top of the one with prevHash, 0 when any will do
+func (chain *BlockChain) minTimestamp(prevHash []byte) (int64, error) {
+	if chain.Params.MedianTimeBlocks <= 0 {
+		return 0, nil
+	}
+	median, err := chain.MedianTimePast(prevHash)
+	if err != nil {
+		return 0, err
+	}
+	return median + 1, nil
+}
+
+// CheckBlockTime validates the timestamp of a block against its parent and the
+// clock: it must be later than the median time past of the parent and at most
+// ChainParams.MaxFutureBlockTime seconds ahead of the network time, so miners
+// can not move the time of the chain back or far ahead. Errors wrap ErrInvalidBlock.
+func (chain *BlockChain) CheckBlockTime(block *Block) error {
+	if limit := chain.Params.MaxFutureBlockTime; limit > 0 {
+		if now := chain.clock.Now().Unix(); block.Timestamp > now+limit {
+			return errors.Wrapf(ErrInvalidBlock, "block %x is %d seconds ahead of the network time", block.Hash, block.Timestamp-now)
+		}
+	}
+	if len(block.PrevHash) == 0 {
+		return nil
+	}
+	earliest, err := chain.minTimestamp(block.PrevHash)
+	if err != nil {
+		return err
+	}
+	if block.Timestamp < earliest {
+		return errors.Wrapf(ErrInvalidBlock, "block %x has timestamp %d, not after the median time past %d", block.Hash, block.Timestamp, earliest-1)
+	}
+	return nil
+}
+
+// ValidateBlock checks a block extending the tip of the chain: CheckBlock, its
+// height, its timestamp, see CheckBlockTime, and the transactions against the
+// UTXO set, see checkTransactions. Errors wrap ErrInvalidBlock.
+func (chain *BlockChain) ValidateBlock(block *Block) error {
+	if err := CheckBlock(block, chain.Params); err != nil {
+		return err
+	}
+	if bytes.Compare(block.PrevHash, chain.LastHash()) != 0 {
+		return errors.Wrapf(ErrInvalidBlock, "block %x does not extend the tip %x", block.Hash, chain.LastHash())
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	if block.Height != bestHeight+1 {
+		return errors.Wrapf(ErrInvalidBlock, "block %x has height %d instead of %d", block.Hash, block.Height, bestHeight+1)
+	}
+	if err := chain.CheckBlockTime(block); err != nil {
+		return err
+	}
+	return chain.checkTransactions(block)
+}
+
+// checkTransactions validates the transactions of a block against the UTXO set
+// of its parent: every input spends an existing output once, is signed by its
+// owner, no transaction creates more than it spends, the coinbase collects
+// at most the block reward and the fees and the UTXO commitment matches.
+func (chain *BlockChain) checkTransactions(block *Block) error {
+	UTXOSet := UTXOSet{BlockChain: chain}
+	created := make(map[string]*CoinTransaction)
+	spent := make(map[string]bool)
+	fees := 0
+
+	for _, tx := range block.Transactions[1:] {
+		prevTXs := make(map[string]CoinTransaction)
+		inValue := 0
+		for _, in := range tx.Inputs {
+			outpoint := Outpoint{in.ID, in.Out}
+			if spent[outpoint.String()] {
+				return errors.Wrapf(ErrInvalidBlock, "input %s of transaction %x is spent twice in the block", outpoint, tx.ID)
+			}
+			spent[outpoint.String()] = true
+
+			var prevTX CoinTransaction
+			if parent, ok := created[hex.EncodeToString(in.ID)]; ok {
+				prevTX = *parent
+			} else {
+				outs, found, err := UTXOSet.outputs(in.ID)
+				if err != nil {
+					return err
+				}
+				if !found {
+					return errors.Wrapf(ErrInvalidBlock, "input %s of transaction %x is missing or already spent", outpoint, tx.ID)
+				}
+				prevTX = outs.transaction(in.ID)
+			}
+			if in.Out < 0 || in.Out >= len(prevTX.Outputs) || prevTX.Outputs[in.Out].PubKeyHash == nil {
+				return errors.Wrapf(ErrInvalidBlock, "input %s of transaction %x is missing or already spent", outpoint, tx.ID)
+			}
+			out := prevTX.Outputs[in.Out]
+			if !in.UsesKey(out.PubKeyHash) {
+				return errors.Wrapf(ErrInvalidBlock, "input %s of transaction %x is not signed by the owner of the output", outpoint, tx.ID)
+			}
+			inValue += out.Value
+			prevTXs[hex.EncodeToString(in.ID)] = prevTX
+		}
+
+		outValue := 0
+		for _, out := range tx.Outputs {
+			if out.Value <= 0 {
+				return errors.Wrapf(ErrInvalidBlock, "transaction %x has an output without a positive value", tx.ID)
+			}
+			outValue += out.Value
+		}
+		if outValue > inValue {
+			return errors.Wrapf(ErrInvalidBlock, "transaction %x spends %d but its inputs are only worth %d", tx.ID, outValue, inValue)
+		}
+		valid, err := tx.Verify(prevTXs)
+		if err != nil {
+			return errors.Wrapf(ErrInvalidBlock, "transaction %x can not be verified: %v", tx.ID, err)
+		}
+		if !valid {
+			return errors.Wrapf(ErrInvalidBlock, "transaction %x has an invalid signature", tx.ID)
+		}
+		fees += inValue - outValue
+		created[hex.EncodeToString(tx.ID)] = tx
+	}
+
+	reward := 0
+	for _, out := range block.Transactions[0].Outputs {
+		if out.Value <= 0 {
+			return errors.Wrapf(ErrInvalidBlock, "the coinbase of block %x has an output without a positive value", block.Hash)
+		}
+		reward += out.Value
+	}
+	if limit := chain.Params.BlockReward + fees; reward > limit {
+		return errors.Wrapf(ErrInvalidBlock, "the coinbase of block %x collects %d, more than the reward and fees of %d", block.Hash, reward, limit)
+	}
+
+	required := chain.Params.UTXOCommitmentHeight
+	if len(block.UTXOCommitment) == 0 && (required == 0 || block.Height < required) {
+		return nil
+	}
+	commitment, err := UTXOSet.CommitmentAfter(block)
+	if err != nil {
+		return err
+	}
+	if bytes.Compare(commitment, block.UTXOCommitment) != 0 {
+		return errors.Wrapf(ErrInvalidBlock, "block %x commits to the UTXO set %x instead of %x", block.Hash, block.UTXOCommitment, commitment)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package blockchain
+
+import (
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestCheckBlockMalformed feeds CheckBlock blocks a peer could send, none of
+// them may panic the node
+func TestCheckBlockMalformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chain, pool, wallets, address := newTestChain(t, dir)
+	defer chain.Close()
+	w := wallets.Wallets[address]
+
+	coin := testCoin(t, chain, w)
+	spend := newTestTx(t, pool, w, []Outpoint{coin.Outpoint}, coin.Value-1000)
+	if err := pool.Add(spend); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := NewBlockTemplate(pool, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := tmpl.Solve()
+	if err := CheckBlock(valid, chain.Params); err != nil {
+		t.Fatalf("a mined block is invalid: %v", err)
+	}
+	coinbase := valid.Transactions[0]
+
+	withTransactions := func(txs ...*CoinTransaction) *Block {
+		block := *valid
+		block.Transactions = txs
+		return &block
+	}
+	wrongNonce := *valid
+	wrongNonce.Nonce++
+	wrongID := *spend
+	wrongID.ID = []byte("not the hash of the transaction")
+	few := *chain.Params
+	few.MaxBlockTxs = 4
+
+	tests := []struct {
+		name  string
+		block *Block
+		p     *params.ChainParams
+	}{
+		{"empty block", &Block{}, chain.Params},
+		{"no transactions", withTransactions(), chain.Params},
+		{"missing transaction", withTransactions(coinbase, nil), chain.Params},
+		{"no coinbase", withTransactions(spend), chain.Params},
+		{"second coinbase", withTransactions(coinbase, spend, coinbase), chain.Params},
+		{"too many transactions", withTransactions(coinbase, spend, spend, spend, spend), &few},
+		{"five transactions", withTransactions(coinbase, spend, spend, spend, spend), chain.Params},
+		{"wrong nonce", &wrongNonce, chain.Params},
+		{"wrong transaction ID", withTransactions(coinbase, &wrongID), chain.Params},
+	}
+	for _, test := range tests {
+		if err := CheckBlock(test.block, test.p); errors.Cause(err) != ErrInvalidBlock {
+			t.Errorf("%s: got %v, want an invalid block", test.name, err)
+		}
+	}
+}
+
+func TestCheckBlockSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chain, pool, wallets, address := newTestChain(t, dir)
+	defer chain.Close()
+	w := wallets.Wallets[address]
+
+	coin := testCoin(t, chain, w)
+	spend := newTestTx(t, pool, w, []Outpoint{coin.Outpoint}, coin.Value-1000)
+	if err := pool.Add(spend); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := NewBlockTemplate(pool, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := tmpl.Solve()
+	blockSize := len(block.Serialize())
+	txSize := 0
+	for _, tx := range block.Transactions {
+		if tx.Size() > txSize {
+			txSize = tx.Size()
+		}
+	}
+
+	limits := func(maxBlockSize, maxTxSize int) *params.ChainParams {
+		p := *chain.Params
+		p.MaxBlockSize, p.MaxTxSize = maxBlockSize, maxTxSize
+		return &p
+	}
+	tests := []struct {
+		name  string
+		p     *params.ChainParams
+		valid bool
+	}{
+		{"within the limits", chain.Params, true},
+		{"at the limits", limits(blockSize, txSize), true},
+		{"block too large", limits(blockSize-1, txSize), false},
+		{"transaction too large", limits(blockSize, txSize-1), false},
+	}
+	for _, test := range tests {
+		err := CheckBlockSize(block, test.p)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && errors.Cause(err) != ErrInvalidBlock {
+			t.Errorf("%s: got %v, want an invalid block", test.name, err)
+		}
+	}
+
+	// a block too large is not connected
+	chain.Params = limits(blockSize/2, txSize)
+	if _, err := tmpl.Mine(pool); errors.Cause(err) != ErrInvalidBlock {
+		t.Errorf("got %v, want an invalid block", err)
+	}
+	if height, err := chain.GetBestHeight(); err != nil || height != 0 {
+		t.Errorf("the chain is at height %d, %v, want the genesis", height, err)
+	}
+}
+
+// mineTestBlockAt mines a template from the pool paying address with timestamp
+func mineTestBlockAt(t *testing.T, pool *Mempool, address string, timestamp int64) *Block {
+	tmpl, err := NewBlockTemplate(pool, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := createBlockAt(timestamp, tmpl.Transactions, tmpl.PrevHash, tmpl.Height, tmpl.Difficulty, tmpl.UTXOCommitment)
+	if _, err := ConnectBlock(pool, block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestMedianTimePast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chain, pool, _, address := newTestChain(t, dir)
+	defer chain.Close()
+	genesis, err := chain.GetBlock(chain.GenesisHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := genesis.Timestamp
+
+	if median, err := chain.MedianTimePast(genesis.Hash); err != nil || median != base {
+		t.Errorf("median time past of the genesis is %d, %v, want %d", median, err, base)
+	}
+	// every block is after the median of its parent, not after the parent itself
+	var tip *Block
+	for _, offset := range []int64{100, 300, 200, 400, 350, 500, 450, 600, 550, 700, 650, 800} {
+		tip = mineTestBlockAt(t, pool, address, base+offset)
+	}
+	// the median of the last 11 blocks, the genesis and the first one are left out
+	if median, err := chain.MedianTimePast(tip.Hash); err != nil || median != base+500 {
+		t.Errorf("median time past of the tip is %d, %v, want %d", median-base, err, 500)
+	}
+
+	now := chain.NetworkTime().Now().Unix()
+	tests := []struct {
+		name      string
+		timestamp int64
+		valid     bool
+	}{
+		{"before the median time past", base + 499, false},
+		{"at the median time past", base + 500, false},
+		{"after the median time past", base + 501, true},
+		{"before the parent", base + 700, true},
+		{"at the future limit", now + chain.Params.MaxFutureBlockTime, true},
+		{"too far ahead", now + chain.Params.MaxFutureBlockTime + 60, false},
+	}
+	for _, test := range tests {
+		block := &Block{Hash: []byte(test.name), PrevHash: tip.Hash, Height: tip.Height + 1, Timestamp: test.timestamp}
+		err := chain.CheckBlockTime(block)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && errors.Cause(err) != ErrInvalidBlock {
+			t.Errorf("%s: got %v, want an invalid block", test.name, err)
+		}
+	}
+
+	// a template on the tip starts at the earliest valid timestamp
+	tmpl, err := NewBlockTemplate(pool, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.MinTimestamp != base+501 {
+		t.Errorf("the template starts at %d, want %d", tmpl.MinTimestamp-base, 501)
+	}
+}
@@ -0,0 +1,227 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+)
+
+// Levels of VerifyChain, every level includes the checks of the ones below it
+const (
+	// VerifyHeaders checks the headers link up from the genesis to the tip, carry
+	// their proof of work and are timestamped after their median time past
+	VerifyHeaders = iota
+	// VerifyBlocks checks the contents of every block, see CheckBlock
+	VerifyBlocks
+	// VerifyTransactions replays the chain checking signatures, spends and subsidies like ValidateBlock
+	VerifyTransactions
+	// VerifyUTXO compares the UTXO set derived by the replay with the stored one
+	VerifyUTXO
+)
+
+// VerifyChain checks the best chain from the genesis to the tip at level, one
+// of the Verify constants. It fails on the first block breaking a rule with an
+// error naming the block and wrapping ErrInvalidBlock, a stored UTXO set
+// differing from the derived one fails with ErrCorruptData. The replay of the
+// higher levels keeps its UTXO set in memory and needs every block, on a
+// pruned chain they fail with ErrPruned. Progress, when set, is called after every block.
+func (chain *BlockChain) VerifyChain(level int, progress func(height, bestHeight int)) error {
+	if level < VerifyHeaders || level > VerifyUTXO {
+		return errors.Errorf("verification level %d is not between %d and %d", level, VerifyHeaders, VerifyUTXO)
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	pruned, err := chain.PruneHeight()
+	if err != nil {
+		return err
+	}
+	if pruned > 0 && level >= VerifyTransactions {
+		return errors.Wrapf(ErrPruned, "can not replay the chain, blocks below height %d are pruned", pruned)
+	}
+	if level >= VerifyUTXO {
+		if err := (UTXOSet{BlockChain: chain}).flushCache(); err != nil {
+			return err
+		}
+	}
+
+	// the replay runs on a chain of its own, its transactions are checked against the derived UTXO set
+	replay := &BlockChain{Database: storage.NewMemory(), Params: chain.Params}
+	defer replay.Database.Close()
+
+	var prev *Block
+	// timestamps of the blocks below the current one, up to MedianTimeBlocks
+	var recent []int64
+	for height := 0; height <= bestHeight; height++ {
+		var block *Block
+		err := chain.Database.View(func(txn storage.Txn) error {
+			hash, err := txn.Get(heightKey(height))
+			if err != nil {
+				return errors.Wrapf(err, "error getting the block at height %d", height)
+			}
+			data, err := txn.Get(hash)
+			if err != nil {
+				return errors.Wrapf(err, "error getting block %x", hash)
+			}
+			block, err = Deserialize(data)
+			if err == nil && bytes.Compare(block.Hash, hash) != 0 {
+				err = errors.Wrapf(ErrInvalidBlock, "block %x is stored as %x", block.Hash, hash)
+			}
+			return err
+		})
+		if err == nil {
+			err = chain.verifyBlock(replay, prev, block, level, height < pruned)
+		}
+		if err == nil {
+			err = chain.verifyBlockTime(block, recent)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "verification failed at height %d", height)
+		}
+		prev = block
+		if recent = append(recent, block.Timestamp); len(recent) > chain.Params.MedianTimeBlocks {
+			recent = recent[1:]
+		}
+		if progress != nil {
+			progress(height, bestHeight)
+		}
+	}
+	if bytes.Compare(prev.Hash, chain.LastHash()) != 0 {
+		return errors.Wrapf(ErrInvalidBlock, "the best chain ends at %x, not at the tip %x", prev.Hash, chain.LastHash())
+	}
+	if level >= VerifyUTXO {
+		return chain.compareUTXO(replay)
+	}
+	return nil
+}
+
+// verifyBlock checks block, the one at its height of the best chain, against
+// prev below it. A pruned block only has its header checked.
+func (chain *BlockChain) verifyBlock(replay *BlockChain, prev, block *Block, level int, pruned bool) error {
+	if prev == nil {
+		if len(block.PrevHash) != 0 || bytes.Compare(block.Hash, chain.GenesisHash) != 0 {
+			return errors.Wrapf(ErrInvalidBlock, "block %x is not the genesis %x", block.Hash, chain.GenesisHash)
+		}
+		if err := checkGenesis(chain.Params, block.Hash); err != nil {
+			return err
+		}
+	} else if bytes.Compare(block.PrevHash, prev.Hash) != 0 {
+		return errors.Wrapf(ErrInvalidBlock, "block %x does not link to %x below it", block.Hash, prev.Hash)
+	}
+	if prev != nil && block.Height != prev.Height+1 || prev == nil && block.Height != 0 {
+		return errors.Wrapf(ErrInvalidBlock, "block %x has the wrong height %d", block.Hash, block.Height)
+	}
+
+	if level == VerifyHeaders || pruned {
+		pow := NewProof(block, chain.Params.Difficulty)
+		if !pow.MeetsTarget() {
+			return errors.Wrapf(ErrInvalidBlock, "block %x has an invalid proof of work", block.Hash)
+		}
+		if !pruned && bytes.Compare(pow.Hash(), block.Hash) != 0 {
+			return errors.Wrapf(ErrInvalidBlock, "block %x does not match the hash of its header and transactions", block.Hash)
+		}
+		return nil
+	}
+	if err := CheckBlock(block, chain.Params); err != nil {
+		return err
+	}
+	if level == VerifyBlocks {
+		return nil
+	}
+
+	if prev != nil {
+		if err := replay.checkTransactions(block); err != nil {
+			return err
+		}
+	}
+	return replay.Database.Update(func(txn storage.Txn) error {
+		_, err := applyBlock(txn, block)
+		return err
+	})
+}
+
+// verifyBlockTime checks a block is timestamped after the median of recent,
+// the timestamps of the blocks below it, see CheckBlockTime
+func (chain *BlockChain) verifyBlockTime(block *Block, recent []int64) error {
+	if chain.Params.MedianTimeBlocks <= 0 || len(recent) == 0 {
+		return nil
+	}
+	median := medianTimestamp(append([]int64{}, recent...))
+	if block.Timestamp <= median {
+		return errors.Wrapf(ErrInvalidBlock, "block %x has timestamp %d, not after the median time past %d", block.Hash, block.Timestamp, median)
+	}
+	return nil
+}
+
+// compareUTXO fails with ErrCorruptData when the UTXO set of the chain differs
+// from the one the replay derived
+func (chain *BlockChain) compareUTXO(replay *BlockChain) error {
+	derived := make(map[string][]byte)
+	err := replay.Database.View(func(txn storage.Txn) error {
+		it := txn.NewIterator(storage.IteratorOptions{Prefix: utxoPrefix})
+		defer it.Close()
+		for ; it.Valid(); it.Next() {
+			v, err := it.Value()
+			if err != nil {
+				return err
+			}
+			derived[hex.EncodeToString(it.Key()[prefixLength:])] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	derivedHash, err := UTXOSet{BlockChain: replay}.hash()
+	if err != nil {
+		return err
+	}
+
+	return chain.Database.View(func(txn storage.Txn) error {
+		utxoTip, err := txn.Get([]byte(utxoTipKey))
+		if err != nil && err != storage.ErrKeyNotFound {
+			return err
+		}
+		if bytes.Compare(utxoTip, chain.LastHash()) != 0 {
+			return errors.Wrapf(ErrCorruptData, "the UTXO set is at block %x instead of the tip", utxoTip)
+		}
+		it := txn.NewIterator(storage.IteratorOptions{Prefix: utxoPrefix})
+		defer it.Close()
+		for ; it.Valid(); it.Next() {
+			ID := hex.EncodeToString(it.Key()[prefixLength:])
+			v, err := it.Value()
+			if err != nil {
+				return err
+			}
+			expected, ok := derived[ID]
+			if !ok {
+				return errors.Wrapf(ErrCorruptData, "the UTXO set has outputs of %s, which are spent or do not exist", ID)
+			}
+			stored, err := DeserializeOutputs(v)
+			if err != nil {
+				return errors.Wrapf(err, "the outputs of %s", ID)
+			}
+			want, err := DeserializeOutputs(expected)
+			if err != nil {
+				return err
+			}
+			if bytes.Compare(stored.Serialize(), want.Serialize()) != 0 {
+				return errors.Wrapf(ErrCorruptData, "the UTXO set has different outputs of %s", ID)
+			}
+			delete(derived, ID)
+		}
+		for ID := range derived {
+			return errors.Wrapf(ErrCorruptData, "the UTXO set misses the outputs of %s", ID)
+		}
+		storedHash, err := utxoHash(txn)
+		if err != nil {
+			return err
+		}
+		if bytes.Compare(storedHash.Sum(), derivedHash.Sum()) != 0 {
+			return errors.Wrapf(ErrCorruptData, "the UTXO set hash %x differs from the derived %x", storedHash.Sum(), derivedHash.Sum())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,126 @@
+package blockchain
+
+import (
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// newVerifyTestChain creates a chain with a few blocks of transactions, it
+// returns the spend mined in the last block
+func newVerifyTestChain(t *testing.T, dir string) (*BlockChain, *Mempool, string, *CoinTransaction) {
+	chain, pool, wallets, address := newTestChain(t, dir)
+	w := wallets.Wallets[address]
+	coins := splitTestCoins(t, pool, w, address, 2, 100000)
+	mineTestBlocks(t, pool, address, 2)
+	spend := newTestTxWithFee(t, pool, w, coins[0], 1, 1000)
+	if err := pool.Add(spend); err != nil {
+		t.Fatal(err)
+	}
+	mineTestBlocks(t, pool, address, 1)
+	return chain, pool, address, spend
+}
+
+func TestVerifyChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chain, _, _, _ := newVerifyTestChain(t, dir)
+	defer chain.Close()
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for level := VerifyHeaders; level <= VerifyUTXO; level++ {
+		var heights []int
+		err := chain.VerifyChain(level, func(height, best int) {
+			if best != bestHeight {
+				t.Errorf("level %d: best height %d, want %d", level, best, bestHeight)
+			}
+			heights = append(heights, height)
+		})
+		if err != nil {
+			t.Errorf("level %d: %v", level, err)
+		}
+		if len(heights) != bestHeight+1 || heights[bestHeight] != bestHeight {
+			t.Errorf("level %d: progress at heights %v", level, heights)
+		}
+	}
+	for _, level := range []int{VerifyHeaders - 1, VerifyUTXO + 1} {
+		if err := chain.VerifyChain(level, nil); err == nil {
+			t.Errorf("level %d was accepted", level)
+		}
+	}
+}
+
+func TestVerifyChainRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		// corrupt breaks the chain, verification fails from level on
+		corrupt func(t *testing.T, chain *BlockChain, pool *Mempool, address string, spend *CoinTransaction)
+		level   int
+		want    error
+	}{
+		{"tampered block", func(t *testing.T, chain *BlockChain, pool *Mempool, address string, spend *CoinTransaction) {
+			block, err := chain.BlockByHeight(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block.Timestamp++
+			err = chain.Database.Update(func(txn storage.Txn) error {
+				return txn.Set(block.Hash, block.Serialize())
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			chain.BlockCache().invalidate(block.Hash)
+		}, VerifyHeaders, ErrInvalidBlock},
+		{"block spending a spent output", func(t *testing.T, chain *BlockChain, pool *Mempool, address string, spend *CoinTransaction) {
+			tmpl, err := NewBlockTemplate(pool, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tmpl.Transactions = append(tmpl.Transactions, spend)
+			// stored without the validation of ConnectBlock
+			if err := chain.AddBlock(tmpl.Solve()); err != nil {
+				t.Fatal(err)
+			}
+		}, VerifyTransactions, ErrInvalidBlock},
+		{"missing unspent outputs", func(t *testing.T, chain *BlockChain, pool *Mempool, address string, spend *CoinTransaction) {
+			if err := (UTXOSet{BlockChain: chain}).flushCache(); err != nil {
+				t.Fatal(err)
+			}
+			err := chain.Database.Update(func(txn storage.Txn) error {
+				return txn.Delete(utxoKey(spend.ID))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, VerifyUTXO, ErrCorruptData},
+	}
+	for _, test := range tests {
+		chain, pool, address, spend := newVerifyTestChain(t, dir)
+		test.corrupt(t, chain, pool, address, spend)
+		for level := VerifyHeaders; level <= VerifyUTXO; level++ {
+			err := chain.VerifyChain(level, nil)
+			if level < test.level && err != nil {
+				t.Errorf("%s at level %d: %v", test.name, level, err)
+			}
+			if level >= test.level && errors.Cause(err) != test.want {
+				t.Errorf("%s at level %d: got %v, want %v", test.name, level, err, test.want)
+			}
+		}
+		chain.Close()
+	}
+}
@@ -1,134 +1,749 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"github.com/AntonBozhinov/sentinel/blockchain"
+	"github.com/AntonBozhinov/sentinel/network"
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/storage"
 	"github.com/AntonBozhinov/sentinel/wallet"
-	"log"
+	"github.com/pkg/errors"
 	"os"
-	"runtime"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 // CommandLine application
-type CommandLine struct {}
+type CommandLine struct {
+	dataDir        string
+	params         *params.ChainParams
+	utxoCacheSize  int
+	blockCacheSize int
+	pruneDepth     int
+	maintenance    storage.MaintenanceOptions
+}
+
+// chainOptions opens chains of the network in the data directory given on the command line
+func (cli *CommandLine) chainOptions() blockchain.Options {
+	return blockchain.Options{
+		DataDir:        cli.dataDir,
+		Params:         cli.params,
+		UTXOCacheSize:  cli.utxoCacheSize,
+		BlockCacheSize: cli.blockCacheSize,
+		PruneDepth:     cli.pruneDepth,
+		Maintenance:    cli.maintenance,
+	}
+}
+
+// printCacheStats prints how well the caches of the chain did
+func printCacheStats(chain *blockchain.BlockChain) {
+	if cache := chain.UTXOCache(); cache != nil {
+		stats := cache.Stats()
+		fmt.Printf("UTXO cache: %d transactions, %d to flush, %.1f%% hits, %d flushes\n",
+			stats.Entries, stats.Dirty, 100*stats.HitRate(), stats.Flushes)
+	}
+	if cache := chain.BlockCache(); cache != nil {
+		stats := cache.Stats()
+		fmt.Printf("Block cache: %d blocks in %d bytes, %d hits, %d misses, %.1f%% hits, %d evicted\n",
+			stats.Entries, stats.Bytes, stats.Hits, stats.Misses, 100*stats.HitRate(), stats.Evictions)
+	}
+}
+
+// reportMaintenance prints the disk usage after a background maintenance run of the database
+func reportMaintenance(report storage.MaintenanceReport) {
+	if report.Err != nil {
+		fmt.Printf("Database maintenance failed: %v\n", report.Err)
+		return
+	}
+	fmt.Printf("Database uses %d bytes, %d in tables and %d in the value log, garbage collection rewrote %d files\n",
+		report.After.Total(), report.After.LSM, report.After.ValueLog, report.Rewrites)
+}
+
+// openWallets opens the wallets of the network in the data directory given on the command line
+func (cli *CommandLine) openWallets() (*wallet.Wallets, error) {
+	return wallet.OpenWallets(cli.dataDir, cli.params.AddressVersion)
+}
 
 func (cli *CommandLine) printUsage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: [-datadir DIR] [-network NAME | -params FILE] COMMAND")
+	fmt.Println(" -datadir DIR - keep the chain and the wallets in DIR (default ./tmp)")
+	fmt.Printf(" -network NAME - run on one of the networks %v, other networks than mainnet keep their data in DIR/NAME\n", params.Networks())
+	fmt.Println(" -params FILE - run on the network described by a JSON chain parameters file")
+	fmt.Println(" -utxocache N - keep up to N transactions of the UTXO set in memory, -1 disables the cache")
+	fmt.Println(" -blockcache BYTES - keep up to BYTES of recently read blocks decoded in memory, -1 disables the cache")
+	fmt.Printf(" -prune N - keep only the last N blocks whole, at least %d, older ones are reduced to headers\n", blockchain.MinPruneDepth)
+	fmt.Printf(" -dbgcinterval DURATION - garbage collect the value log of the database this often (default %v), a negative interval disables it\n", storage.DefaultMaintenanceInterval)
+	fmt.Printf(" -dbgcratio R - rewrite value log files with at least this share of stale data (default %v)\n", storage.DefaultDiscardRatio)
+	fmt.Println(" -dbgcminsize BYTES - skip the periodic garbage collection while the value log is smaller")
+	fmt.Println("Commands:")
 	fmt.Println(" balance -address ADDRESS - get balance from an address")
 	fmt.Println(" create -blockchain ADDRESS - create a blockchain for an address")
-	fmt.Println(" print -  prints the blocks in the chain")
-	fmt.Println(" send -from ADDRESS -to ADDRESS -amount AMOUNT - Send coins to from one address to another")
+	fmt.Println(" create -genesis - create a blockchain from the genesis allocations of the chain parameters")
+	fmt.Println(" print [-from HEIGHT] [-to HEIGHT] - prints the blocks in the chain from the genesis up")
+	fmt.Println(" send -from ADDRESS -to ADDRESS -amount AMOUNT [-feerate RATE] [-coinselect largest|smallest|bnb|random] [-inputs TXID:OUT,...] [-node ADDR] [-mine] - Send coins to from one address to another. With -node the transaction is still built and signed on the chain of -datadir and only submitted to the node, so -datadir needs a synced copy of the chain apart from the one the node holds open")
+	fmt.Println(" utxos -address ADDRESS - list the unspent outputs of an address")
+	fmt.Println(" bumpfee -txid TXID -feerate RATE - Raise the fee of a stuck mempool transaction")
+	fmt.Println(" mine -address ADDRESS [-blocks N] - Mine blocks from the mempool, N = 0 mines forever")
+	fmt.Println(" startnode [-port PORT] [-miner ADDRESS] - Start a node, mining to ADDRESS when given")
 	fmt.Println(" reindex - Rebuilds the UTXO set")
+	fmt.Println(" gettxoutsetinfo - show the size, total value and commitment hash of the UTXO set")
+	fmt.Println(" dumputxo -file FILE - write a snapshot of the UTXO set at the tip to FILE")
+	fmt.Println(" loadutxo -file FILE - create the chain from a UTXO set snapshot pinned in the chain parameters")
+	fmt.Printf(" verifychain [-level N] - check the chain from the genesis up, N from %d for the headers to %d for a replay compared with the UTXO set\n", blockchain.VerifyHeaders, blockchain.VerifyUTXO)
+	fmt.Println(" export -file FILE - write the blocks of the chain from the genesis up to FILE")
+	fmt.Println(" import -file FILE - validate and add the blocks exported to FILE, creating the chain when there is none")
+	fmt.Println(" backup -out FILE [-node ADDR] - write a backup of the chain and the wallets to FILE, by the running node at ADDR when given")
+	fmt.Println(" compactdb - garbage collect the value log of the database and show its disk usage")
+	fmt.Println(" restore -file FILE - validate the backup in FILE and replace the chain and the wallets with it")
+}
+
+// errUsage reports that the command line was incomplete, the usage has already been printed
+var errUsage = errors.New("invalid usage")
+
+// exitCode maps the errors returned by the commands to the exit status of the process
+func exitCode(err error) int {
+	switch errors.Cause(err) {
+	case errUsage:
+		return 2
+	case blockchain.ErrNoChain, blockchain.ErrChainExists, blockchain.ErrGenesisMismatch, blockchain.ErrUnknownSnapshot, blockchain.ErrNewerSchema:
+		return 3
+	case blockchain.ErrInsufficientFunds:
+		return 4
+	case wallet.ErrUnknownWallet, wallet.ErrInvalidAddress:
+		return 5
+	case blockchain.ErrBlockNotFound, blockchain.ErrTxNotFound, blockchain.ErrPruned:
+		return 6
+	case blockchain.ErrInvalidTx, blockchain.ErrFeeTooLow, blockchain.ErrTxInMempool, blockchain.ErrInvalidBlock:
+		return 7
+	default:
+		return 1
+	}
 }
 
-func (cli *CommandLine) validateArgs() {
-	if len(os.Args) < 2 {
+func (cli *CommandLine) validateArgs(args []string) error {
+	if len(args) < 1 {
 		cli.printUsage()
-		runtime.Goexit()
+		return errUsage
 	}
+	return nil
 }
 
-func (cli *CommandLine) printChain() {
-	chain := blockchain.Continue("")
-	iter := chain.Iterator()
-	for {
-		block := iter.Next()
+// validateAddress fails with wallet.ErrInvalidAddress naming the role of the address,
+// also when it is valid on another network
+func (cli *CommandLine) validateAddress(role, address string) error {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
+		return errors.Wrapf(wallet.ErrInvalidAddress, "%s address %s is not a %s address", role, address, cli.params.Name)
+	}
+	return nil
+}
+
+// printChain prints the blocks of the best chain from height from to height to, -1 being the tip
+func (cli *CommandLine) printChain(from, to int) error {
+	chain, err := blockchain.Open(cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	pruneHeight, err := chain.PruneHeight()
+	if err != nil {
+		return err
+	}
+	if from < pruneHeight {
+		fmt.Printf("Blocks below height %d are pruned\n", pruneHeight)
+		from = pruneHeight
+	}
+	iter, err := chain.ForwardIterator(from, to)
+	if err != nil {
+		return err
+	}
+	for iter.Valid() {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Height: %d\n", block.Height)
 		fmt.Printf("PrevHash: %x\n", block.PrevHash)
 		fmt.Printf("Nonce: %d\n", block.Nonce)
 		fmt.Printf("Hash: %x\n", block.Hash)
-		pow := blockchain.NewProof(block)
+		if len(block.UTXOCommitment) > 0 {
+			fmt.Printf("UTXO commitment: %x\n", block.UTXOCommitment)
+		}
+		pow := blockchain.NewProof(block, chain.Params.Difficulty)
 		fmt.Printf("Valid: %t\n", pow.Validate())
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
 		}
-		if len(block.PrevHash) == 0 {
-			break
-		}
 	}
+	printCacheStats(chain)
+	return nil
 }
 
-func (cli *CommandLine) reindexUTXO() {
-	chain := blockchain.Continue("")
-	defer chain.Database.Close()
-	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
-	UTXOSet.Reindex()
-	count := UTXOSet.CountTransactions()
+func (cli *CommandLine) reindexUTXO() error {
+	chain, err := blockchain.Open(cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	UTXOSet := blockchain.UTXOSet{
+		BlockChain: chain,
+		Progress: func(height, bestHeight int) {
+			fmt.Printf("\rReplayed %d of %d blocks", height+1, bestHeight+1)
+		},
+	}
+	err = UTXOSet.Reindex()
+	fmt.Println()
+	if err != nil {
+		return err
+	}
+	count, err := UTXOSet.CountTransactions()
+	if err != nil {
+		return err
+	}
 	fmt.Printf("Done! There are %d transactions in the UTXO set. \n", count)
+	return nil
+}
+
+// getTxOutSetInfo prints the summary of the UTXO set
+func (cli *CommandLine) getTxOutSetInfo() error {
+	chain, err := blockchain.Open(cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	info, err := blockchain.UTXOSet{BlockChain: chain}.Info()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Height: %d\n", info.Height)
+	fmt.Printf("Block: %x\n", info.BlockHash)
+	fmt.Printf("Transactions: %d\n", info.Transactions)
+	fmt.Printf("Outputs: %d\n", info.Outputs)
+	fmt.Printf("Total value: %d\n", info.TotalValue)
+	fmt.Printf("Commitment: %x\n", info.Commitment)
+	block, err := chain.BlockByHash(info.BlockHash)
+	if err == nil && len(block.UTXOCommitment) > 0 {
+		fmt.Printf("Committed in the block: %t\n", bytes.Compare(block.UTXOCommitment, info.Commitment) == 0)
+	}
+	return nil
+}
+
+// verifyChain checks the chain at level and reports the first block breaking a rule
+func (cli *CommandLine) verifyChain(level int) error {
+	chain, err := blockchain.Open(cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	err = chain.VerifyChain(level, func(height, bestHeight int) {
+		fmt.Printf("\rVerified %d of %d blocks", height+1, bestHeight+1)
+	})
+	fmt.Println()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("The chain up to %x is valid at level %d\n", chain.LastHash(), level)
+	return nil
+}
+
+// dumpUTXO writes a snapshot of the UTXO set to file and prints the entry
+// pinning it in the chain parameters
+func (cli *CommandLine) dumpUTXO(file string) error {
+	chain, err := blockchain.Open(cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	f, err := os.Create(file)
+	if err != nil {
+		return errors.Wrap(err, "error creating the snapshot file")
+	}
+	info, err := chain.DumpUTXO(f)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "error writing the snapshot file")
+	}
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+	fmt.Printf("Wrote %d transactions at height %d to %s\n", info.Transactions, info.Height, file)
+	fmt.Printf("Pin it in the chain parameters with {\"height\": %d, \"block_hash\": \"%x\", \"hash\": \"%x\"}\n",
+		info.Height, info.BlockHash, info.Hash)
+	return nil
+}
+
+// loadUTXO creates the chain from a snapshot, the blocks below it are backfilled by startnode
+func (cli *CommandLine) loadUTXO(file string) error {
+	chain, info, err := blockchain.LoadUTXO(cli.chainOptions(), file)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	fmt.Printf("Loaded %d transactions at height %d, block %x\n", info.Transactions, info.Height, info.BlockHash)
+	if backfilling, err := chain.Backfilling(); err == nil && backfilling {
+		fmt.Printf("The blocks below height %d are downloaded from peers when the node runs\n", info.Height+1)
+	}
+	return nil
 }
 
-func (cli *CommandLine) createBlockChain(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("address is not valid")
+// exportChain writes the blocks of the chain to file
+func (cli *CommandLine) exportChain(file string) error {
+	chain, err := blockchain.Open(cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	f, err := os.Create(file)
+	if err != nil {
+		return errors.Wrap(err, "error creating the export file")
+	}
+	blocks, err := chain.ExportBlocks(f)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "error writing the export file")
+	}
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+	fmt.Printf("Exported %d blocks to %s\n", blocks, file)
+	return nil
+}
+
+// importChain adds the blocks exported to file to the chain
+func (cli *CommandLine) importChain(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "error opening the export file")
+	}
+	defer f.Close()
+	chain, added, err := blockchain.ImportBlocks(cli.chainOptions(), f)
+	if err != nil {
+		return err
 	}
-	chain := blockchain.InitBlockChain(address)
-	defer chain.Database.Close()
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	defer chain.Close()
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d blocks, the tip is %x at height %d\n", added, chain.LastHash(), bestHeight)
+	return nil
+}
+
+// backup writes a backup to file. A running node holds the database, so with
+// node the backup is taken by the node and checked here once it appears.
+func (cli *CommandLine) backup(file, node string) error {
+	if len(node) == 0 {
+		chain, err := blockchain.Open(cli.chainOptions())
+		if err != nil {
+			return err
+		}
+		defer chain.Close()
+		info, err := chain.BackupFile(file)
+		if err != nil {
+			return err
+		}
+		printBackup("Wrote", file, info)
+		return nil
+	}
+
+	// the node resolves relative paths against its own working directory
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return errors.Wrap(err, "error resolving the backup file")
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error removing the previous backup file")
+	}
+	if err := network.SendBackup(node, file); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(backupTimeout)
+	for {
+		f, err := os.Open(file)
+		if err == nil {
+			info, err := blockchain.CheckBackup(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			printBackup(fmt.Sprintf("%s wrote", node), file, info)
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return errors.Wrap(err, "error opening the backup file")
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("%s did not write the backup within %v, see its log", node, backupTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// backupTimeout bounds how long backup waits for a running node
+const backupTimeout = 10 * time.Minute
+
+func printBackup(action, file string, info blockchain.BackupInfo) {
+	fmt.Printf("%s a backup of %s at height %d, block %x, to %s\n", action, info.Network, info.Height, info.TipHash, file)
+	fmt.Printf("%d database entries, wallets included: %t\n", info.Entries, info.Wallets)
+}
+
+// restore replaces the chain and the wallets with the backup in file
+func (cli *CommandLine) restore(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "error opening the backup file")
+	}
+	defer f.Close()
+	info, err := blockchain.RestoreBackup(cli.chainOptions(), f)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored the backup of %s taken %s, the tip is %x at height %d\n",
+		info.Network, info.Created.Format(time.RFC3339), info.TipHash, info.Height)
+	return nil
+}
+
+// compactDB garbage collects the value log of the database
+func (cli *CommandLine) compactDB() error {
+	chain, err := blockchain.Open(cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	report, err := chain.CompactDB()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rewrote %d value log files\n", report.Rewrites)
+	fmt.Printf("Tables: %d bytes, value log: %d bytes, total: %d bytes, %d bytes reclaimed\n",
+		report.After.LSM, report.After.ValueLog, report.After.Total(), report.Before.Total()-report.After.Total())
+	return nil
+}
+
+// createBlockChain creates the chain of the network, its genesis pays to address
+// unless the chain parameters list genesis allocations
+func (cli *CommandLine) createBlockChain(address string) error {
+	if len(address) > 0 {
+		if err := cli.validateAddress("genesis", address); err != nil {
+			return err
+		}
+	}
+	chain, err := blockchain.Init(cli.chainOptions(), address)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	if err := UTXOSet.Reindex(); err != nil {
+		return err
+	}
+	fmt.Printf("Genesis: %x\n", chain.GenesisHash)
 	fmt.Println("Finished!")
+	return nil
 }
 
-func (cli *CommandLine) getBalance(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("address is not valid")
+func (cli *CommandLine) getBalance(address string) error {
+	if err := cli.validateAddress("account", address); err != nil {
+		return err
+	}
+	pubKeyHash, err := wallet.AddressPublicKeyHash(address)
+	if err != nil {
+		return err
 	}
-	chain := blockchain.Continue(address)
-	defer chain.Database.Close()
+	chain, err := blockchain.Open(cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
 	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
 	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1: len(pubKeyHash) - wallet.ChecksumLength]
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
+	UTXOs, err := UTXOSet.FindUnspentTransactions(pubKeyHash)
+	if err != nil {
+		return err
+	}
 	for _, out := range UTXOs {
 		balance += out.Value
 	}
 	fmt.Printf("Balance of %s: %d\n", address, balance)
+	return nil
 }
 
-func (cli *CommandLine) send(from, to string, amount int) {
-	if !wallet.ValidateAddress(from) {
-		log.Panic("source address is not valid")
+func (cli *CommandLine) listUTXOs(address string) error {
+	if err := cli.validateAddress("account", address); err != nil {
+		return err
 	}
-	if !wallet.ValidateAddress(to) {
-		log.Panic("destination address is not valid")
+	pubKeyHash, err := wallet.AddressPublicKeyHash(address)
+	if err != nil {
+		return err
 	}
-	chain := blockchain.Continue(from)
-	defer chain.Database.Close()
+	chain, err := blockchain.Open(cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
 	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	pool, err := blockchain.NewMempool(chain)
+	if err != nil {
+		return err
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
 
-	tx := blockchain.NewTransaction(from , to, amount, &UTXOSet)
-	// TODO: calculate the amount of the reward dynamically based on time spent mining
-	rTx := blockchain.RewardTransaction(from, "", 10)
-	block := chain.AddBlock([]*blockchain.CoinTransaction{rTx, tx})
-	UTXOSet.Update(block)
-	fmt.Println("Success!")
+	UTXOs, err := UTXOSet.FindUnspentOutputs(pubKeyHash)
+	if err != nil {
+		return err
+	}
+	for _, utxo := range UTXOs {
+		status := ""
+		if pool.IsSpent(utxo.Outpoint) {
+			status = " (spent in mempool)"
+		}
+		fmt.Printf("%s value: %d confirmations: %d%s\n", utxo.Outpoint, utxo.Value, bestHeight-utxo.Height+1, status)
+	}
+	return nil
 }
 
-func (cli *CommandLine) createWallet() {
-	wallets, _ := wallet.CreateWallets()
-	address := wallets.AddWallet()
-	wallets.SaveFile()
+// send builds and signs a transaction on the chain of the data directory and
+// adds it to the mempool there. With node it is also submitted to a running
+// node, which holds its own database open: coins are selected from the local
+// copy of the chain, so it has to be synced for the node to accept them.
+func (cli *CommandLine) send(from, to string, amount, feeRate int, coinSelect, inputs, node string, mineNow bool) error {
+	if err := cli.validateAddress("source", from); err != nil {
+		return err
+	}
+	if err := cli.validateAddress("destination", to); err != nil {
+		return err
+	}
+	wallets, err := cli.openWallets()
+	if err != nil {
+		return err
+	}
+	chain, err := blockchain.Open(cli.chainOptions())
+	if errors.Cause(err) == storage.ErrLocked && len(node) > 0 {
+		return errors.Wrapf(err, "send builds the transaction on the local chain, stop the node or use a -datadir apart from the one of %s", node)
+	}
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	pool, err := blockchain.NewMempool(chain)
+	if err != nil {
+		return err
+	}
+
+	var selector blockchain.CoinSelector
+	if len(inputs) > 0 {
+		var outpoints []blockchain.Outpoint
+		for _, input := range strings.Split(inputs, ",") {
+			outpoint, err := blockchain.ParseOutpoint(strings.TrimSpace(input))
+			if err != nil {
+				return err
+			}
+			outpoints = append(outpoints, outpoint)
+		}
+		pubKeyHash, err := wallet.AddressPublicKeyHash(from)
+		if err != nil {
+			return err
+		}
+		manual, err := blockchain.NewManualSelection(pool, pubKeyHash, outpoints)
+		if err != nil {
+			return err
+		}
+		selector = manual
+	} else {
+		selector, err = blockchain.NewCoinSelector(coinSelect)
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := blockchain.NewTransaction(wallets, from, to, amount, feeRate, selector, pool)
+	if err != nil {
+		return err
+	}
+	if err := pool.Add(tx); err != nil {
+		return errors.Wrap(err, "transaction rejected")
+	}
+	if len(node) > 0 {
+		if err := network.SendTx(node, tx); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Transaction %x submitted\n", tx.ID)
+
+	if mineNow {
+		tmpl, err := blockchain.NewBlockTemplate(pool, from)
+		if err != nil {
+			return err
+		}
+		block, err := tmpl.Mine(pool)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Mined block %x at height %d\n", block.Hash, block.Height)
+	}
+	return nil
+}
+
+func (cli *CommandLine) bumpFee(txID string, feeRate int) error {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		return errors.Wrapf(blockchain.ErrInvalidTx, "transaction id %s is not valid: %v", txID, err)
+	}
+	wallets, err := cli.openWallets()
+	if err != nil {
+		return err
+	}
+	chain, err := blockchain.Open(cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	pool, err := blockchain.NewMempool(chain)
+	if err != nil {
+		return err
+	}
+
+	tx, err := blockchain.BumpFee(pool, wallets, ID, feeRate)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Fee bumped, new transaction: %x\n", tx.ID)
+	return nil
+}
+
+func (cli *CommandLine) mine(address string, blocks int) error {
+	if err := cli.validateAddress("miner", address); err != nil {
+		return err
+	}
+	chain, err := blockchain.Open(cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	pool, err := blockchain.NewMempool(chain)
+	if err != nil {
+		return err
+	}
+
+	for mined := 0; blocks == 0 || mined < blocks; mined++ {
+		tmpl, err := blockchain.NewBlockTemplate(pool, address)
+		if err != nil {
+			return err
+		}
+		block, err := tmpl.Mine(pool)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Mined block %x at height %d with %d transactions and %d in fees\n",
+			block.Hash, block.Height, len(block.Transactions), tmpl.Fees)
+	}
+	printCacheStats(chain)
+	return nil
+}
+
+func (cli *CommandLine) startNode(port, minerAddress string) error {
+	fmt.Printf("Starting node on port %s\n", port)
+	if len(minerAddress) > 0 {
+		if err := cli.validateAddress("miner", minerAddress); err != nil {
+			return err
+		}
+		fmt.Printf("Mining is on, rewards go to %s\n", minerAddress)
+	}
+	chain, err := blockchain.Open(cli.chainOptions())
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+	return network.StartServer(port, minerAddress, chain)
+}
+
+func (cli *CommandLine) createWallet() error {
+	wallets, err := cli.openWallets()
+	if err != nil {
+		return err
+	}
+	address, err := wallets.AddWallet()
+	if err != nil {
+		return err
+	}
+	if err := wallets.SaveFile(); err != nil {
+		return err
+	}
 	fmt.Printf("New wallet address is: %s\n", address)
+	return nil
 }
 
-func (cli *CommandLine) listAddresses() {
-	wallets, _ := wallet.CreateWallets()
+func (cli *CommandLine) listAddresses() error {
+	wallets, err := cli.openWallets()
+	if err != nil {
+		return err
+	}
 	addresses := wallets.GetAllAddresses()
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
+	return nil
 }
 
-func (cli *CommandLine) run() {
-	cli.validateArgs()
+func (cli *CommandLine) run() error {
+	globalCmd := flag.NewFlagSet("sentinel", flag.ExitOnError)
+	dataDir := globalCmd.String("datadir", blockchain.DefaultDataDir, "Directory holding the chain and the wallets")
+	networkName := globalCmd.String("network", params.Mainnet.Name, "Network to run on")
+	paramsFile := globalCmd.String("params", "", "JSON file with the parameters of a custom network")
+	utxoCacheSize := globalCmd.Int("utxocache", blockchain.DefaultUTXOCacheSize, "Transactions of the UTXO set kept in memory, -1 disables the cache")
+	blockCacheSize := globalCmd.Int("blockcache", blockchain.DefaultBlockCacheSize, "Bytes of blocks kept decoded in memory, -1 disables the cache")
+	pruneDepth := globalCmd.Int("prune", 0, "Number of recent blocks kept whole, 0 keeps every block")
+	gcInterval := globalCmd.Duration("dbgcinterval", storage.DefaultMaintenanceInterval, "Interval of the value log garbage collection, negative disables it")
+	gcRatio := globalCmd.Float64("dbgcratio", storage.DefaultDiscardRatio, "Share of stale data a value log file is rewritten at")
+	gcMinSize := globalCmd.Int64("dbgcminsize", 0, "Value log size below which the periodic garbage collection is skipped")
+	if err := globalCmd.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	var err error
+	if len(*paramsFile) > 0 {
+		cli.params, err = params.Load(*paramsFile)
+	} else {
+		cli.params, err = params.ByName(*networkName)
+	}
+	if err != nil {
+		return err
+	}
+	cli.dataDir = *dataDir
+	cli.utxoCacheSize = *utxoCacheSize
+	cli.blockCacheSize = *blockCacheSize
+	cli.pruneDepth = *pruneDepth
+	cli.maintenance = storage.MaintenanceOptions{
+		Interval:        *gcInterval,
+		DiscardRatio:    *gcRatio,
+		MinValueLogSize: *gcMinSize,
+		Report:          reportMaintenance,
+	}
+	if cli.params.Name != params.Mainnet.Name {
+		cli.dataDir = filepath.Join(*dataDir, cli.params.Name)
+	}
+	network.Configure(cli.params)
+	args := globalCmd.Args()
+	if err := cli.validateArgs(args); err != nil {
+		return err
+	}
+
 	getBalanceCmd := flag.NewFlagSet("balance", flag.ExitOnError)
 	getBalanceAddress := getBalanceCmd.String("address", "", "address of the account")
 
 	createCmd := flag.NewFlagSet("create", flag.ExitOnError)
 	createBlockChainAddress := createCmd.String("blockchain", "", "address of the blockchain")
 	createWallet := createCmd.Bool("wallet", false, "create new wallet")
+	createGenesis := createCmd.Bool("genesis", false, "create the blockchain from the genesis of the chain parameters")
 	
 	printCmd := flag.NewFlagSet("print", flag.ExitOnError)
+	printFrom := printCmd.Int("from", 0, "Height of the first block to print")
+	printTo := printCmd.Int("to", -1, "Height of the last block to print, -1 for the tip")
 
 	listCmd := flag.NewFlagSet("list", flag.ExitOnError)
 	listWallets := listCmd.Bool("wallets", false, "list wallets")
@@ -137,91 +752,288 @@ func (cli *CommandLine) run() {
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount of coins")
+	sendFeeRate := sendCmd.Int("feerate", 2, "Fee per byte paid to the miner")
+	sendCoinSelect := sendCmd.String("coinselect", "largest", "Coin selection strategy: largest, smallest, bnb or random")
+	sendInputs := sendCmd.String("inputs", "", "Spend exactly these outpoints, as txid:index separated by commas")
+	sendNode := sendCmd.String("node", "", "Submit the transaction to a running node at this address. It is still built and signed on the chain of -datadir, which can not be the one the node holds open, and coins that copy does not know about yet are not spent")
+	sendMine := sendCmd.Bool("mine", false, "Mine a block with the transaction right away")
+
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
+	bumpFeeTxID := bumpFeeCmd.String("txid", "", "ID of the mempool transaction")
+	bumpFeeRate := bumpFeeCmd.Int("feerate", 0, "New fee per byte")
 
 	reindexCmd := flag.NewFlagSet("reindex", flag.ExitOnError)
 
-	switch os.Args[1] {
+	getTxOutSetInfoCmd := flag.NewFlagSet("gettxoutsetinfo", flag.ExitOnError)
+
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ExitOnError)
+	verifyChainLevel := verifyChainCmd.Int("level", blockchain.VerifyUTXO, "How thoroughly the chain is checked")
+
+	dumpUTXOCmd := flag.NewFlagSet("dumputxo", flag.ExitOnError)
+	dumpUTXOFile := dumpUTXOCmd.String("file", "", "File the snapshot is written to")
+
+	loadUTXOCmd := flag.NewFlagSet("loadutxo", flag.ExitOnError)
+	loadUTXOFile := loadUTXOCmd.String("file", "", "File the snapshot is read from")
+
+	exportCmd := flag.NewFlagSet("export", flag.ExitOnError)
+	exportFile := exportCmd.String("file", "", "File the blocks are written to")
+
+	importCmd := flag.NewFlagSet("import", flag.ExitOnError)
+	importFile := importCmd.String("file", "", "File the blocks are read from")
+
+	backupCmd := flag.NewFlagSet("backup", flag.ExitOnError)
+	backupOut := backupCmd.String("out", "", "File the backup is written to")
+	backupNode := backupCmd.String("node", "", "Have the running node at this address take the backup")
+
+	compactDBCmd := flag.NewFlagSet("compactdb", flag.ExitOnError)
+
+	restoreCmd := flag.NewFlagSet("restore", flag.ExitOnError)
+	restoreFile := restoreCmd.String("file", "", "File the backup is read from")
+
+	utxosCmd := flag.NewFlagSet("utxos", flag.ExitOnError)
+	utxosAddress := utxosCmd.String("address", "", "address owning the outputs")
+
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
+	mineAddress := mineCmd.String("address", "", "Address receiving the block rewards")
+	mineBlocks := mineCmd.Int("blocks", 0, "Number of blocks to mine, 0 mines forever")
+
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	startNodePort := startNodeCmd.String("port", cli.params.DefaultPort, "Port the node listens on")
+	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining and send the rewards to this address")
+
+	switch args[0] {
 	case "reindex":
-		err := reindexCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		if err := reindexCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "gettxoutsetinfo":
+		if err := getTxOutSetInfoCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "verifychain":
+		if err := verifyChainCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "dumputxo":
+		if err := dumpUTXOCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "loadutxo":
+		if err := loadUTXOCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "export":
+		if err := exportCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "import":
+		if err := importCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "backup":
+		if err := backupCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "restore":
+		if err := restoreCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "compactdb":
+		if err := compactDBCmd.Parse(args[1:]); err != nil {
+			return err
 		}
 	case "list":
-		err := listCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		if err := listCmd.Parse(args[1:]); err != nil {
+			return err
 		}
 	case "balance":
-		err := getBalanceCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		if err := getBalanceCmd.Parse(args[1:]); err != nil {
+			return err
 		}
 	case "create":
-		err := createCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		if err := createCmd.Parse(args[1:]); err != nil {
+			return err
 		}
 	case "print":
-		err := printCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		if err := printCmd.Parse(args[1:]); err != nil {
+			return err
 		}
 	case "send":
-		err := sendCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
+		if err := sendCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "bumpfee":
+		if err := bumpFeeCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "utxos":
+		if err := utxosCmd.Parse(args[1:]); err != nil {
+			return err
 		}
+	case "mine":
+		if err := mineCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "startnode":
+		if err := startNodeCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	default:
+		cli.printUsage()
+		return errUsage
 	}
 
 	if reindexCmd.Parsed() {
-		cli.reindexUTXO()
+		return cli.reindexUTXO()
+	}
+
+	if getTxOutSetInfoCmd.Parsed() {
+		return cli.getTxOutSetInfo()
+	}
+
+	if verifyChainCmd.Parsed() {
+		if *verifyChainLevel < blockchain.VerifyHeaders || *verifyChainLevel > blockchain.VerifyUTXO {
+			verifyChainCmd.Usage()
+			return errUsage
+		}
+		return cli.verifyChain(*verifyChainLevel)
+	}
+
+	if dumpUTXOCmd.Parsed() {
+		if *dumpUTXOFile == "" {
+			dumpUTXOCmd.Usage()
+			return errUsage
+		}
+		return cli.dumpUTXO(*dumpUTXOFile)
+	}
+
+	if loadUTXOCmd.Parsed() {
+		if *loadUTXOFile == "" {
+			loadUTXOCmd.Usage()
+			return errUsage
+		}
+		return cli.loadUTXO(*loadUTXOFile)
+	}
+
+	if exportCmd.Parsed() {
+		if *exportFile == "" {
+			exportCmd.Usage()
+			return errUsage
+		}
+		return cli.exportChain(*exportFile)
+	}
+
+	if importCmd.Parsed() {
+		if *importFile == "" {
+			importCmd.Usage()
+			return errUsage
+		}
+		return cli.importChain(*importFile)
+	}
+
+	if backupCmd.Parsed() {
+		if *backupOut == "" {
+			backupCmd.Usage()
+			return errUsage
+		}
+		return cli.backup(*backupOut, *backupNode)
+	}
+
+	if restoreCmd.Parsed() {
+		if *restoreFile == "" {
+			restoreCmd.Usage()
+			return errUsage
+		}
+		return cli.restore(*restoreFile)
+	}
+
+	if compactDBCmd.Parsed() {
+		return cli.compactDB()
 	}
 
 	if listCmd.Parsed() {
 		if *listWallets {
-			cli.listAddresses()
+			return cli.listAddresses()
 		} else {
 			listCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
 	}
 
 	if getBalanceCmd.Parsed() {
 		if *getBalanceAddress == "" {
 			getBalanceCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
-		cli.getBalance(*getBalanceAddress)
+		return cli.getBalance(*getBalanceAddress)
 	}
 
 	if createCmd.Parsed() {
-		if *createBlockChainAddress == "" && !*createWallet {
+		if *createBlockChainAddress == "" && !*createWallet && !*createGenesis {
 			createCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
-		if len(*createBlockChainAddress) > 0{
-			cli.createBlockChain(*createBlockChainAddress)
+		if len(*createBlockChainAddress) > 0 || *createGenesis {
+			if err := cli.createBlockChain(*createBlockChainAddress); err != nil {
+				return err
+			}
 		}
 		if *createWallet {
-			cli.createWallet()
+			return cli.createWallet()
 		}
 	}
 	if printCmd.Parsed() {
-		cli.printChain()
+		if *printFrom < 0 || (*printTo >= 0 && *printTo < *printFrom) {
+			printCmd.Usage()
+			return errUsage
+		}
+		return cli.printChain(*printFrom, *printTo)
 	}
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFeeRate < blockchain.MinRelayFeeRate {
 			sendCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+		return cli.send(*sendFrom, *sendTo, *sendAmount, *sendFeeRate, *sendCoinSelect, *sendInputs, *sendNode, *sendMine)
 	}
-
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeTxID == "" || *bumpFeeRate <= 0 {
+			bumpFeeCmd.Usage()
+			return errUsage
+		}
+		return cli.bumpFee(*bumpFeeTxID, *bumpFeeRate)
+	}
+	if utxosCmd.Parsed() {
+		if *utxosAddress == "" {
+			utxosCmd.Usage()
+			return errUsage
+		}
+		return cli.listUTXOs(*utxosAddress)
+	}
+	if mineCmd.Parsed() {
+		if *mineAddress == "" || *mineBlocks < 0 {
+			mineCmd.Usage()
+			return errUsage
+		}
+		return cli.mine(*mineAddress, *mineBlocks)
+	}
+	if startNodeCmd.Parsed() {
+		if *startNodePort == "" {
+			startNodeCmd.Usage()
+			return errUsage
+		}
+		return cli.startNode(*startNodePort, *startNodeMiner)
+	}
+	return nil
 }
 
 func main() {
-	defer os.Exit(0)
 	cli := CommandLine{}
-	cli.run()
+	if err := cli.run(); err != nil {
+		if errors.Cause(err) != errUsage {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		os.Exit(exitCode(err))
+	}
 }
@@ -0,0 +1,14 @@
+package network
+
+import "github.com/pkg/errors"
+
+// Errors returned by the package, possibly wrapped with more context.
+// Compare them against errors.Cause(err).
+var (
+	ErrPeerUnavailable  = errors.New("peer is not available")
+	ErrMalformedMessage = errors.New("malformed message")
+	ErrUnknownCommand   = errors.New("unknown command")
+	ErrWrongNetwork     = errors.New("message from another network")
+	ErrNotLocal         = errors.New("command only accepted from this host")
+	ErrMessageTooLarge  = errors.New("message too large")
+)
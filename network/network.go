@@ -2,31 +2,60 @@ package network
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
 	"github.com/AntonBozhinov/sentinel/blockchain"
+	"github.com/AntonBozhinov/sentinel/params"
+	"github.com/AntonBozhinov/sentinel/storage"
+	"github.com/pkg/errors"
 	"gopkg.in/vrecan/death.v3"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
-	"runtime"
+	"sync"
 	"syscall"
+	"time"
 )
 
 const (
 	protocol = "tcp"
 	version = 1
+	magicLength = 4
 	commandLength = 12
+	// headerLength is the size of the network magic and the command starting every message
+	headerLength = magicLength + commandLength
+	// payloadOverhead is the room for the sender address and the encoding
+	// around the block or transaction of a message
+	payloadOverhead = 1 << 10
+	// maxPayloadSize bounds the payload of the other messages, an inventory
+	// of every block hash of a long chain included
+	maxPayloadSize = 32 << 20
+	// minerRetryDelay is how long the miner waits after a failed template or
+	// block, doubling with every failure in a row up to maxMinerRetryDelay
+	minerRetryDelay    = time.Second
+	maxMinerRetryDelay = time.Minute
 )
 
 var (
 	nodeAddress     string
 	minerAddress    string
 	blocksInTransit [][]byte
-	KnownNodes       = []string{"localhost:3000"}
-	memoryPool       = make(map[string]blockchain.CoinTransaction)
+	chainParams      = &params.Mainnet
+	KnownNodes       = chainParams.DefaultPeers
+	memoryPool       *blockchain.Mempool
+	// refusedNodes announced another genesis, nothing they send is accepted
+	refusedNodes     = make(map[string]bool)
+	// chainLock keeps the miner and the connection handlers from
+	// modifying the chain and the mempool at the same time, readers
+	// of both do not need it
+	chainLock sync.Mutex
+	// nodesLock guards KnownNodes and refusedNodes
+	nodesLock sync.RWMutex
+	// transitLock guards blocksInTransit
+	transitLock sync.Mutex
 )
 
 type Addr struct {
@@ -59,10 +88,20 @@ type Tx struct {
 	Transaction []byte
 }
 
+// Backup asks a node on the same host to write a backup of its chain to File
+type Backup struct {
+	File string
+}
+
 type Version struct {
 	Version int
 	BestHeight int
 	AddrFrom string
+	GenesisHash []byte
+	// PruneHeight is the lowest height the node has whole blocks for, zero unless it is pruned
+	PruneHeight int
+	// Timestamp is the clock of the node in seconds, it adjusts the network time of its peers
+	Timestamp int64
 }
 
 func CmdToBytes(cmd string) []byte  {
@@ -86,177 +125,662 @@ func BytesToCmd(bytes []byte) string  {
 }
 
 
+// Configure switches the node to the network of p, it talks to its default peers
+// and only accepts messages carrying its magic
+func Configure(p *params.ChainParams) {
+	chainParams = p
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+	KnownNodes = append([]string{}, p.DefaultPeers...)
+}
+
+// magicBytes encodes the magic of the network messages are sent on
+func magicBytes() []byte {
+	magic := make([]byte, magicLength)
+	binary.BigEndian.PutUint32(magic, chainParams.Magic)
+	return magic
+}
+
 func CloseDB(chain *blockchain.BlockChain) {
 	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	d.WaitForDeathWithFunc(func() {
 		defer os.Exit(1)
-		defer runtime.Goexit()
-		chain.Database.Close()
+		// let a block or transaction being added finish first
+		chainLock.Lock()
+		if err := chain.Close(); err != nil {
+			fmt.Println(err)
+		}
 	})
 }
 
-func GobEncode(data interface{}) []byte {
+func GobEncode(data interface{}) ([]byte, error) {
 	var buff bytes.Buffer
 	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(data)
-	if err != nil {
-		log.Panic(err)
+	if err := enc.Encode(data); err != nil {
+		return nil, errors.Wrap(err, "error encoding the payload")
+	}
+	return buff.Bytes(), nil
+}
+
+// decodePayload decodes the gob payload following the command of a request
+func decodePayload(request []byte, payload interface{}) error {
+	buff := bytes.NewBuffer(request[headerLength:])
+	if err := gob.NewDecoder(buff).Decode(payload); err != nil {
+		return errors.Wrap(ErrMalformedMessage, err.Error())
 	}
-	return buff.Bytes()
+	return nil
 }
 
-func HandleConnection(conn net.Conn, chain *blockchain.BlockChain)  {
-	req, err := ioutil.ReadAll(conn)
+// payloadLimit is the size of the largest valid payload of a command, blocks
+// and transactions are bounded by the limits of the chain parameters
+func payloadLimit(command string) int {
+	switch command {
+	case "block":
+		return chainParams.MaxBlockSize + payloadOverhead
+	case "tx":
+		return chainParams.MaxTxSize + payloadOverhead
+	}
+	return maxPayloadSize
+}
+
+// HandleConnection reads a single request from conn and dispatches it to its handler
+func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) error {
 	defer conn.Close()
-	if err != nil {
-		log.Panic(err)
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(conn, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.Wrap(ErrMalformedMessage, "request is shorter than a message header")
+	} else if err != nil {
+		return errors.Wrap(err, "error reading the request")
+	}
+	if magic := binary.BigEndian.Uint32(header[:magicLength]); magic != chainParams.Magic {
+		return errors.Wrapf(ErrWrongNetwork, "message magic %08x, expected %08x of %s", magic, chainParams.Magic, chainParams.Name)
 	}
 
-	command := BytesToCmd(req[commandLength:])
+	command := BytesToCmd(header[magicLength:])
 	fmt.Printf("Recieved %s command\n", command)
 
+	// read no more than the largest valid message of the command
+	limit := payloadLimit(command)
+	payload, err := ioutil.ReadAll(io.LimitReader(conn, int64(limit)+1))
+	if err != nil {
+		return errors.Wrap(err, "error reading the request")
+	}
+	if len(payload) > limit {
+		return errors.Wrapf(ErrMessageTooLarge, "%s message is over %d bytes", command, limit)
+	}
+	req := append(header, payload...)
+
 	switch command {
+	case "block", "tx", "backup":
+		// the chain, the mempool or the database change, or must not change while read
+		chainLock.Lock()
+		defer chainLock.Unlock()
+	}
+
+	switch command {
+	case "addr":
+		err = HandleAddr(req)
+	case "block":
+		err = HandleBlocks(req, chain)
+	case "inv":
+		err = HandleInv(req, chain)
+	case "getblocks":
+		err = HandleGetBlocks(req, chain)
+	case "getdata":
+		err = HandleGetData(req, chain)
+	case "tx":
+		err = HandleTx(req, chain)
+	case "version":
+		err = HandleVersion(req, conn.RemoteAddr(), chain)
+	case "backup":
+		err = HandleBackup(req, conn.RemoteAddr(), chain)
 	default:
-		fmt.Println("Unknown command")
+		err = errors.Wrap(ErrUnknownCommand, command)
 	}
+	return errors.Wrapf(err, "error handling %s", command)
 }
 
-func SendData(addr string, data []byte)  {
-	conn, err := net.Dial(protocol, addr)
+// StartServer runs a node listening on localhost:nodeID. With a miner address
+// the node keeps mining block templates built from its mempool.
+func StartServer(nodeID, minerAddr string, chain *blockchain.BlockChain) error {
+	Configure(chain.Params)
+	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+	minerAddress = minerAddr
+	var err error
+	memoryPool, err = blockchain.NewMempool(chain)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen(protocol, nodeAddress)
+	if err != nil {
+		return errors.Wrapf(err, "error listening on %s", nodeAddress)
+	}
+	defer ln.Close()
+
+	go CloseDB(chain)
+	if nodes := knownNodes(); len(nodes) > 0 && nodeAddress != nodes[0] {
+		if err := SendVersion(nodes[0], chain); err != nil {
+			fmt.Println(err)
+		}
+	}
+	backfilling, err := chain.Backfilling()
 	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
-		for _, node := range KnownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
+		return err
+	}
+	if backfilling {
+		// ask for the blocks below the snapshot the chain was loaded from
+		for _, node := range knownNodes() {
+			if node == nodeAddress {
+				continue
+			}
+			if err := SendGetBlocks(node); err != nil {
+				fmt.Println(err)
 			}
 		}
-		KnownNodes = updatedNodes
-		return
 	}
-	defer conn.Close()
-	_, err = io.Copy(conn, bytes.NewReader(data))
+	if len(minerAddress) > 0 {
+		go func() {
+			if err := MineBlocks(chain); err != nil {
+				fmt.Printf("miner stopped: %v\n", err)
+			}
+		}()
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return errors.Wrap(err, "error accepting a connection")
+		}
+		go func() {
+			if err := HandleConnection(conn, chain); err != nil {
+				fmt.Println(err)
+			}
+		}()
+	}
+}
+
+// MineBlocks continuously mines templates on top of the tip and announces
+// every block that extends the chain to the known nodes. A template or block
+// that fails is logged and retried after a delay, the miner only returns once
+// the chain is closed on shutdown.
+func MineBlocks(chain *blockchain.BlockChain) error {
+	delay := minerRetryDelay
+	for {
+		block, err := mineBlock()
+		if errors.Cause(err) == storage.ErrClosed {
+			return err
+		}
+		if err != nil {
+			fmt.Printf("mining failed, retrying in %v: %v\n", delay, err)
+			time.Sleep(delay)
+			if delay *= 2; delay > maxMinerRetryDelay {
+				delay = maxMinerRetryDelay
+			}
+			continue
+		}
+		delay = minerRetryDelay
+		if block == nil {
+			fmt.Println("Tip changed while mining, discarding the block")
+			continue
+		}
+		fmt.Printf("New block mined: %x\n", block.Hash)
+
+		for _, node := range knownNodes() {
+			if node != nodeAddress {
+				if err := SendInv(node, "block", [][]byte{block.Hash}); err != nil {
+					fmt.Println(err)
+				}
+			}
+		}
+	}
+}
+
+// mineBlock mines a template on top of the tip and connects it, returning
+// nil when the tip changed in the meantime
+func mineBlock() (*blockchain.Block, error) {
+	chainLock.Lock()
+	tmpl, err := blockchain.NewBlockTemplate(memoryPool, minerAddress)
+	chainLock.Unlock()
 	if err != nil {
-		log.Panic(err)
+		return nil, err
+	}
 
+	fmt.Printf("Mining a block with %d transactions at height %d\n", len(tmpl.Transactions), tmpl.Height)
+	block := tmpl.Solve()
+
+	chainLock.Lock()
+	connected, err := blockchain.ConnectBlock(memoryPool, block)
+	chainLock.Unlock()
+	if err != nil || !connected {
+		return nil, err
 	}
+	return block, nil
 }
 
-func SendAddr(address string)  {
-	nodes := Addr{KnownNodes}
-	nodes.AddrList = append(nodes.AddrList, address)
-	payload := GobEncode(nodes)
-	request := append(CmdToBytes("addr"), payload...)
+// SendData delivers a request to addr, forgetting the node when it can not be reached
+func SendData(addr string, data []byte) error {
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		forgetNode(addr)
+		return errors.Wrap(ErrPeerUnavailable, addr)
+	}
+	defer conn.Close()
+	_, err = io.Copy(conn, bytes.NewReader(data))
+	return errors.Wrapf(err, "error sending data to %s", addr)
+}
 
-	SendData(address, request)
+// sendCommand encodes data as the payload of command and sends it to addr
+func sendCommand(addr, command string, data interface{}) error {
+	payload, err := GobEncode(data)
+	if err != nil {
+		return err
+	}
+	request := append(magicBytes(), CmdToBytes(command)...)
+	request = append(request, payload...)
+	return SendData(addr, request)
 }
 
-func SendBlock(addr string, block *blockchain.Block) {
-	data := Block{addr, block.Serialize()}
-	payload := GobEncode(data)
-	request := append(CmdToBytes("block"), payload...)
+func SendAddr(address string) error {
+	nodes := Addr{knownNodes()}
+	nodes.AddrList = append(nodes.AddrList, address)
+	return sendCommand(address, "addr", nodes)
+}
 
-	SendData(addr, request)
+func SendBlock(addr string, block *blockchain.Block) error {
+	return sendCommand(addr, "block", Block{nodeAddress, block.Serialize()})
 }
 
-func SendInv(address, kind string, items [][]byte)  {
+func SendInv(address, kind string, items [][]byte) error {
 	inventory := Inventory{
-		AddrFrom:address,
+		AddrFrom: nodeAddress,
 		Type: kind,
 		Items: items,
 	}
-	payload := GobEncode(inventory)
-	request := append(CmdToBytes("inv"), payload...)
-	SendData(address, request)
+	return sendCommand(address, "inv", inventory)
 }
 
-func SendTx(address string, transaction *blockchain.CoinTransaction)  {
+func SendTx(address string, transaction *blockchain.CoinTransaction) error {
 	data := Tx{
-		AddrFrom: address,
+		AddrFrom: nodeAddress,
 		Transaction: transaction.Serialize(),
 	}
-	payload := GobEncode(data)
-	request := append(CmdToBytes("tx"), payload...)
-	SendData(address, request)
+	return sendCommand(address, "tx", data)
 }
 
-func SendVersion(address string, chain *blockchain.BlockChain) {
-	bestHeight := chain.GetBestHeight()
+func SendVersion(address string, chain *blockchain.BlockChain) error {
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	pruneHeight, err := chain.PruneHeight()
+	if err != nil {
+		return err
+	}
 	version := Version{
-		AddrFrom: address,
+		AddrFrom: nodeAddress,
 		BestHeight: bestHeight,
 		Version: version,
+		GenesisHash: chain.GenesisHash,
+		PruneHeight: pruneHeight,
+		Timestamp: time.Now().Unix(),
 	}
-	payload := GobEncode(version)
-	request := append(CmdToBytes("version"), payload...)
-	SendData(address, request)
+	return sendCommand(address, "version", version)
 }
 
-func SendGetBlocks(address string) {
-	payload := GobEncode(GetBlocks{nodeAddress})
-	request := append(CmdToBytes("getblocks"), payload...)
-	SendData(address, request)
+func SendGetBlocks(address string) error {
+	return sendCommand(address, "getblocks", GetBlocks{nodeAddress})
 }
 
-func SendGetData(address, kind string, id []byte) {
-	payload := GobEncode(GetData{
-		AddrFrom: address,
+func SendGetData(address, kind string, id []byte) error {
+	return sendCommand(address, "getdata", GetData{
+		AddrFrom: nodeAddress,
 		Type: kind,
 		ID: id,
 	})
-	request := append(CmdToBytes("getdata"), payload...)
-	SendData(address, request)
 }
 
-func HandleAddr(request []byte) {
-	var buff bytes.Buffer
+// SendBackup asks the node at address, which must run on this host, to write a backup to file
+func SendBackup(address, file string) error {
+	return sendCommand(address, "backup", Backup{file})
+}
+
+func HandleAddr(request []byte) error {
 	var payload Addr
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(request, &payload); err != nil {
+		return err
 	}
 
-	KnownNodes = append(KnownNodes, payload.AddrList...)
-	fmt.Printf("there are %d known nodes\n", len(KnownNodes))
-	RequestBlocks()
+	for _, node := range payload.AddrList {
+		addNode(node)
+	}
+	fmt.Printf("there are %d known nodes\n", len(knownNodes()))
+	return RequestBlocks()
 }
 
-func HandleBlocks(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
+func HandleBlocks(request []byte, chain *blockchain.BlockChain) error {
 	var payload Block
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+	if err := decodePayload(request, &payload); err != nil {
+		return err
+	}
+	if err := checkPeer(payload.AddrFrom); err != nil {
+		return err
+	}
+	block, err := blockchain.Deserialize(payload.Block)
+	if err != nil {
+		return err
+	}
+	fmt.Println("received a new block")
+	if err := blockchain.CheckBlock(block, chain.Params); err != nil {
+		return err
+	}
+	connected, err := blockchain.ConnectBlock(memoryPool, block)
+	if errors.Cause(err) == blockchain.ErrBlockNotFound {
+		// an orphan is dropped and the missing blocks requested, it comes again
+		// after its parent and is checked against its median time past then
+		fmt.Printf("block %x has an unknown parent %x\n", block.Hash, block.PrevHash)
+		return SendGetBlocks(payload.AddrFrom)
+	}
+	if err != nil {
+		return err
+	}
+	if connected {
+		fmt.Printf("added block %x\n", block.Hash)
+	} else if bytes.Compare(chain.LastHash(), block.Hash) == 0 {
+		// the block belongs to a longer branch, move the UTXO set over to it
+		UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+		if err := UTXOSet.Reorganize(); err != nil {
+			return err
+		}
+		if err := memoryPool.Reload(); err != nil {
+			return err
+		}
+		fmt.Printf("switched to block %x\n", block.Hash)
+	}
+	if blockHash, ok := nextBlockInTransit(); ok {
+		return SendGetData(payload.AddrFrom, "block", blockHash)
+	}
+	return nil
+}
+
+func HandleInv(request []byte, chain *blockchain.BlockChain) error {
+	var payload Inventory
+	if err := decodePayload(request, &payload); err != nil {
+		return err
+	}
+	if err := checkPeer(payload.AddrFrom); err != nil {
+		return err
+	}
+	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
+
+	if payload.Type == "block" {
+		// blocks are announced from the tip down, request them from the genesis up.
+		// Pruned blocks are only requested again while a snapshot is backfilled.
+		backfilling, err := chain.Backfilling()
+		if err != nil {
+			return err
+		}
+		var missing [][]byte
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			_, err := chain.GetBlock(payload.Items[i])
+			switch errors.Cause(err) {
+			case nil:
+			case blockchain.ErrBlockNotFound:
+				missing = append(missing, payload.Items[i])
+			case blockchain.ErrPruned:
+				if backfilling {
+					missing = append(missing, payload.Items[i])
+				}
+			default:
+				return err
+			}
+		}
+		setBlocksInTransit(missing)
+		if blockHash, ok := nextBlockInTransit(); ok {
+			return SendGetData(payload.AddrFrom, "block", blockHash)
+		}
+	}
+
+	if payload.Type == "tx" {
+		for _, txID := range payload.Items {
+			if _, ok := memoryPool.Get(txID); !ok {
+				if err := SendGetData(payload.AddrFrom, "tx", txID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) error {
+	var payload GetBlocks
+	if err := decodePayload(request, &payload); err != nil {
+		return err
+	}
+	if err := checkPeer(payload.AddrFrom); err != nil {
+		return err
+	}
+
+	blocks, err := chain.GetBlockHashes()
+	if err != nil {
+		return err
+	}
+	return SendInv(payload.AddrFrom, "block", blocks)
+}
+
+func HandleGetData(request []byte, chain *blockchain.BlockChain) error {
+	var payload GetData
+	if err := decodePayload(request, &payload); err != nil {
+		return err
+	}
+	if err := checkPeer(payload.AddrFrom); err != nil {
+		return err
+	}
+
+	if payload.Type == "block" {
+		block, err := chain.GetBlock(payload.ID)
+		if err != nil {
+			return err
+		}
+		return SendBlock(payload.AddrFrom, &block)
+	}
+
+	if payload.Type == "tx" {
+		entry, ok := memoryPool.Get(payload.ID)
+		if !ok {
+			return errors.Wrapf(blockchain.ErrTxNotFound, "transaction %x is not in the mempool", payload.ID)
+		}
+		return SendTx(payload.AddrFrom, entry.Tx)
+	}
+	return nil
+}
+
+func HandleTx(request []byte, chain *blockchain.BlockChain) error {
+	var payload Tx
+	if err := decodePayload(request, &payload); err != nil {
+		return err
+	}
+	if err := checkPeer(payload.AddrFrom); err != nil {
+		return err
+	}
+
+	tx, err := blockchain.DeserializeTransaction(payload.Transaction)
+	if err != nil {
+		return err
+	}
+	if err := memoryPool.Add(&tx); err != nil {
+		return errors.Wrapf(err, "rejected transaction %s", hex.EncodeToString(tx.ID))
+	}
+	fmt.Printf("%s, %d transactions in the mempool\n", nodeAddress, memoryPool.Count())
+
+	for _, node := range knownNodes() {
+		if node != nodeAddress && node != payload.AddrFrom {
+			if err := SendInv(node, "tx", [][]byte{tx.ID}); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+	return nil
+}
+
+// HandleVersion checks the genesis of a peer, samples its clock and starts a
+// sync with whichever side is behind. Clock samples are keyed by the host of
+// the connection, not by the address the peer claims, so one machine can not
+// outweigh the others. Nodes sharing a machine share its clock and count as
+// one sample, so a local setup with several nodes never reaches the samples
+// needed to adjust the time and keeps the local clock.
+func HandleVersion(request []byte, from net.Addr, chain *blockchain.BlockChain) error {
+	var payload Version
+	if err := decodePayload(request, &payload); err != nil {
+		return err
+	}
+
+	if bytes.Compare(payload.GenesisHash, chain.GenesisHash) != 0 {
+		refuseNode(payload.AddrFrom)
+		return errors.Wrapf(blockchain.ErrGenesisMismatch, "refusing %s with genesis %x", payload.AddrFrom, payload.GenesisHash)
+	}
+	if host, _, err := net.SplitHostPort(from.String()); err == nil && payload.Timestamp != 0 {
+		chain.NetworkTime().AddSample(host, time.Unix(payload.Timestamp, 0))
+	}
+
+	bestHeight, err := chain.GetBestHeight()
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-	blockData := payload.Block
-	block := blockchain.Deserialize(blockData)
-	fmt.Printf("received a new block")
-	chain.AddBlock(block)
-	fmt.Printf("added block %x\n", block.Hash)
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := blockchain.UTXOSet{chain}
-		UTXOSet.Reindex()
+	otherHeight := payload.BestHeight
+
+	addNode(payload.AddrFrom)
+
+	if bestHeight < otherHeight {
+		if bestHeight+1 < payload.PruneHeight {
+			fmt.Printf("%s is pruned below height %d, can not sync from it\n", payload.AddrFrom, payload.PruneHeight)
+			return nil
+		}
+		return SendGetBlocks(payload.AddrFrom)
+	} else if bestHeight > otherHeight {
+		if err := SendVersion(payload.AddrFrom, chain); err != nil {
+			return err
+		}
+	}
+	// a chain loaded from a snapshot fetches its history from peers that have all of it
+	backfilling, err := chain.Backfilling()
+	if err != nil {
+		return err
 	}
+	if backfilling && payload.PruneHeight == 0 {
+		return SendGetBlocks(payload.AddrFrom)
+	}
+	return nil
 }
 
-func RequestBlocks() {
-	for _, n := range KnownNodes {
-		SendGetBlocks(n)
+// HandleBackup writes a backup of the chain while the node keeps running. The
+// backup holds the wallets, so it is only taken for requests from this host.
+func HandleBackup(request []byte, from net.Addr, chain *blockchain.BlockChain) error {
+	if addr, ok := from.(*net.TCPAddr); !ok || !addr.IP.IsLoopback() {
+		return errors.Wrapf(ErrNotLocal, "backup requested by %s", from)
+	}
+	var payload Backup
+	if err := decodePayload(request, &payload); err != nil {
+		return err
 	}
+	info, err := chain.BackupFile(payload.File)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote a backup at height %d with %d entries to %s\n", info.Height, info.Entries, payload.File)
+	return nil
 }
 
+// knownNodes returns a copy of the known nodes that is safe to iterate
+func knownNodes() []string {
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+	return append([]string{}, KnownNodes...)
+}
 
+// addNode adds addr to the known nodes unless it is known or refused
+func addNode(addr string) {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+	if refusedNodes[addr] {
+		return
+	}
+	for _, node := range KnownNodes {
+		if node == addr {
+			return
+		}
+	}
+	KnownNodes = append(KnownNodes, addr)
+}
 
+// refuseNode forgets addr and ignores everything it sends from now on
+func refuseNode(addr string) {
+	nodesLock.Lock()
+	refusedNodes[addr] = true
+	nodesLock.Unlock()
+	forgetNode(addr)
+}
 
+// forgetNode drops addr from the known nodes
+func forgetNode(addr string) {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+	var updatedNodes []string
+	for _, node := range KnownNodes {
+		if node != addr {
+			updatedNodes = append(updatedNodes, node)
+		}
+	}
+	KnownNodes = updatedNodes
+}
 
+// checkPeer refuses messages from nodes with another genesis
+func checkPeer(addr string) error {
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+	if refusedNodes[addr] {
+		return errors.Wrapf(blockchain.ErrGenesisMismatch, "ignoring %s", addr)
+	}
+	return nil
+}
 
+func NodeIsKnown(addr string) bool {
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+	for _, node := range KnownNodes {
+		if node == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// setBlocksInTransit replaces the blocks still to request from the peer syncing the node
+func setBlocksInTransit(hashes [][]byte) {
+	transitLock.Lock()
+	defer transitLock.Unlock()
+	blocksInTransit = hashes
+}
 
+// nextBlockInTransit takes the next block to request, if any is left
+func nextBlockInTransit() ([]byte, bool) {
+	transitLock.Lock()
+	defer transitLock.Unlock()
+	if len(blocksInTransit) == 0 {
+		return nil, false
+	}
+	blockHash := blocksInTransit[0]
+	blocksInTransit = blocksInTransit[1:]
+	return blockHash, true
+}
 
+// RequestBlocks asks every known node for its blocks, skipping the ones that are unavailable
+func RequestBlocks() error {
+	for _, n := range knownNodes() {
+		if err := SendGetBlocks(n); err != nil && errors.Cause(err) != ErrPeerUnavailable {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+// Package params describes the networks a node can run on. Every network has
+// its own genesis, proof of work difficulty, rewards, address version and
+// message magic, so nodes and wallets of different networks can not mix.
+package params
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"sort"
+)
+
+// ErrUnknownNetwork is returned for a network name without a preset
+var ErrUnknownNetwork = errors.New("unknown network")
+
+// ChainParams are the consensus and networking parameters of a chain
+type ChainParams struct {
+	// Name of the network, chains of other networks than mainnet keep
+	// their data in a sub directory of that name
+	Name string `json:"name"`
+	// Magic starts every network message so peers of other networks are refused
+	Magic uint32 `json:"magic"`
+	// AddressVersion is the first byte of every address of the network
+	AddressVersion byte `json:"address_version"`
+	// DefaultPort is the port a node listens on when none is given
+	DefaultPort string `json:"default_port"`
+	// DefaultPeers are the nodes contacted first
+	DefaultPeers []string `json:"default_peers"`
+	// Difficulty is the number of leading zero bits of a block hash
+	Difficulty int `json:"difficulty"`
+	// BlockReward is the subsidy a miner collects on top of the fees of a block
+	BlockReward int `json:"block_reward"`
+	// UTXOCommitmentHeight is the height from which every block commits to the
+	// UTXO set in its header, 0 leaves the commitment optional
+	UTXOCommitmentHeight int `json:"utxo_commitment_height"`
+	// MedianTimeBlocks is the number of blocks whose median timestamp, the
+	// median time past, a block must be later than, 0 disables the rule
+	MedianTimeBlocks int `json:"median_time_blocks"`
+	// MaxFutureBlockTime is how many seconds a block may be ahead of the
+	// network time, 0 disables the rule
+	MaxFutureBlockTime int64 `json:"max_future_block_time"`
+	// MaxBlockSize is the largest serialized size of a block in bytes
+	MaxBlockSize int `json:"max_block_size"`
+	// MaxTxSize is the largest serialized size of a transaction in bytes
+	MaxTxSize int `json:"max_tx_size"`
+	// MaxBlockTxs is the largest number of transactions of a block, the
+	// coinbase included
+	MaxBlockTxs int `json:"max_block_txs"`
+	// Genesis describes the first block of the chain
+	Genesis Genesis `json:"genesis"`
+	// GenesisHash pins the hash of the genesis in hex, chains and peers with
+	// another genesis are refused. Empty when the genesis is not fixed.
+	GenesisHash string `json:"genesis_hash"`
+	// Snapshots are the UTXO set snapshots a new chain may be loaded from
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+// Genesis is the spec of the first block of a chain
+type Genesis struct {
+	// Timestamp of the block in unix seconds, the time of creation when zero
+	Timestamp int64 `json:"timestamp"`
+	// ExtraData is written into the input of the genesis coinbase
+	ExtraData string `json:"extra_data"`
+	// Allocations are paid by the genesis coinbase. Without allocations the
+	// genesis pays to the address the chain is created for.
+	Allocations []Allocation `json:"allocations"`
+}
+
+// Snapshot pins the content hash of the UTXO set snapshot taken at a block, both in hex
+type Snapshot struct {
+	Height    int    `json:"height"`
+	BlockHash string `json:"block_hash"`
+	Hash      string `json:"hash"`
+}
+
+// Allocation credits an address in the genesis
+type Allocation struct {
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
+}
+
+var (
+	Mainnet = ChainParams{
+		Name:                 "mainnet",
+		Magic:                0x53454e54,
+		AddressVersion:       0x00,
+		DefaultPort:          "3000",
+		DefaultPeers:         []string{"localhost:3000"},
+		Difficulty:           18,
+		BlockReward:          10,
+		UTXOCommitmentHeight: 1,
+		MedianTimeBlocks:     11,
+		MaxFutureBlockTime:   2 * 60 * 60,
+		MaxBlockSize:         1 << 20,
+		MaxTxSize:            100 << 10,
+		MaxBlockTxs:          10000,
+		Genesis:              Genesis{ExtraData: "First transaction from Genesis"},
+	}
+
+	Testnet = ChainParams{
+		Name:                 "testnet",
+		Magic:                0x0b110907,
+		AddressVersion:       0x6f,
+		DefaultPort:          "13000",
+		DefaultPeers:         []string{"localhost:13000"},
+		Difficulty:           16,
+		BlockReward:          10,
+		UTXOCommitmentHeight: 1,
+		MedianTimeBlocks:     11,
+		MaxFutureBlockTime:   2 * 60 * 60,
+		MaxBlockSize:         1 << 20,
+		MaxTxSize:            100 << 10,
+		MaxBlockTxs:          10000,
+		Genesis:              Genesis{ExtraData: "First transaction from the Testnet Genesis"},
+	}
+
+	// Regtest mines almost instantly, for tests and local development
+	Regtest = ChainParams{
+		Name:                 "regtest",
+		Magic:                0xfabfb5da,
+		AddressVersion:       0x3c,
+		DefaultPort:          "23000",
+		DefaultPeers:         []string{"localhost:23000"},
+		Difficulty:           4,
+		BlockReward:          10,
+		UTXOCommitmentHeight: 1,
+		MedianTimeBlocks:     11,
+		MaxFutureBlockTime:   2 * 60 * 60,
+		MaxBlockSize:         1 << 20,
+		MaxTxSize:            100 << 10,
+		MaxBlockTxs:          10000,
+		Genesis:              Genesis{ExtraData: "First transaction from the Regtest Genesis"},
+	}
+
+	presets = map[string]*ChainParams{
+		Mainnet.Name: &Mainnet,
+		Testnet.Name: &Testnet,
+		Regtest.Name: &Regtest,
+	}
+)
+
+// Networks lists the names of the presets
+func Networks() []string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ByName returns a copy of the preset of a network
+func ByName(name string) (*ChainParams, error) {
+	preset, ok := presets[name]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownNetwork, "%q, use one of %v", name, Networks())
+	}
+	p := *preset
+	p.DefaultPeers = append([]string{}, preset.DefaultPeers...)
+	p.Genesis.Allocations = append([]Allocation{}, preset.Genesis.Allocations...)
+	p.Snapshots = append([]Snapshot{}, preset.Snapshots...)
+	return &p, nil
+}
+
+// Load reads chain parameters from a JSON file. Fields missing from the file
+// are taken from the preset of the network named in it, or from mainnet.
+func Load(file string) (*ChainParams, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading the chain parameters")
+	}
+	var named struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(content, &named); err != nil {
+		return nil, errors.Wrapf(err, "error decoding the chain parameters in %s", file)
+	}
+	base := Mainnet.Name
+	if _, ok := presets[named.Name]; ok {
+		base = named.Name
+	}
+	p, err := ByName(base)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, errors.Wrapf(err, "error decoding the chain parameters in %s", file)
+	}
+	return p, errors.Wrapf(p.Validate(), "invalid chain parameters in %s", file)
+}
+
+// Validate checks the parameters can run a chain
+func (p *ChainParams) Validate() error {
+	switch {
+	case p.Name == "":
+		return errors.New("the network needs a name")
+	case p.Difficulty < 1 || p.Difficulty > 255:
+		return errors.Errorf("difficulty %d is not between 1 and 255", p.Difficulty)
+	case p.BlockReward < 0:
+		return errors.Errorf("block reward %d is negative", p.BlockReward)
+	case p.UTXOCommitmentHeight < 0:
+		return errors.Errorf("UTXO commitment height %d is negative", p.UTXOCommitmentHeight)
+	case p.MedianTimeBlocks < 0:
+		return errors.Errorf("median time blocks %d is negative", p.MedianTimeBlocks)
+	case p.MaxFutureBlockTime < 0:
+		return errors.Errorf("max future block time %d is negative", p.MaxFutureBlockTime)
+	case p.MaxBlockSize < 1:
+		return errors.Errorf("max block size %d is not positive", p.MaxBlockSize)
+	case p.MaxTxSize < 1 || p.MaxTxSize > p.MaxBlockSize:
+		return errors.Errorf("max transaction size %d is not between 1 and the max block size %d", p.MaxTxSize, p.MaxBlockSize)
+	case p.MaxBlockTxs < 1:
+		return errors.Errorf("max block transactions %d is not positive", p.MaxBlockTxs)
+	case p.DefaultPort == "":
+		return errors.New("the network needs a default port")
+	}
+	if _, err := hex.DecodeString(p.GenesisHash); err != nil {
+		return errors.Wrapf(err, "genesis hash %q is not hex", p.GenesisHash)
+	}
+	for _, allocation := range p.Genesis.Allocations {
+		if allocation.Amount <= 0 {
+			return errors.Errorf("genesis allocation of %d to %s is not positive", allocation.Amount, allocation.Address)
+		}
+	}
+	for _, snapshot := range p.Snapshots {
+		if snapshot.Height < 0 {
+			return errors.Errorf("snapshot height %d is negative", snapshot.Height)
+		}
+		if _, err := hex.DecodeString(snapshot.BlockHash); err != nil || snapshot.BlockHash == "" {
+			return errors.Errorf("snapshot block hash %q is not hex", snapshot.BlockHash)
+		}
+		if _, err := hex.DecodeString(snapshot.Hash); err != nil || snapshot.Hash == "" {
+			return errors.Errorf("snapshot hash %q is not hex", snapshot.Hash)
+		}
+	}
+	return nil
+}
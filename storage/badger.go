@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+	"sync"
+	"syscall"
+)
+
+// valueLogFileSize keeps value log files small enough for the garbage
+// collection to rewrite them, it never touches the file being written
+const valueLogFileSize = 64 << 20
+
+// Badger is a Store kept on disk by badger
+type Badger struct {
+	DB          *badger.DB
+	dir         string
+	closing     chan struct{}
+	maintenance sync.WaitGroup
+	// mu guards closed, Close waits for the transactions in active
+	mu     sync.Mutex
+	closed bool
+	active sync.WaitGroup
+}
+
+// OpenBadger opens or creates the badger database in dir. Badger locks the
+// directory, so it fails with ErrLocked while another process, such as a
+// running node, has it open.
+func OpenBadger(dir string) (*Badger, error) {
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	opts.ValueLogFileSize = valueLogFileSize
+
+	db, err := badger.Open(opts)
+	if errors.Cause(err) == syscall.EWOULDBLOCK {
+		return nil, errors.Wrapf(ErrLocked, "error opening the database in %s", dir)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening the database in %s", dir)
+	}
+	return &Badger{DB: db, dir: dir, closing: make(chan struct{})}, nil
+}
+
+// begin registers a transaction, failing with ErrClosed once Close was called
+func (b *Badger) begin() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	b.active.Add(1)
+	return nil
+}
+
+func (b *Badger) View(fn func(txn Txn) error) error {
+	if err := b.begin(); err != nil {
+		return err
+	}
+	defer b.active.Done()
+	return b.DB.View(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+func (b *Badger) Update(fn func(txn Txn) error) error {
+	if err := b.begin(); err != nil {
+		return err
+	}
+	defer b.active.Done()
+	return b.DB.Update(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+// Close stops the background maintenance and closes the database once the
+// running transactions are done, later ones fail with ErrClosed
+func (b *Badger) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mu.Unlock()
+	close(b.closing)
+	b.maintenance.Wait()
+	b.active.Wait()
+	return b.DB.Close()
+}
+
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+func (t badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (t badgerTxn) Set(key, value []byte) error {
+	if err := t.txn.Set(key, value); err != badger.ErrReadOnlyTxn {
+		return err
+	}
+	return ErrReadOnly
+}
+
+func (t badgerTxn) Delete(key []byte) error {
+	if err := t.txn.Delete(key); err != badger.ErrReadOnlyTxn {
+		return err
+	}
+	return ErrReadOnly
+}
+
+func (t badgerTxn) NewIterator(opts IteratorOptions) Iterator {
+	itOpts := badger.DefaultIteratorOptions
+	itOpts.PrefetchValues = !opts.KeysOnly
+	it := t.txn.NewIterator(itOpts)
+	it.Seek(opts.Prefix)
+	return &badgerIterator{it, opts.Prefix}
+}
+
+type badgerIterator struct {
+	it     *badger.Iterator
+	prefix []byte
+}
+
+func (i *badgerIterator) Valid() bool {
+	return i.it.ValidForPrefix(i.prefix)
+}
+
+func (i *badgerIterator) Next() {
+	i.it.Next()
+}
+
+func (i *badgerIterator) Seek(key []byte) {
+	i.it.Seek(key)
+}
+
+func (i *badgerIterator) Key() []byte {
+	return i.it.Item().KeyCopy(nil)
+}
+
+func (i *badgerIterator) Value() ([]byte, error) {
+	return i.it.Item().ValueCopy(nil)
+}
+
+func (i *badgerIterator) Close() {
+	i.it.Close()
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMaintenanceInterval is how often the value log is garbage collected by default
+	DefaultMaintenanceInterval = 10 * time.Minute
+	// DefaultDiscardRatio is the share of a value log file that must be stale
+	// for the garbage collection to rewrite it, as recommended by badger
+	DefaultDiscardRatio = 0.5
+)
+
+// MaintenanceOptions configure the background maintenance of a badger database
+type MaintenanceOptions struct {
+	// Interval between two runs, DefaultMaintenanceInterval when zero, a negative interval disables them
+	Interval time.Duration
+	// DiscardRatio, between 0 and 1, DefaultDiscardRatio when zero
+	DiscardRatio float64
+	// MinValueLogSize skips the garbage collection while the value log is smaller
+	MinValueLogSize int64
+	// Report, when set, is called after every run
+	Report func(MaintenanceReport)
+}
+
+func (opts MaintenanceOptions) interval() time.Duration {
+	if opts.Interval == 0 {
+		return DefaultMaintenanceInterval
+	}
+	return opts.Interval
+}
+
+func (opts MaintenanceOptions) discardRatio() float64 {
+	if opts.DiscardRatio == 0 {
+		return DefaultDiscardRatio
+	}
+	return opts.DiscardRatio
+}
+
+// Validate refuses a discard ratio badger does not accept
+func (opts MaintenanceOptions) Validate() error {
+	if opts.DiscardRatio < 0 || opts.DiscardRatio >= 1 {
+		return errors.Errorf("discard ratio %v is not between 0 and 1", opts.DiscardRatio)
+	}
+	return nil
+}
+
+// DiskUsage is the size of the files of a badger database in bytes
+type DiskUsage struct {
+	LSM      int64
+	ValueLog int64
+}
+
+// Total size of the database
+func (u DiskUsage) Total() int64 {
+	return u.LSM + u.ValueLog
+}
+
+// MaintenanceReport describes a maintenance run
+type MaintenanceReport struct {
+	Before DiskUsage
+	After  DiskUsage
+	// Rewrites is the number of value log files the garbage collection rewrote
+	Rewrites int
+	// Skipped is set when the value log was below MinValueLogSize
+	Skipped bool
+	Err     error
+}
+
+// DiskUsage adds up the table and value log files of the database
+func (b *Badger) DiskUsage() (DiskUsage, error) {
+	var usage DiskUsage
+	err := filepath.Walk(b.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(path, ".sst"):
+			usage.LSM += info.Size()
+		case strings.HasSuffix(path, ".vlog"):
+			usage.ValueLog += info.Size()
+		}
+		return nil
+	})
+	return usage, errors.Wrapf(err, "error measuring the database in %s", b.dir)
+}
+
+// CollectGarbage rewrites value log files until one has less than
+// discardRatio of stale values and returns the number of files rewritten.
+// Space of deleted and overwritten keys is only reclaimed this way.
+func (b *Badger) CollectGarbage(discardRatio float64) (int, error) {
+	if err := b.begin(); err != nil {
+		return 0, err
+	}
+	defer b.active.Done()
+	rewrites := 0
+	for {
+		err := b.DB.RunValueLogGC(discardRatio)
+		switch err {
+		case nil:
+			rewrites++
+		case badger.ErrNoRewrite, badger.ErrRejected:
+			return rewrites, nil
+		default:
+			return rewrites, errors.Wrap(err, "error collecting the value log garbage")
+		}
+	}
+}
+
+// Maintain runs the garbage collection once, see MaintenanceOptions
+func (b *Badger) Maintain(opts MaintenanceOptions) MaintenanceReport {
+	var report MaintenanceReport
+	report.Before, report.Err = b.DiskUsage()
+	if report.Err != nil {
+		return report
+	}
+	report.After = report.Before
+	if report.Before.ValueLog < opts.MinValueLogSize {
+		report.Skipped = true
+		return report
+	}
+	report.Rewrites, report.Err = b.CollectGarbage(opts.discardRatio())
+	if report.Err == nil {
+		report.After, report.Err = b.DiskUsage()
+	}
+	return report
+}
+
+// StartMaintenance runs Maintain in the background at the interval of opts
+// until the database is closed
+func (b *Badger) StartMaintenance(opts MaintenanceOptions) {
+	interval := opts.interval()
+	if interval < 0 {
+		return
+	}
+	b.maintenance.Add(1)
+	go func() {
+		defer b.maintenance.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report := b.Maintain(opts)
+				if opts.Report != nil {
+					opts.Report(report)
+				}
+			case <-b.closing:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Memory is a Store keeping everything in memory, for tests and simulations
+type Memory struct {
+	mu     sync.RWMutex
+	data   map[string][]byte
+	closed bool
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{data: make(map[string][]byte)}
+}
+
+func (m *Memory) View(fn func(txn Txn) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+	return fn(&memoryTxn{store: m})
+}
+
+func (m *Memory) Update(fn func(txn Txn) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	txn := &memoryTxn{store: m, writes: make(map[string]*[]byte)}
+	if err := fn(txn); err != nil {
+		return err
+	}
+	for key, value := range txn.writes {
+		if value == nil {
+			delete(m.data, key)
+		} else {
+			m.data[key] = *value
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.data = nil
+	return nil
+}
+
+// memoryTxn sees the store plus its own pending writes, a nil write is a delete
+type memoryTxn struct {
+	store  *Memory
+	writes map[string]*[]byte
+}
+
+func (t *memoryTxn) lookup(key string) ([]byte, bool) {
+	if value, ok := t.writes[key]; ok {
+		if value == nil {
+			return nil, false
+		}
+		return *value, true
+	}
+	value, ok := t.store.data[key]
+	return value, ok
+}
+
+func (t *memoryTxn) Get(key []byte) ([]byte, error) {
+	value, ok := t.lookup(string(key))
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (t *memoryTxn) Set(key, value []byte) error {
+	if t.writes == nil {
+		return ErrReadOnly
+	}
+	stored := append([]byte{}, value...)
+	t.writes[string(key)] = &stored
+	return nil
+}
+
+func (t *memoryTxn) Delete(key []byte) error {
+	if t.writes == nil {
+		return ErrReadOnly
+	}
+	t.writes[string(key)] = nil
+	return nil
+}
+
+func (t *memoryTxn) NewIterator(opts IteratorOptions) Iterator {
+	prefix := string(opts.Prefix)
+	var keys []string
+	for key := range t.store.data {
+		if _, written := t.writes[key]; !written && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for key, value := range t.writes {
+		if value != nil && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return &memoryIterator{txn: t, keys: keys}
+}
+
+// memoryIterator walks over the keys present when it was created
+type memoryIterator struct {
+	txn  *memoryTxn
+	keys []string
+	pos  int
+}
+
+func (i *memoryIterator) Valid() bool {
+	return i.pos < len(i.keys)
+}
+
+func (i *memoryIterator) Next() {
+	i.pos++
+}
+
+func (i *memoryIterator) Seek(key []byte) {
+	i.pos = sort.Search(len(i.keys), func(n int) bool {
+		return bytes.Compare([]byte(i.keys[n]), key) >= 0
+	})
+}
+
+func (i *memoryIterator) Key() []byte {
+	return []byte(i.keys[i.pos])
+}
+
+func (i *memoryIterator) Value() ([]byte, error) {
+	value, ok := i.txn.lookup(i.keys[i.pos])
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (i *memoryIterator) Close() {}
@@ -0,0 +1,53 @@
+// Package storage defines the key-value store the chain keeps its data in,
+// with a badger backed implementation for nodes and an in-memory one for
+// tests and simulations.
+package storage
+
+import "github.com/pkg/errors"
+
+// Errors returned by the stores, compare them against errors.Cause(err)
+var (
+	ErrKeyNotFound = errors.New("key not found")
+	ErrClosed      = errors.New("store is closed")
+	ErrReadOnly    = errors.New("transaction is read-only")
+	// ErrLocked is returned when another process has the database open
+	ErrLocked = errors.New("database is in use by another process")
+)
+
+// Store is a transactional key-value store. View runs fn in a read-only
+// transaction and Update in a read-write one whose writes are only applied
+// when fn returns nil. Transactions must not be nested.
+type Store interface {
+	View(fn func(txn Txn) error) error
+	Update(fn func(txn Txn) error) error
+	Close() error
+}
+
+// Txn reads and writes keys inside a transaction. Slices returned by Get
+// and by the iterators are copies the caller may keep.
+type Txn interface {
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	NewIterator(opts IteratorOptions) Iterator
+}
+
+// IteratorOptions select the keys an iterator walks over
+type IteratorOptions struct {
+	// Prefix limits the iteration to the keys starting with it
+	Prefix []byte
+	// KeysOnly tells the store values will not be read
+	KeysOnly bool
+}
+
+// Iterator walks over keys in ascending order, starting at the first key with
+// the prefix of its options. It must be closed before its transaction ends.
+type Iterator interface {
+	Valid() bool
+	Next()
+	// Seek moves to the first key greater than or equal to key
+	Seek(key []byte)
+	Key() []byte
+	Value() ([]byte, error)
+	Close()
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// stores opens every implementation, the returned function closes and removes it
+var stores = []struct {
+	name string
+	open func(t *testing.T) (Store, func())
+}{
+	{"memory", func(t *testing.T) (Store, func()) {
+		store := NewMemory()
+		return store, func() { store.Close() }
+	}},
+	{"badger", func(t *testing.T) (Store, func()) {
+		dir, err := ioutil.TempDir("", "sentinel-storage")
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := OpenBadger(dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		return store, func() {
+			store.Close()
+			os.RemoveAll(dir)
+		}
+	}},
+}
+
+func set(t *testing.T, store Store, pairs ...string) {
+	err := store.Update(func(txn Txn) error {
+		for i := 0; i < len(pairs); i += 2 {
+			if err := txn.Set([]byte(pairs[i]), []byte(pairs[i+1])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(store Store, key string) (string, error) {
+	var value []byte
+	err := store.View(func(txn Txn) error {
+		var err error
+		value, err = txn.Get([]byte(key))
+		return err
+	})
+	return string(value), err
+}
+
+// keys lists the keys with prefix in the order the iterator walks them,
+// starting at seek when it is not empty
+func keys(t *testing.T, store Store, prefix, seek string) []string {
+	var found []string
+	err := store.View(func(txn Txn) error {
+		it := txn.NewIterator(IteratorOptions{Prefix: []byte(prefix)})
+		defer it.Close()
+		if len(seek) > 0 {
+			it.Seek([]byte(seek))
+		}
+		for ; it.Valid(); it.Next() {
+			value, err := it.Value()
+			if err != nil {
+				return err
+			}
+			found = append(found, fmt.Sprintf("%s=%s", it.Key(), value))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestStores(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store Store)
+	}{
+		{"get a set key", func(t *testing.T, store Store) {
+			set(t, store, "a", "1")
+			if value, err := get(store, "a"); err != nil || value != "1" {
+				t.Errorf("got %q, %v, want 1", value, err)
+			}
+		}},
+		{"get a missing key", func(t *testing.T, store Store) {
+			if _, err := get(store, "missing"); err != ErrKeyNotFound {
+				t.Errorf("got %v, want key not found", err)
+			}
+		}},
+		{"overwrite a key", func(t *testing.T, store Store) {
+			set(t, store, "a", "1")
+			set(t, store, "a", "2")
+			if value, err := get(store, "a"); err != nil || value != "2" {
+				t.Errorf("got %q, %v, want 2", value, err)
+			}
+		}},
+		{"delete a key", func(t *testing.T, store Store) {
+			set(t, store, "a", "1", "b", "2")
+			err := store.Update(func(txn Txn) error {
+				return txn.Delete([]byte("a"))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := get(store, "a"); err != ErrKeyNotFound {
+				t.Errorf("got %v, want key not found", err)
+			}
+			if value, err := get(store, "b"); err != nil || value != "2" {
+				t.Errorf("got %q, %v, want 2", value, err)
+			}
+		}},
+		{"failed update is discarded", func(t *testing.T, store Store) {
+			set(t, store, "a", "1")
+			failure := errors.New("failure")
+			err := store.Update(func(txn Txn) error {
+				if err := txn.Set([]byte("a"), []byte("2")); err != nil {
+					return err
+				}
+				if err := txn.Set([]byte("b"), []byte("2")); err != nil {
+					return err
+				}
+				return failure
+			})
+			if err != failure {
+				t.Errorf("got %v, want the error of the update", err)
+			}
+			if value, err := get(store, "a"); err != nil || value != "1" {
+				t.Errorf("got %q, %v, want 1", value, err)
+			}
+			if _, err := get(store, "b"); err != ErrKeyNotFound {
+				t.Errorf("got %v, want key not found", err)
+			}
+		}},
+		{"update sees its own writes", func(t *testing.T, store Store) {
+			set(t, store, "p-1", "1", "p-2", "2")
+			err := store.Update(func(txn Txn) error {
+				if err := txn.Set([]byte("p-3"), []byte("3")); err != nil {
+					return err
+				}
+				if err := txn.Delete([]byte("p-1")); err != nil {
+					return err
+				}
+				value, err := txn.Get([]byte("p-3"))
+				if err != nil || string(value) != "3" {
+					return errors.Errorf("got %q, %v, want 3", value, err)
+				}
+				if _, err := txn.Get([]byte("p-1")); err != ErrKeyNotFound {
+					return errors.Errorf("got %v for a deleted key, want key not found", err)
+				}
+				it := txn.NewIterator(IteratorOptions{Prefix: []byte("p-")})
+				defer it.Close()
+				var found []string
+				for ; it.Valid(); it.Next() {
+					found = append(found, string(it.Key()))
+				}
+				if fmt.Sprint(found) != "[p-2 p-3]" {
+					return errors.Errorf("iterated over %v, want [p-2 p-3]", found)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}},
+		{"view is read-only", func(t *testing.T, store Store) {
+			err := store.View(func(txn Txn) error {
+				return txn.Set([]byte("a"), []byte("1"))
+			})
+			if errors.Cause(err) != ErrReadOnly {
+				t.Errorf("got %v, want read-only", err)
+			}
+			err = store.View(func(txn Txn) error {
+				return txn.Delete([]byte("a"))
+			})
+			if errors.Cause(err) != ErrReadOnly {
+				t.Errorf("got %v, want read-only", err)
+			}
+		}},
+		{"iterate over a prefix in key order", func(t *testing.T, store Store) {
+			set(t, store, "b-2", "x", "a-1", "y", "b-10", "z", "b-1", "w", "c-1", "v", "b", "u")
+			got := fmt.Sprint(keys(t, store, "b-", ""))
+			if want := "[b-1=w b-10=z b-2=x]"; got != want {
+				t.Errorf("iterated over %s, want %s", got, want)
+			}
+			got = fmt.Sprint(keys(t, store, "", ""))
+			if want := "[a-1=y b=u b-1=w b-10=z b-2=x c-1=v]"; got != want {
+				t.Errorf("iterated over %s, want %s", got, want)
+			}
+		}},
+		{"keys are ordered by bytes", func(t *testing.T, store Store) {
+			set(t, store, "k\xff", "3", "k\x00", "1", "k\x01", "2")
+			got := fmt.Sprintf("%q", keys(t, store, "k", ""))
+			if want := `["k\x00=1" "k\x01=2" "k\xff=3"]`; got != want {
+				t.Errorf("iterated over %s, want %s", got, want)
+			}
+		}},
+		{"seek within a prefix", func(t *testing.T, store Store) {
+			set(t, store, "h-1", "a", "h-3", "b", "h-5", "c", "i-1", "d")
+			got := fmt.Sprint(keys(t, store, "h-", "h-2"))
+			if want := "[h-3=b h-5=c]"; got != want {
+				t.Errorf("iterated over %s, want %s", got, want)
+			}
+			got = fmt.Sprint(keys(t, store, "h-", "h-6"))
+			if want := "[]"; got != want {
+				t.Errorf("iterated over %s, want %s", got, want)
+			}
+		}},
+		{"empty prefix", func(t *testing.T, store Store) {
+			if found := keys(t, store, "none-", ""); len(found) != 0 {
+				t.Errorf("iterated over %v, want nothing", found)
+			}
+		}},
+		{"returned slices are copies", func(t *testing.T, store Store) {
+			set(t, store, "a", "1")
+			err := store.View(func(txn Txn) error {
+				value, err := txn.Get([]byte("a"))
+				if err != nil {
+					return err
+				}
+				value[0] = '2'
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value, err := get(store, "a"); err != nil || value != "1" {
+				t.Errorf("got %q, %v, want 1", value, err)
+			}
+		}},
+		{"closed store", func(t *testing.T, store Store) {
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := get(store, "a"); err != ErrClosed {
+				t.Errorf("view got %v, want closed", err)
+			}
+			err := store.Update(func(txn Txn) error { return nil })
+			if err != ErrClosed {
+				t.Errorf("update got %v, want closed", err)
+			}
+		}},
+	}
+
+	for _, s := range stores {
+		for _, test := range tests {
+			store, done := s.open(t)
+			t.Run(s.name+"/"+test.name, func(t *testing.T) {
+				test.run(t, store)
+			})
+			done()
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package wallet
+
+import "github.com/pkg/errors"
+
+// Errors returned by the package, possibly wrapped with more context.
+// Compare them against errors.Cause(err).
+var (
+	ErrUnknownWallet  = errors.New("unknown wallet")
+	ErrInvalidAddress = errors.New("invalid address")
+	ErrCorruptWallets = errors.New("corrupt wallets file")
+)
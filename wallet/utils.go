@@ -1,9 +1,8 @@
 package wallet
 
 import (
-	"fmt"
-	"log"
 	"github.com/mr-tron/base58"
+	"github.com/pkg/errors"
 )
 
 // Base58Encode bytes
@@ -13,25 +12,33 @@ func Base58Encode(input []byte) []byte {
 }
 
 // Base58Decode bytes
-func Base58Decode(input []byte) []byte {
+func Base58Decode(input []byte) ([]byte, error) {
 	decode, err := base58.Decode(string(input[:]))
-	if (err != nil) {
-		log.Panicf("error decoding base58: %v", err)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidAddress, "error decoding base58: %v", err)
 	}
-	return decode
+	return decode, nil
 }
 
-// Address is the wallet address
-func (w Wallet) Address() []byte{
+// Address is the wallet address on the network with the given address version
+func (w Wallet) Address(version byte) []byte {
 	pubHash := PublicKeyHash(w.PublicKey)
 	versionedHash := append([]byte{version}, pubHash...)
 	checksum := Checksum(versionedHash)
 	fullHash := append(versionedHash, checksum...)
 	address := Base58Encode(fullHash)
 
-	fmt.Printf("public key: %x\n", w.PublicKey)
-	fmt.Printf("public hash: %x\n", pubHash)
-	fmt.Printf("address: %s\n", address)
-
 	return address
-}
\ No newline at end of file
+}
+
+// AddressPublicKeyHash extracts the public key hash an address of any network pays to
+func AddressPublicKeyHash(address string) ([]byte, error) {
+	if !validChecksum(address) {
+		return nil, errors.Wrapf(ErrInvalidAddress, "%q", address)
+	}
+	pubKeyHash, err := Base58Decode([]byte(address))
+	if err != nil {
+		return nil, err
+	}
+	return pubKeyHash[1 : len(pubKeyHash)-ChecksumLength], nil
+}
@@ -6,14 +6,13 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/gob"
+	"github.com/pkg/errors"
+	"math/big"
 	"golang.org/x/crypto/ripemd160"
-	"log"
 )
 
-const (
-	ChecksumLength = 4
-	version        = byte(0x00)
-)
+const ChecksumLength = 4
 
 // Wallet in the blockchain
 type Wallet struct {
@@ -21,9 +20,18 @@ type Wallet struct {
 	PublicKey []byte
 }
 
-// ValidateAddress validates an address by comparing checksum
-func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
+// ValidateAddress validates an address by comparing checksum and checks
+// it belongs to the network with the given address version
+func ValidateAddress(address string, version byte) bool {
+	decoded, err := Base58Decode([]byte(address))
+	return err == nil && validChecksum(address) && decoded[0] == version
+}
+
+func validChecksum(address string) bool {
+	pubKeyHash, err := Base58Decode([]byte(address))
+	if err != nil || len(pubKeyHash) <= 1+ChecksumLength {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash) -ChecksumLength:]
 	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1:len(pubKeyHash) -ChecksumLength]
@@ -32,34 +40,68 @@ func ValidateAddress(address string) bool {
 }
 
 // NewKeyPair generates new public/private key pair for a wallet
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
+func NewKeyPair() (ecdsa.PrivateKey, []byte, error) {
 	curve := elliptic.P256()
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
-		log.Panicf("error generating a key pair: %v", err)
+		return ecdsa.PrivateKey{}, nil, errors.Wrap(err, "error generating a key pair")
 	}
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
-	return *private, pub
+	// X and Y are padded to the same length, the key is split in half to verify signatures
+	size := (curve.Params().BitSize + 7) / 8
+	pub := make([]byte, 2*size)
+	copy(pub[size-len(private.PublicKey.X.Bytes()):size], private.PublicKey.X.Bytes())
+	copy(pub[2*size-len(private.PublicKey.Y.Bytes()):], private.PublicKey.Y.Bytes())
+	return *private, pub, nil
 }
 
 // MakeWallet creates new Wallet
-func MakeWallet() *Wallet {
-	private, public := NewKeyPair()
+func MakeWallet() (*Wallet, error) {
+	private, public, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
 	w := Wallet{
 		PrivateKey: private,
 		PublicKey: public,
 	}
-	return &w
+	return &w, nil
+}
+
+// walletData is the stored form of a wallet, the curve of the key is always P256
+type walletData struct {
+	D         []byte
+	PublicKey []byte
+}
+
+// GobEncode stores the private scalar and the public key of the wallet
+func (w *Wallet) GobEncode() ([]byte, error) {
+	var buff bytes.Buffer
+	err := gob.NewEncoder(&buff).Encode(walletData{w.PrivateKey.D.Bytes(), w.PublicKey})
+	return buff.Bytes(), errors.Wrap(err, "error encoding a wallet")
+}
+
+// GobDecode rebuilds the key pair of a wallet stored with GobEncode
+func (w *Wallet) GobDecode(data []byte) error {
+	var stored walletData
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&stored); err != nil {
+		return errors.Wrap(err, "error decoding a wallet")
+	}
+	curve := elliptic.P256()
+	x, y := curve.ScalarBaseMult(stored.D)
+	w.PrivateKey = ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+		D:         new(big.Int).SetBytes(stored.D),
+	}
+	w.PublicKey = stored.PublicKey
+	return nil
 }
 
 // PublicKeyHash hash a public key
 func PublicKeyHash(pubKey []byte) []byte {
 	pubHash := sha256.Sum256(pubKey)
 	hasher := ripemd160.New()
-	_ , err := hasher.Write(pubHash[:])
-	if err != nil {
-		log.Panicf("error with ripemd160 hash write: %v", err)
-	}
+	// writing to a hash never returns an error
+	hasher.Write(pubHash[:])
 	publicRipMd := hasher.Sum(nil)
 	return publicRipMd
 }
@@ -2,36 +2,54 @@ package wallet
 
 import (
 	"bytes"
-	"crypto/elliptic"
 	"encoding/gob"
 	"fmt"
+	"github.com/pkg/errors"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 )
 
-const walletsFile = "./tmp/wallets.data"
+const walletsFileName = "wallets.data"
 
-// Wallets of the user
+// Wallets of the user, keyed by their address on one network
 type Wallets struct {
 	Wallets map[string]*Wallet
+	file    string
+	version byte
 }
 
-// CreateWallets create user wallets
-func CreateWallets() (*Wallets, error) {
-	wallets := Wallets{}
+// FilePath is the wallets file kept in dataDir
+func FilePath(dataDir string) string {
+	return filepath.Join(dataDir, walletsFileName)
+}
+
+// OpenWallets loads the user wallets kept in dataDir for the network with the given
+// address version, starting with none when there is no wallets file yet
+func OpenWallets(dataDir string, version byte) (*Wallets, error) {
+	wallets := Wallets{file: FilePath(dataDir), version: version}
 	wallets.Wallets = make(map[string]*Wallet)
 	err := wallets.LoadFile()
 	return &wallets, err
 }
 
 // GetWallet from an address
-func (ws *Wallets) GetWallet(address string) Wallet {
-	fmt.Printf("%v\n", ws.Wallets)
-	fmt.Printf("%s\n", address)
-	w := *ws.Wallets[address]
+func (ws *Wallets) GetWallet(address string) (Wallet, error) {
+	w, ok := ws.Wallets[address]
+	if !ok {
+		return Wallet{}, errors.Wrapf(ErrUnknownWallet, "%s", address)
+	}
+	return *w, nil
+}
 
-	return w
+// FindByPublicKeyHash returns the address and wallet owning a public key hash
+func (ws *Wallets) FindByPublicKeyHash(pubKeyHash []byte) (string, *Wallet, bool) {
+	for address, w := range ws.Wallets {
+		if bytes.Compare(PublicKeyHash(w.PublicKey), pubKeyHash) == 0 {
+			return address, w, true
+		}
+	}
+	return "", nil, false
 }
 
 // GetAllAddresses gets all user wallet addresses
@@ -44,46 +62,53 @@ func (ws *Wallets) GetAllAddresses() []string {
 }
 
 // AddWallet to add new wallet to wallets
-func (ws *Wallets) AddWallet() string {
-	wallet := MakeWallet()
-	fmt.Println("Wallet added successfully!")
-	address := fmt.Sprintf("%s", wallet.Address())
+func (ws *Wallets) AddWallet() (string, error) {
+	wallet, err := MakeWallet()
+	if err != nil {
+		return "", err
+	}
+	address := fmt.Sprintf("%s", wallet.Address(ws.version))
 
 	ws.Wallets[address] = wallet
-	return address
+	return address, nil
 }
 
 // LoadFile reads wallets file
 func (ws *Wallets) LoadFile() error {
-	if _, err := os.Stat(walletsFile); os.IsNotExist(err) {
-		return err
+	if _, err := os.Stat(ws.file); os.IsNotExist(err) {
+		return nil
 	}
 	var wallets Wallets
-	fileContent, err := ioutil.ReadFile(walletsFile)
+	fileContent, err := ioutil.ReadFile(ws.file)
 	if err != nil {
-		log.Panicf("error reading wallets file: %v", err)
+		return errors.Wrap(err, "error reading wallets file")
 	}
-	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 	err = decoder.Decode(&wallets)
 	if err != nil {
-		log.Panicf("error decoding wallets file: %v", err)
+		return errors.Wrapf(ErrCorruptWallets, "error decoding wallets file: %v", err)
+	}
+	// key the wallets by their address on this network
+	for _, w := range wallets.Wallets {
+		ws.Wallets[fmt.Sprintf("%s", w.Address(ws.version))] = w
 	}
-	ws.Wallets = wallets.Wallets
 	return nil
 }
 
 // SaveFile saves user wallets data to e file
-func (ws *Wallets) SaveFile() {
+func (ws *Wallets) SaveFile() error {
 	var content bytes.Buffer
-	gob.Register(elliptic.P256())
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)
 	if err != nil {
-		log.Panicf("error encoding wallets: %v", err)
+		return errors.Wrap(err, "error encoding wallets")
+	}
+	if err := os.MkdirAll(filepath.Dir(ws.file), 0700); err != nil {
+		return errors.Wrap(err, "error creating the wallets directory")
 	}
-	err = ioutil.WriteFile(walletsFile, content.Bytes(), 0644)
+	err = ioutil.WriteFile(ws.file, content.Bytes(), 0600)
 	if err != nil {
-		log.Panicf("error writing wallets file: %v", err)
+		return errors.Wrap(err, "error writing wallets file")
 	}
-}
\ No newline at end of file
+	return nil
+}